@@ -0,0 +1,72 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// AckHeader is the request header set ("required") on batches when
+// acknowledgements are enabled with WithAcks. A bridge acknowledges such a
+// batch by responding with a 2xx status and a JSON body of the form
+// {"ack": "<batch id>"}, where the batch id is that of BatchIDHeader, once the
+// batch is durably stored.
+const AckHeader = "X-Sqmetrics-Ack"
+
+// maxResponseBytes is the size of the largest response body read.
+const maxResponseBytes = 64 << 10
+
+// errUnacknowledged is the error of batches that were accepted by the bridge
+// but not acknowledged.
+var errUnacknowledged = errors.New("metrics bridge did not acknowledge the batch")
+
+// WithAcks gives at-least-once delivery for metrics that must not be lost,
+// such as billing or SLA metrics: batches only count as delivered once the
+// bridge acknowledges them (see AckHeader). Batches that are not acknowledged
+// fail like those the bridge failed on, being retried (see WithRetries) and
+// then spooled (see WithSpool) to be resent until they are acknowledged.
+// Bridges may thus see the same batch several times, with the same
+// IdempotencyKeyHeader.
+func WithAcks() Option {
+	return func(mb *SquareMetrics) {
+		mb.acks = true
+	}
+}
+
+// bridgeResponse is the body of the responses of bridges that acknowledge
+// batches or report partial failures.
+type bridgeResponse struct {
+	Ack      string      `json:"ack"`
+	Rejected []Rejection `json:"rejected"`
+}
+
+// readResponse reads the body of resp, a 2xx response to the batch with the
+// given id, for acknowledgements and rejected metrics.
+func (mb *SquareMetrics) readResponse(resp *http.Response, id string) error {
+	var body bridgeResponse
+	err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&body)
+	if err == nil && len(body.Rejected) > 0 {
+		mb.recordRejections(body.Rejected)
+	}
+	if mb.acks && (err != nil || body.Ack != id) {
+		return errUnacknowledged
+	}
+	return nil
+}
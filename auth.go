@@ -0,0 +1,93 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Authorizer decides whether a request to the metrics handlers is allowed,
+// for WithAuthorizer.
+type Authorizer func(r *http.Request) bool
+
+// WithAuthorizer protects the handlers of SquareMetrics, which expose
+// internal operational data, with the given authorizer: requests it doesn't
+// allow get a 401 Unauthorized response. HealthHandler is left open for
+// readiness checks.
+func WithAuthorizer(authorize Authorizer) Option {
+	return func(mb *SquareMetrics) {
+		mb.authorize = authorize
+	}
+}
+
+// TokenAuthorizer allows requests that carry the given bearer token in their
+// Authorization header.
+func TokenAuthorizer(token string) Authorizer {
+	return func(r *http.Request) bool {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && secretsEqual(given, token)
+	}
+}
+
+// BasicAuthorizer allows requests with the given HTTP basic authentication
+// credentials.
+func BasicAuthorizer(username, password string) Authorizer {
+	return func(r *http.Request) bool {
+		givenUser, givenPassword, ok := r.BasicAuth()
+		// evaluate both, so timing doesn't reveal which one was wrong
+		userOK := secretsEqual(givenUser, username)
+		passwordOK := secretsEqual(givenPassword, password)
+		return ok && userOK && passwordOK
+	}
+}
+
+// secretsEqual compares secrets in constant time, hashing them first so that
+// their lengths aren't revealed either.
+func secretsEqual(given, want string) bool {
+	a, b := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// authorized checks a request against the authorizer, if there is one,
+// responding 401 Unauthorized if it is not allowed.
+func (mb *SquareMetrics) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if mb.authorize == nil || mb.authorize(r) {
+		return true
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// Protect wraps handler so that it is protected by the authorizer configured
+// with WithAuthorizer, like the handlers of SquareMetrics, for mounting other
+// operational handlers alongside them.
+func (mb *SquareMetrics) Protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mb.authorized(w, r) {
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// preventCaching marks a response as not to be cached, as it reflects the
+// current state of the process.
+func preventCaching(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
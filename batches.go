@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// split cuts points into batches of at most size points each, adding the
+// every points, such as the heartbeat, to each batch; they count towards its
+// size. If size is not positive, or there are fewer points, there is a single
+// batch.
+func split(points []MetricPoint, size int, every []MetricPoint) [][]MetricPoint {
+	if size > 0 {
+		// leave room for the extra points, but make progress regardless
+		size -= len(every)
+		if size < 1 {
+			size = 1
+		}
+	}
+	var batches [][]MetricPoint
+	for {
+		n := len(points)
+		if size > 0 && n > size {
+			n = size
+		}
+		// the full slice expression makes append copy rather than
+		// overwrite the next batch
+		batch := append(points[:n:n], every...)
+		batches = append(batches, batch)
+		points = points[n:]
+		if len(points) == 0 {
+			return batches
+		}
+	}
+}
+
+// postBatches delivers the batches of a publish, posting up to mb.batchPosts
+// of them concurrently, and returns the errors of those that failed.
+func (mb *SquareMetrics) postBatches(ctx context.Context, target string, batches [][]MetricPoint) error {
+	pending := int64(len(batches))
+	mb.queued(len(batches))
+	errs := make([]error, len(batches))
+
+	if mb.batchPosts <= 1 {
+		for i, batch := range batches {
+			errs[i] = mb.postBatch(ctx, target, batch)
+			mb.queued(int(atomic.AddInt64(&pending, -1)))
+		}
+		return errors.Join(errs...)
+	}
+
+	slots := make(chan struct{}, mb.batchPosts)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, batch []MetricPoint) {
+			defer wg.Done()
+			errs[i] = mb.postBatch(ctx, target, batch)
+			mb.queued(int(atomic.AddInt64(&pending, -1)))
+			<-slots
+		}(i, batch)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// queued records the number of batches of the publish in progress that are
+// waiting to be delivered, for DebugHandler and sqmetrics.batches.queued.
+func (mb *SquareMetrics) queued(batches int) {
+	mb.status.setQueued(batches)
+	mb.stats.queued(batches)
+}
+
+// sendWithRetries sends a batch, retrying up to mb.retries times with
+// exponential backoff if it fails with a transport error, a 429 or a server
+// error, or isn't acknowledged (see WithAcks). Client errors are not retried
+// since resending wouldn't help.
+func (mb *SquareMetrics) sendWithRetries(ctx context.Context, target string, body *pooledBody) (int, error) {
+	reloaded := false
+	for attempt := 0; ; attempt++ {
+		status, err := mb.send(ctx, target, body)
+		if status == http.StatusUnauthorized && !reloaded && mb.token.reload() {
+			// the credential was rotated since it was last read, resend
+			// right away without counting it as a retry
+			reloaded = true
+			attempt--
+			continue
+		}
+		if err == nil || attempt >= mb.retries || mb.dryRun != nil || !retryable(status, err) {
+			return status, err
+		}
+
+		timer := mb.clock.NewTimer(mb.backoff << attempt)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return status, err
+		case <-mb.done:
+			timer.Stop()
+			return status, err
+		}
+	}
+}
+
+func retryable(status int, err error) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500 || errors.Is(err, errUnacknowledged)
+}
@@ -0,0 +1,95 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestEveryBatchCarriesTheHeartbeat(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 5; i++ {
+		metrics.GetOrRegisterCounter(fmt.Sprintf("requests.%d", i), registry).Inc(1)
+	}
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink), sqmetrics.WithBatchSize(3),
+		sqmetrics.WithHeartbeat())
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := sink.Batches()
+	if len(batches) != 3 {
+		t.Fatalf("got %d batches, want 3", len(batches))
+	}
+	seen := map[string]bool{}
+	for i, batch := range batches {
+		if len(batch) > 3 {
+			t.Errorf("batch %d has %d points, want at most 3", i, len(batch))
+		}
+		beats := 0
+		for _, point := range batch {
+			if point.Name == "app.sqmetrics.heartbeat" {
+				beats++
+				continue
+			}
+			seen[point.Name] = true
+		}
+		if beats != 1 {
+			t.Errorf("batch %d has %d heartbeats, want 1", i, beats)
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("got %d metrics across the batches, want 5", len(seen))
+	}
+}
+
+func TestFailedBatchesAreRetried(t *testing.T) {
+	bridge := sqmetricstest.NewBridge()
+	defer bridge.Close()
+	bridge.FailNext(1, 503)
+
+	registry := metrics.NewRegistry()
+	for i := 0; i < 4; i++ {
+		metrics.GetOrRegisterCounter(fmt.Sprintf("requests.%d", i), registry).Inc(1)
+	}
+	mb := sqmetrics.NewMetrics(bridge.URL, "app", bridge.Client(), time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithBatchSize(2), sqmetrics.WithConcurrentBatches(2),
+		sqmetrics.WithRetries(1, time.Millisecond))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bridge.Requests(); got != 3 {
+		t.Errorf("got %d requests, want 2 batches and a retry", got)
+	}
+	if got := len(bridge.Points()); got != 4 {
+		t.Errorf("got %d points, want 4", got)
+	}
+}
@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+)
+
+// BatchIDHeader is the request header carrying a random UUID identifying each
+// batch, the same for every attempt at sending it, so that receivers can
+// detect duplicates.
+const BatchIDHeader = "X-Sqmetrics-Batch"
+
+// IdempotencyKeyHeader is the request header carrying the idempotency key of
+// each batch, its batch id. Every attempt at sending a batch (see WithRetries)
+// carries the same key, so that a receiver which remembers the keys of the
+// batches it processed can acknowledge a retry of one of them without
+// processing it again, and counters are not counted twice.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// SequenceHeader is the request header carrying the sequence number of each
+// batch, which starts at 1 and increases by one with every batch posted by a
+// SquareMetrics (identified by InstanceHeader), so that receivers can detect
+// gaps and reordering. Batches posted concurrently (see WithConcurrentBatches)
+// may arrive out of order.
+const SequenceHeader = "X-Sqmetrics-Sequence"
+
+// ReplayHeader is the request header set ("true") on batches delivered from
+// the spool (see WithSpool) after an outage. Their points keep the timestamps
+// they were collected at, so that the bridge backfills them into the right
+// time buckets rather than treating them as current values.
+const ReplayHeader = "X-Sqmetrics-Replay"
+
+// batchSequence numbers the batches posted.
+type batchSequence struct {
+	last uint64
+}
+
+func (s *batchSequence) next() uint64 {
+	return atomic.AddUint64(&s.last, 1)
+}
+
+// newBatchID returns a random (version 4) UUID.
+func newBatchID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
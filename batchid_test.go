@@ -0,0 +1,76 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+func TestRetriesKeepTheBatchIDAndIdempotencyKey(t *testing.T) {
+	var mutex sync.Mutex
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		headers = append(headers, r.Header.Clone())
+		if len(headers) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", registry).Inc(1)
+	mb := sqmetrics.NewMetrics(server.URL, "app", server.Client(), time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithRetries(2, time.Millisecond))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 4 {
+		t.Fatalf("got %d requests, want 3 attempts and a second batch", len(headers))
+	}
+	id := headers[0].Get(sqmetrics.BatchIDHeader)
+	if id == "" {
+		t.Fatal("no batch id sent")
+	}
+	for i, header := range headers[:3] {
+		if got := header.Get(sqmetrics.BatchIDHeader); got != id {
+			t.Errorf("attempt %d has batch id %q, want %q", i, got, id)
+		}
+		if got := header.Get(sqmetrics.IdempotencyKeyHeader); got != id {
+			t.Errorf("attempt %d has idempotency key %q, want %q", i, got, id)
+		}
+	}
+	if next := headers[3].Get(sqmetrics.IdempotencyKeyHeader); next == "" || next == id {
+		t.Errorf("second batch has idempotency key %q, want a new one", next)
+	}
+}
@@ -0,0 +1,169 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Bucketed is implemented by histograms and timers that count their values in
+// explicit buckets, for bridges and backends that can only aggregate bucketed
+// data across hosts correctly. Besides their usual fields, they are serialized
+// with a <name>.bucket for each bucket, with the cumulative count of values up
+// to its upper bound and the bound in the "le" tag, and one more for all
+// values with le="+Inf". Timer bounds are in nanoseconds.
+type Bucketed interface {
+	// Buckets returns the upper bounds of the buckets, in ascending order,
+	// and the cumulative count of values up to each bound.
+	Buckets() (bounds []int64, counts []int64)
+}
+
+// bucketCounts counts values in buckets. Each count only covers values in
+// its bucket; they are accumulated when read.
+type bucketCounts struct {
+	bounds []int64
+	counts []int64
+}
+
+func newBucketCounts(bounds []int64) *bucketCounts {
+	bounds = append([]int64(nil), bounds...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return &bucketCounts{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (b *bucketCounts) observe(v int64) {
+	i := sort.Search(len(b.bounds), func(i int) bool { return v <= b.bounds[i] })
+	if i < len(b.counts) {
+		atomic.AddInt64(&b.counts[i], 1)
+	}
+}
+
+func (b *bucketCounts) clear() {
+	for i := range b.counts {
+		atomic.StoreInt64(&b.counts[i], 0)
+	}
+}
+
+func (b *bucketCounts) Buckets() ([]int64, []int64) {
+	counts := make([]int64, len(b.counts))
+	var cumulative int64
+	for i := range b.counts {
+		cumulative += atomic.LoadInt64(&b.counts[i])
+		counts[i] = cumulative
+	}
+	return b.bounds, counts
+}
+
+type bucketedHistogram struct {
+	metrics.Histogram
+	*bucketCounts
+}
+
+// NewBucketedHistogram returns a histogram of the values in sample that also
+// counts them in buckets with the given upper bounds.
+func NewBucketedHistogram(sample metrics.Sample, bounds []int64) metrics.Histogram {
+	return &bucketedHistogram{metrics.NewHistogram(sample), newBucketCounts(bounds)}
+}
+
+// GetOrRegisterBucketedHistogram returns the histogram with the given name,
+// registering a bucketed histogram if needed.
+func GetOrRegisterBucketedHistogram(name string, registry metrics.Registry, sample metrics.Sample, bounds []int64) metrics.Histogram {
+	return registry.GetOrRegister(name, func() metrics.Histogram {
+		return NewBucketedHistogram(sample, bounds)
+	}).(metrics.Histogram)
+}
+
+func (h *bucketedHistogram) Update(v int64) {
+	h.Histogram.Update(v)
+	h.observe(v)
+}
+
+func (h *bucketedHistogram) Clear() {
+	h.Histogram.Clear()
+	h.clear()
+}
+
+type bucketedTimer struct {
+	metrics.Timer
+	*bucketCounts
+}
+
+// NewBucketedTimer returns a timer that also counts durations in buckets with
+// the given upper bounds.
+func NewBucketedTimer(bounds []time.Duration) metrics.Timer {
+	nanos := make([]int64, len(bounds))
+	for i, bound := range bounds {
+		nanos[i] = int64(bound)
+	}
+	return &bucketedTimer{metrics.NewTimer(), newBucketCounts(nanos)}
+}
+
+// GetOrRegisterBucketedTimer returns the timer with the given name,
+// registering a bucketed timer if needed.
+func GetOrRegisterBucketedTimer(name string, registry metrics.Registry, bounds []time.Duration) metrics.Timer {
+	return registry.GetOrRegister(name, func() metrics.Timer {
+		return NewBucketedTimer(bounds)
+	}).(metrics.Timer)
+}
+
+func (t *bucketedTimer) Time(f func()) {
+	start := time.Now()
+	f()
+	t.UpdateSince(start)
+}
+
+func (t *bucketedTimer) Update(d time.Duration) {
+	t.Timer.Update(d)
+	t.observe(int64(d))
+}
+
+func (t *bucketedTimer) UpdateSince(start time.Time) {
+	t.Update(time.Since(start))
+}
+
+// appendBuckets appends the bucket counts of a bucketed histogram or timer
+// with the given count, named after names (see nameCache.buckets).
+func appendBuckets(nvs []tuple, names []string, kind MetricType, count int64, counts []int64) []tuple {
+	for i, bucketCount := range counts {
+		nvs = append(nvs, tuple{names[i], bucketCount, kind})
+	}
+	if n := len(counts); n > 0 && counts[n-1] > count {
+		// updated since the count was read
+		count = counts[n-1]
+	}
+	return append(nvs, tuple{names[len(counts)], count, kind})
+}
+
+// bucketNames returns the names of the buckets of the metric called name, with
+// the le tag of each merged into any tags encoded in name. Bounds are converted
+// to unit, which is then recorded in the unit tag, unless it is 0.
+func bucketNames(name string, bounds []int64, unit time.Duration) []string {
+	base, tags := SplitTaggedName(withUnit(name, timerUnits[unit]))
+	names := make([]string, len(bounds)+1)
+	for i := range names {
+		le := "+Inf"
+		if i < len(bounds) {
+			le = formatBound(bounds[i], unit)
+		}
+		names[i] = TaggedName(base+".bucket", mergeMaps(tags, map[string]string{"le": le}))
+	}
+	return names
+}
@@ -0,0 +1,119 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer is the capacity above which buffers are left to the garbage
+// collector rather than pooled, so that one unusually large batch doesn't pin
+// its memory forever.
+const maxPooledBuffer = 16 << 20
+
+// bufferPool holds the buffers batches are serialized into, so that frequent
+// publishes don't churn large allocations.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// pooledBody is a request body backed by a pooled buffer. It hands out
+// independent readers for each attempt at sending it, and returns the buffer
+// to the pool once it has been released and the transport has closed every
+// reader, which it does once it is done writing the request.
+type pooledBody struct {
+	buf      *bytes.Buffer
+	id       string // see BatchIDHeader
+	sequence uint64 // see SequenceHeader
+	replay   bool   // see ReplayHeader
+	readers  sync.WaitGroup
+}
+
+func (b *pooledBody) reader() io.ReadCloser {
+	b.readers.Add(1)
+	return &bodyReader{Reader: bytes.NewReader(b.buf.Bytes()), done: b.readers.Done}
+}
+
+// release returns the buffer to the pool once all readers are closed. No more
+// readers may be requested afterwards.
+func (b *pooledBody) release() {
+	go func() {
+		b.readers.Wait()
+		putBuffer(b.buf)
+	}()
+}
+
+type bodyReader struct {
+	*bytes.Reader
+	done func()
+	once sync.Once
+}
+
+func (r *bodyReader) Close() error {
+	r.once.Do(r.done)
+	return nil
+}
+
+// shrinkEvery is the number of publishes after which the slices reused across
+// publishes are checked for excess capacity.
+const shrinkEvery = 100
+
+// publishScratch holds the slices a publish is built in, reused from one
+// publish to the next so that steady-state publishing allocates little. They
+// only ever grow, except that every shrinkEvery publishes those that are more
+// than twice as large as the last publish needed are let go, so that a one-off
+// spike in the number of metrics doesn't pin its memory forever.
+type publishScratch struct {
+	entries   []registryEntry
+	tuples    []tuple
+	points    []MetricPoint
+	publishes int
+}
+
+// cycle prepares the scratch space for another publish.
+func (s *publishScratch) cycle() {
+	s.publishes++
+	if s.publishes%shrinkEvery != 0 {
+		return
+	}
+	if cap(s.entries) > 2*len(s.entries) {
+		s.entries = nil
+	}
+	if cap(s.tuples) > 2*len(s.tuples) {
+		s.tuples = nil
+	}
+	if cap(s.points) > 2*len(s.points) {
+		s.points = nil
+	}
+}
@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// selfPrefix is the namespace of the metrics sqmetrics records about itself.
+const selfPrefix = "sqmetrics."
+
+// cardinalityCap limits the number of distinct metric names that are
+// serialized. Names seen by a publish once the cap is reached are unregistered
+// and counted in the sqmetrics.dropped-series counter instead, once per name.
+type cardinalityCap struct {
+	max     int
+	dropped metrics.Counter
+
+	mutex    sync.Mutex
+	admitted map[string]struct{}
+	rejected map[string]struct{} // names already counted, at most max of them
+}
+
+// admit reports whether the metric may be serialized. Metrics under selfPrefix
+// are always admitted, and don't count towards the cap. Only publishes admit
+// metrics and count rejections; other serializations, e.g. by ServeHTTP, just
+// check whether the metric would be admitted.
+func (c *cardinalityCap) admit(name string, publish bool) bool {
+	if strings.HasPrefix(name, selfPrefix) {
+		return true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.admitted[name]; ok {
+		return true
+	}
+	if len(c.admitted) < c.max {
+		if publish {
+			c.admitted[name] = struct{}{}
+			delete(c.rejected, name)
+		}
+		return true
+	}
+	if !publish {
+		return false
+	}
+	if _, counted := c.rejected[name]; !counted {
+		c.dropped.Inc(1)
+		if len(c.rejected) >= c.max {
+			c.rejected = map[string]struct{}{}
+		}
+		c.rejected[name] = struct{}{}
+	}
+	return false
+}
+
+// forget releases the slot of a metric that was unregistered.
+func (c *cardinalityCap) forget(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.admitted, name)
+}
@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+// published returns the application metrics, without the app prefix, in the
+// last batch sent to sink.
+func published(t *testing.T, sink *sqmetricstest.RecordingSink) []string {
+	batches := sink.Batches()
+	if len(batches) == 0 {
+		t.Fatal("nothing published")
+	}
+	var names []string
+	for _, point := range batches[len(batches)-1] {
+		name := strings.TrimPrefix(point.Name, "app.")
+		if !strings.HasPrefix(name, "sqmetrics.") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestMaxSeriesDropsNewNames(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		metrics.GetOrRegisterCounter(name, registry).Inc(1)
+	}
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink), sqmetrics.WithMaxSeries(2))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	names := published(t, sink)
+	if len(names) != 2 {
+		t.Fatalf("published %v, want 2 metrics", names)
+	}
+	sqmetricstest.AssertCounter(t, registry, "sqmetrics.dropped-series", sqmetricstest.Eq(1))
+	if registry.Get("a") != nil && registry.Get("b") != nil && registry.Get("c") != nil {
+		t.Error("the dropped metric is still registered")
+	}
+
+	// unregistering a metric frees its slot for a new name
+	mb.Unregister(names[0])
+	metrics.GetOrRegisterCounter("d", registry).Inc(1)
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	names = published(t, sink)
+	if len(names) != 2 || (names[0] != "d" && names[1] != "d") {
+		t.Errorf("published %v, want d to take the freed slot", names)
+	}
+	sqmetricstest.AssertCounter(t, registry, "sqmetrics.dropped-series", sqmetricstest.Eq(1))
+}
@@ -0,0 +1,200 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command sqmetrics-agent scrapes the metrics of local services from their
+// sqmetrics ServeHTTP endpoints on a schedule and publishes them to the
+// bridge, so that applications can run pull-only and delegate delivery.
+// Batches that cannot be delivered after retrying are spooled to disk, if a
+// spool directory is given, and delivered once the bridge is reachable again.
+// Spooled batches are encrypted if a key file is given.
+//
+// Usage:
+//
+//	sqmetrics-agent [flags] -bridge URL ENDPOINT...
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/fetch"
+	"github.com/square/go-sq-metrics/internal/spool"
+)
+
+var (
+	bridge   = flag.String("bridge", "", "metrics bridge URL to publish to")
+	interval = flag.Duration("interval", 30*time.Second, "scraping and publishing interval")
+	timeout  = flag.Duration("timeout", 10*time.Second, "timeout for each scrape and publish attempt")
+	retries  = flag.Int("retries", 3, "publish attempts before a batch is spooled or dropped")
+	backoff  = flag.Duration("backoff", time.Second, "delay before the first retry, doubling after each")
+	spoolDir = flag.String("spool", "", "directory to spool undelivered batches to")
+	spoolMax = flag.Int("spool-max", 1000, "maximum number of spooled batches; the oldest are dropped")
+	spoolKey = flag.String("spool-key", "", "file holding a hex encoded AES key to encrypt spooled batches with")
+)
+
+// agent scrapes endpoints and publishes what it scraped.
+type agent struct {
+	endpoints []string
+	client    *http.Client
+	spool     *spool.Spool
+}
+
+// scrape fetches the metrics of every endpoint. Endpoints that fail are
+// logged and left out of the batch.
+func (a *agent) scrape() []sqmetrics.MetricPoint {
+	results := make([][]sqmetrics.MetricPoint, len(a.endpoints))
+	var wg sync.WaitGroup
+	for i, url := range a.endpoints {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			points, err := fetch.Points(ctx, a.client, url)
+			if err != nil {
+				log.Printf("error scraping %s: %s", url, err)
+				return
+			}
+			results[i] = points
+		}(i, url)
+	}
+	wg.Wait()
+
+	var batch []sqmetrics.MetricPoint
+	for _, points := range results {
+		batch = append(batch, points...)
+	}
+	return batch
+}
+
+// publish posts a batch, retrying with exponential backoff.
+func (a *agent) publish(body []byte) error {
+	delay := *backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = a.post(body, false); err == nil || errors.Is(err, spool.ErrRejected) || attempt >= *retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post posts a batch once, marking it as replayed from the spool if replay is
+// set. Batches keep the timestamps they were scraped with.
+func (a *agent) post(body []byte, replay bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", *bridge, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if replay {
+		req.Header.Set(sqmetrics.ReplayHeader, "true")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		// resending wouldn't help
+		return fmt.Errorf("%w: metrics bridge responded with %s", spool.ErrRejected, resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("metrics bridge responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// run scrapes and publishes once. When the batch is delivered, the spool is
+// drained too.
+func (a *agent) run() {
+	batch := a.scrape()
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("error encoding metrics: %s", err)
+		return
+	}
+	if err := a.publish(body); err != nil {
+		log.Printf("error publishing %d metrics: %s", len(batch), err)
+		if a.spool != nil && !errors.Is(err, spool.ErrRejected) {
+			dropped, err := a.spool.Store(spool.Batch{Body: body})
+			for _, file := range dropped {
+				log.Printf("spool full, dropped %s", file)
+			}
+			if err != nil {
+				log.Printf("error spooling metrics: %s", err)
+			}
+		}
+		return
+	}
+	if a.spool != nil {
+		dropped, unreadable, err := a.spool.Drain(func(batch spool.Batch) error {
+			return a.post(batch.Body, true)
+		})
+		for _, file := range dropped {
+			log.Printf("metrics bridge rejected spooled %s, dropped it", file)
+		}
+		for _, file := range unreadable {
+			log.Printf("unreadable spooled batch, set aside as %s", file)
+		}
+		if err != nil {
+			log.Printf("error publishing spooled metrics: %s", err)
+		}
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -bridge URL ENDPOINT...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *bridge == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	a := &agent{endpoints: flag.Args(), client: &http.Client{}}
+	if *spoolDir != "" {
+		if err := os.MkdirAll(*spoolDir, 0o700); err != nil {
+			log.Fatalf("error creating spool: %s", err)
+		}
+		a.spool = &spool.Spool{Dir: *spoolDir, Max: *spoolMax, KeyFile: *spoolKey}
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		a.run()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,245 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command sqmetrics-check validates connectivity to a metrics bridge, so that
+// misconfiguration is caught at deploy time. It publishes a synthetic batch
+// with the given URL, prefix and credentials, using the same code path as a
+// service would, and reports the response, latency and TLS details.
+//
+// Usage:
+//
+//	sqmetrics-check -url https://bridge.example.com/metrics -prefix myservice \
+//	    -cert client.pem -key client-key.pem -ca bridge-ca.pem
+//
+// It exits with status 0 if the bridge accepted the batch, and 1 otherwise.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// certExpiryWarning is how close to expiry a certificate must be to be
+// flagged.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// headerFlags collects repeated -header flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return errors.New(`header must be of the form "Name: value"`)
+	}
+	http.Header(h).Add(strings.TrimSpace(key), strings.TrimSpace(val))
+	return nil
+}
+
+var (
+	url      = flag.String("url", "", "metrics bridge URL (required)")
+	prefix   = flag.String("prefix", "sqmetrics-check", "metrics prefix")
+	certFile = flag.String("cert", "", "client certificate file, for mutual TLS")
+	keyFile  = flag.String("key", "", "client private key file, for mutual TLS")
+	caFile   = flag.String("ca", "", "CA bundle to verify the bridge against, instead of the system roots")
+	token    = flag.String("token", "", "bearer token to send in the Authorization header")
+	timeout  = flag.Duration("timeout", 10*time.Second, "timeout for the request")
+	headers  = headerFlags{}
+)
+
+// recorder is an http.RoundTripper that adds the configured headers to
+// requests and records what happened to the last one.
+type recorder struct {
+	base    http.RoundTripper
+	headers http.Header
+
+	mutex    sync.Mutex
+	timings  timings
+	tls      *tls.ConnectionState
+	response []byte
+}
+
+// timings are the durations of each phase of a request, from its start.
+type timings struct {
+	start, dns, connect, handshake, firstByte time.Time
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, values := range r.headers {
+		req.Header[key] = values
+	}
+
+	var t timings
+	trace := &httptrace.ClientTrace{
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dns = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connect = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.handshake = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	t.start = time.Now()
+	resp, err := r.base.RoundTrip(req)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.timings = t
+	if resp == nil {
+		return resp, err
+	}
+	r.tls = resp.TLS
+
+	// keep the start of the body, to show along with error responses
+	r.response, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(r.response), resp.Body), resp.Body}
+	return resp, err
+}
+
+func main() {
+	flag.Var(headers, "header", `extra request header, "Name: value" (repeatable)`)
+	flag.Parse()
+	if *url == "" {
+		fmt.Fprintln(os.Stderr, "sqmetrics-check: -url is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig, err := clientTLS()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sqmetrics-check: %s\n", err)
+		os.Exit(1)
+	}
+	if *token != "" {
+		http.Header(headers).Set("Authorization", "Bearer "+*token)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	rec := &recorder{base: transport, headers: http.Header(headers)}
+	client := &http.Client{Transport: rec}
+
+	var event sqmetrics.PublishEvent
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterGauge("check", registry).Update(1)
+
+	// the interval is irrelevant, the batch is published by Flush
+	logger := log.New(io.Discard, "", 0)
+	sqm := sqmetrics.NewMetrics(*url, *prefix, client, time.Hour, registry, logger,
+		sqmetrics.WithPublishHook(func(e sqmetrics.PublishEvent) { event = e }))
+	defer sqm.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	err = sqm.Flush(ctx)
+
+	report(os.Stdout, rec, event, err)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// clientTLS builds the TLS configuration from the certificate flags.
+func clientTLS() (*tls.Config, error) {
+	config := &tls.Config{}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *caFile)
+		}
+	}
+	return config, nil
+}
+
+func report(w io.Writer, rec *recorder, event sqmetrics.PublishEvent, err error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	fmt.Fprintf(w, "url:       %s\n", *url)
+	fmt.Fprintf(w, "batch:     %d points, %d bytes\n", event.BatchSize, event.PayloadBytes)
+	if event.StatusCode != 0 {
+		fmt.Fprintf(w, "status:    %d %s\n", event.StatusCode, http.StatusText(event.StatusCode))
+	}
+	fmt.Fprintf(w, "latency:   %s\n", event.Duration.Round(time.Microsecond))
+
+	t := rec.timings
+	phase := func(name string, at time.Time) {
+		if !at.IsZero() {
+			fmt.Fprintf(w, "  %-9s %s\n", name, at.Sub(t.start).Round(time.Microsecond))
+		}
+	}
+	phase("dns", t.dns)
+	phase("connect", t.connect)
+	phase("tls", t.handshake)
+	phase("response", t.firstByte)
+
+	if state := rec.tls; state != nil {
+		fmt.Fprintf(w, "tls:       %s, %s\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		if state.NegotiatedProtocol != "" {
+			fmt.Fprintf(w, "  alpn      %s\n", state.NegotiatedProtocol)
+		}
+		for i, cert := range state.PeerCertificates {
+			fmt.Fprintf(w, "  cert %d    %s (issuer %s)\n", i, cert.Subject, cert.Issuer)
+			fmt.Fprintf(w, "            valid %s to %s", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly))
+			if left := time.Until(cert.NotAfter); left < certExpiryWarning {
+				fmt.Fprintf(w, " WARNING: expires in %s", left.Round(time.Hour))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(w, "FAILED:    %s\n", err)
+		if len(rec.response) > 0 {
+			fmt.Fprintf(w, "response:  %s\n", bytes.TrimSpace(rec.response))
+		}
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
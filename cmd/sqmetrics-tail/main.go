@@ -0,0 +1,188 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command sqmetrics-tail polls a metrics endpoint, such as a service's
+// sqmetrics ServeHTTP handler, and renders a live table of its metrics with
+// the change since the previous poll.
+//
+// Usage:
+//
+//	sqmetrics-tail [flags] URL [PATTERN...]
+//
+// Patterns limit the metrics shown, each either an exact name or a prefix
+// ending in "*".
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/fetch"
+)
+
+var (
+	interval = flag.Duration("interval", 2*time.Second, "polling interval")
+	timeout  = flag.Duration("timeout", 5*time.Second, "timeout for each poll")
+	sortBy   = flag.String("sort", "name", "sort order: name, value or delta")
+	changed  = flag.Bool("changed", false, "only show metrics that changed since the previous poll")
+	once     = flag.Bool("once", false, "print the metrics once and exit")
+)
+
+// row is a metric as displayed.
+type row struct {
+	name   string
+	value  float64
+	delta  float64
+	rate   float64
+	exists bool // false if there was no previous value to compare against
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] URL [PATTERN...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *sortBy {
+	case "name", "value", "delta":
+	default:
+		fmt.Fprintf(os.Stderr, "sqmetrics-tail: unknown sort order %q\n", *sortBy)
+		os.Exit(2)
+	}
+
+	url, patterns := flag.Arg(0), flag.Args()[1:]
+	client := &http.Client{}
+
+	var previous map[string]float64
+	var previousAt time.Time
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		points, err := fetch.Points(ctx, client, url)
+		cancel()
+		now := time.Now()
+
+		if !*once {
+			// clear the terminal and move the cursor home
+			fmt.Print("\033[H\033[2J")
+		}
+		fmt.Printf("%s  %s\n\n", url, now.Format(time.TimeOnly))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sqmetrics-tail: %s\n", err)
+			if *once {
+				os.Exit(1)
+			}
+		} else {
+			current := values(points, patterns)
+			render(os.Stdout, rows(current, previous, now.Sub(previousAt)))
+			previous, previousAt = current, now
+		}
+
+		if *once {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// values returns the numeric values of the points whose names match patterns.
+func values(points []sqmetrics.MetricPoint, patterns []string) map[string]float64 {
+	out := make(map[string]float64, len(points))
+	for _, point := range points {
+		value, ok := fetch.Value(point)
+		if ok && fetch.Match(point.Name, patterns) {
+			out[point.Name] = value
+		}
+	}
+	return out
+}
+
+// rows compares current values with those of the previous poll, elapsed ago.
+func rows(current, previous map[string]float64, elapsed time.Duration) []row {
+	out := make([]row, 0, len(current))
+	for name, value := range current {
+		r := row{name: name, value: value}
+		if before, ok := previous[name]; ok {
+			r.exists = true
+			r.delta = value - before
+			if elapsed > 0 {
+				r.rate = r.delta / elapsed.Seconds()
+			}
+		}
+		if *changed && (!r.exists || r.delta == 0) {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		switch *sortBy {
+		case "value":
+			if out[i].value != out[j].value {
+				return out[i].value > out[j].value
+			}
+		case "delta":
+			if di, dj := math.Abs(out[i].delta), math.Abs(out[j].delta); di != dj {
+				return di > dj
+			}
+		}
+		return out[i].name < out[j].name
+	})
+	return out
+}
+
+func render(w io.Writer, rows []row) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tVALUE\tDELTA\tRATE/s")
+	for _, r := range rows {
+		delta, rate := "", ""
+		if r.exists {
+			delta = signed(r.delta)
+			rate = signed(r.rate)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.name, format(r.value), delta, rate)
+	}
+	tw.Flush()
+}
+
+// format prints integral values without a fractional part, and others to a
+// few significant digits.
+func format(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+func signed(v float64) string {
+	if v > 0 {
+		return "+" + format(v)
+	}
+	return format(v)
+}
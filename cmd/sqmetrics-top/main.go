@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command sqmetrics-top shows the runtime metrics of one or more services,
+// polled from their sqmetrics ServeHTTP endpoints, updating live in the
+// terminal.
+//
+// Usage:
+//
+//	sqmetrics-top [flags] URL...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/fetch"
+)
+
+var (
+	interval = flag.Duration("interval", 2*time.Second, "polling interval")
+	timeout  = flag.Duration("timeout", 5*time.Second, "timeout for each poll")
+)
+
+// runtimeMetrics returns the runtime metrics among points, keyed by their
+// registry names, whatever prefix they were published with.
+func runtimeMetrics(points []sqmetrics.MetricPoint) map[string]float64 {
+	out := map[string]float64{}
+	for _, point := range points {
+		i := strings.Index(point.Name, "runtime.")
+		if i < 0 || (i > 0 && point.Name[i-1] != '.') {
+			continue
+		}
+		if value, ok := fetch.Value(point); ok {
+			out[point.Name[i:]] = value
+		}
+	}
+	return out
+}
+
+// endpoint is a polled service.
+type endpoint struct {
+	url      string
+	hostname string
+	current  map[string]float64
+	previous map[string]float64
+	elapsed  time.Duration
+	polled   time.Time
+	err      error
+}
+
+func (e *endpoint) poll(client *http.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	points, err := fetch.Points(ctx, client, e.url)
+	now := time.Now()
+	e.err = err
+	if err != nil {
+		return
+	}
+	if len(points) > 0 {
+		e.hostname = points[0].Hostname
+	}
+	if e.current != nil {
+		e.previous, e.elapsed = e.current, now.Sub(e.polled)
+	}
+	e.current, e.polled = runtimeMetrics(points), now
+}
+
+// rate is the per-second rate of change of a cumulative metric.
+func (e *endpoint) rate(name string) (float64, bool) {
+	now, ok := e.current[name]
+	before, okBefore := e.previous[name]
+	if !ok || !okBefore || e.elapsed <= 0 {
+		return 0, false
+	}
+	return (now - before) / e.elapsed.Seconds(), true
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] URL...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	endpoints := make([]*endpoint, flag.NArg())
+	for i, url := range flag.Args() {
+		endpoints[i] = &endpoint{url: url}
+	}
+
+	client := &http.Client{}
+	for {
+		var wg sync.WaitGroup
+		for _, e := range endpoints {
+			wg.Add(1)
+			go func(e *endpoint) {
+				defer wg.Done()
+				e.poll(client)
+			}(e)
+		}
+		wg.Wait()
+
+		// clear the terminal and move the cursor home
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("sqmetrics-top  %s  every %s\n\n", time.Now().Format(time.TimeOnly), *interval)
+		render(os.Stdout, endpoints)
+		time.Sleep(*interval)
+	}
+}
+
+func render(w io.Writer, endpoints []*endpoint) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tHOST\tGOROUTINES\tHEAP\tHEAP OBJECTS\tSYS\tALLOC/s\tGC/s\tGC P99\tGC MAX\tGC CPU")
+	for _, e := range endpoints {
+		if e.err != nil {
+			fmt.Fprintf(tw, "%s\t%s\terror: %s\n", e.url, e.hostname, e.err)
+			continue
+		}
+		m := e.current
+		fmt.Fprintf(tw, "%s\t%s\t%.0f\t%s\t%.0f\t%s\t%s\t%s\t%s\t%s\t%.2f%%\n",
+			e.url, e.hostname,
+			m["runtime.goroutines"],
+			byteSize(m["runtime.mem.heap.alloc"]),
+			m["runtime.mem.heap.objects"],
+			byteSize(m["runtime.mem.sys"]),
+			rateOf(e, "runtime.mem.total-alloc", byteSize),
+			rateOf(e, "runtime.mem.gc.num-gc", func(v float64) string { return fmt.Sprintf("%.2f", v) }),
+			nanos(m["runtime.mem.gc.duration.99-percentile"]),
+			nanos(m["runtime.mem.gc.duration.max"]),
+			m["runtime.mem.gc.cpu-fraction"]*100)
+	}
+	tw.Flush()
+}
+
+func rateOf(e *endpoint, name string, format func(float64) string) string {
+	rate, ok := e.rate(name)
+	if !ok {
+		return "-"
+	}
+	return format(rate)
+}
+
+// byteSize formats a byte count with a binary unit.
+func byteSize(v float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for ; v >= 1024 && i < len(units)-1; i++ {
+		v /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", v, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
+
+// nanos formats a duration given in nanoseconds.
+func nanos(v float64) string {
+	return time.Duration(v).Round(time.Microsecond).String()
+}
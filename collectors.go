@@ -0,0 +1,44 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+// Collector is a set of the system metrics groups that are collected every
+// interval, combined with |.
+type Collector uint
+
+// System metrics groups.
+const (
+	// CollectMemStats collects the runtime.mem.* memory statistics.
+	CollectMemStats Collector = 1 << iota
+	// CollectGC collects the runtime.mem.gc.* garbage collector statistics,
+	// including the histogram of GC pauses.
+	CollectGC
+	// CollectGoroutines collects runtime.goroutines and runtime.cgo-calls.
+	CollectGoroutines
+
+	// DefaultCollectors are the groups collected unless WithCollectors is used.
+	DefaultCollectors = CollectMemStats | CollectGC | CollectGoroutines
+)
+
+// WithCollectors selects which system metrics groups are collected, e.g.
+// DefaultCollectors&^CollectGC to leave out GC statistics, or 0 to collect none
+// and only update the gauges added with AddGauge.
+func WithCollectors(collectors Collector) Option {
+	return func(mb *SquareMetrics) {
+		mb.collectors = collectors
+	}
+}
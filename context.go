@@ -0,0 +1,36 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"context"
+)
+
+type batchSizeKey struct{}
+
+func withBatchSize(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, batchSizeKey{}, size)
+}
+
+// BatchSizeFromContext returns the number of metrics in the batch carried by a
+// publish request, given the request's context. It allows HTTP middleware
+// (such as a RoundTripper installed on the client passed to NewMetrics) to
+// annotate publishes; ok is false for requests that aren't publishes.
+func BatchSizeFromContext(ctx context.Context) (size int, ok bool) {
+	size, ok = ctx.Value(batchSizeKey{}).(int)
+	return
+}
@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sync"
+)
+
+// customMetric is implemented by the metric types of this package that
+// go-metrics registries can't hold, as they only hold their own types. They
+// are registered with the SquareMetrics itself, in the namespace of the main
+// registry, and flatten themselves.
+type customMetric interface {
+	flatten(names *nameCache, nvs []tuple, name string) []tuple
+}
+
+// customMetrics holds the custom metrics registered with a SquareMetrics.
+type customMetrics struct {
+	mutex   sync.RWMutex
+	metrics map[string]customMetric
+}
+
+func newCustomMetrics() *customMetrics {
+	return &customMetrics{metrics: map[string]customMetric{}}
+}
+
+// getOrRegister returns the metric with the given name, registering the one
+// returned by create if there is none.
+func (c *customMetrics) getOrRegister(name string, create func() customMetric) customMetric {
+	c.mutex.RLock()
+	metric, ok := c.metrics[name]
+	c.mutex.RUnlock()
+	if ok {
+		return metric
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if metric, ok = c.metrics[name]; !ok {
+		metric = create()
+		c.metrics[name] = metric
+	}
+	return metric
+}
+
+func (c *customMetrics) get(name string) customMetric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.metrics[name]
+}
+
+func (c *customMetrics) unregister(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.metrics, name)
+}
+
+// each calls fn with every metric, outside the lock.
+func (c *customMetrics) each(fn func(name string, metric customMetric)) {
+	c.mutex.RLock()
+	metrics := make(map[string]customMetric, len(c.metrics))
+	for name, metric := range c.metrics {
+		metrics[name] = metric
+	}
+	c.mutex.RUnlock()
+	for name, metric := range metrics {
+		fn(name, metric)
+	}
+}
@@ -0,0 +1,141 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type debugConfig struct {
+	URL          string            `json:"url"`
+	Prefix       string            `json:"prefix"`
+	Hostname     string            `json:"hostname"`
+	Interval     string            `json:"interval"`
+	Jitter       float64           `json:"jitter,omitempty"`
+	Aligned      bool              `json:"aligned,omitempty"`
+	DedupeEvery  *int              `json:"dedupe_refresh_every,omitempty"`
+	TTL          string            `json:"ttl,omitempty"`
+	Include      []string          `json:"include,omitempty"`
+	Exclude      []string          `json:"exclude,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	RewriteRules int               `json:"rewrite_rules,omitempty"`
+	SlowLanes    []string          `json:"slow_lanes,omitempty"`
+	MaxSeries    int               `json:"max_series,omitempty"`
+	DryRun       bool              `json:"dry_run,omitempty"`
+	Sink         bool              `json:"sink,omitempty"`
+	HealthProbe  string            `json:"health_probe,omitempty"`
+	Heartbeat    bool              `json:"heartbeat,omitempty"`
+	SelfMetrics  bool              `json:"self_metrics,omitempty"`
+}
+
+type debugState struct {
+	Config        debugConfig     `json:"config"`
+	LastPublish   *time.Time      `json:"last_publish,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	LastStatus    int             `json:"last_status,omitempty"`
+	BridgeHealthy bool            `json:"bridge_healthy"`
+	LastPayload   json.RawMessage `json:"last_payload,omitempty"`
+	QueuedBatches int             `json:"queued_batches"`
+	SpoolFiles    *int            `json:"spool_files,omitempty"`
+	SpoolBytes    *int64          `json:"spool_bytes,omitempty"`
+}
+
+func (mb *SquareMetrics) debugConfig() debugConfig {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+	config := debugConfig{
+		URL:          mb.url,
+		Prefix:       mb.prefix,
+		Hostname:     mb.hostname,
+		Interval:     mb.interval.String(),
+		Jitter:       mb.jitter,
+		Aligned:      mb.aligned,
+		Include:      mb.filter.include,
+		Exclude:      mb.filter.exclude,
+		Tags:         mb.tags,
+		RewriteRules: len(mb.rules),
+		DryRun:       mb.dryRun != nil,
+		Sink:         mb.sink != nil,
+		Heartbeat:    mb.heartbeat,
+		SelfMetrics:  mb.stats != nil,
+	}
+	if mb.dedupe != nil {
+		config.DedupeEvery = &mb.dedupe.refresh
+	}
+	if mb.ttl != nil {
+		config.TTL = mb.ttl.window.String()
+	}
+	for _, lane := range mb.lanes.lanes {
+		for _, pattern := range lane.patterns {
+			config.SlowLanes = append(config.SlowLanes, pattern+" every "+time.Duration(lane.every*int(mb.interval)).String())
+		}
+	}
+	if mb.seriesCap != nil {
+		config.MaxSeries = mb.seriesCap.max
+	}
+	if mb.probe != nil {
+		config.HealthProbe = probeURL(mb.url, mb.probe.path)
+	}
+	return config
+}
+
+// DebugHandler returns an http.Handler (to be mounted at e.g. /debug/sqmetrics)
+// that describes the publisher as JSON: its effective configuration, the time
+// of the last successful publish, the last error and response status, whether
+// the bridge is believed to be healthy, the last payload that was sent, the
+// number of batches of the publish in progress waiting to be delivered and,
+// with WithSpool, the number and total size of the spooled batches.
+// It exposes internal details and should not be reachable from outside, or
+// be protected with WithAuthorizer.
+func (mb *SquareMetrics) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mb.authorized(w, r) {
+			return
+		}
+		state := debugState{
+			Config:        mb.debugConfig(),
+			BridgeHealthy: mb.probe == nil || !mb.probe.unhealthy.Load(),
+		}
+
+		mb.status.mutex.Lock()
+		if !mb.status.lastSuccess.IsZero() {
+			lastSuccess := mb.status.lastSuccess
+			state.LastPublish = &lastSuccess
+		}
+		if mb.status.lastError != nil {
+			state.LastError = mb.status.lastError.Error()
+		}
+		state.LastStatus = mb.status.lastStatus
+		state.LastPayload = append(json.RawMessage(nil), mb.status.lastPayload...)
+		state.QueuedBatches = mb.status.queued
+		mb.status.mutex.Unlock()
+
+		if mb.spool != nil {
+			if files, size, err := mb.spool.Len(); err == nil {
+				state.SpoolFiles, state.SpoolBytes = &files, &size
+			}
+		}
+
+		preventCaching(w)
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(state)
+	})
+}
@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestDebugHandlerReportsTheSpool(t *testing.T) {
+	bridge := sqmetricstest.NewBridge()
+	defer bridge.Close()
+	bridge.FailNext(1, http.StatusServiceUnavailable)
+
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", registry).Inc(1)
+	mb := sqmetrics.NewMetrics(bridge.URL, "app", bridge.Client(), time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSpool(t.TempDir(), 10))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err == nil {
+		t.Fatal("publish didn't fail")
+	}
+
+	recorder := httptest.NewRecorder()
+	mb.DebugHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/sqmetrics", nil))
+	var state struct {
+		QueuedBatches int   `json:"queued_batches"`
+		SpoolFiles    int   `json:"spool_files"`
+		SpoolBytes    int64 `json:"spool_bytes"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.QueuedBatches != 0 {
+		t.Errorf("%d batches queued, want 0 once the publish is over", state.QueuedBatches)
+	}
+	if state.SpoolFiles != 1 || state.SpoolBytes <= 0 {
+		t.Errorf("spool has %d files of %d bytes, want the failed batch", state.SpoolFiles, state.SpoolBytes)
+	}
+}
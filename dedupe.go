@@ -0,0 +1,51 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+// dedupe drops metrics whose value is unchanged since the last publish. Every
+// refresh publishes, all metrics are sent so that the bridge still sees static
+// values from time to time.
+type dedupe struct {
+	refresh   int
+	publishes int
+	last      map[string]interface{}
+}
+
+func (d *dedupe) filter(nvs []tuple) []tuple {
+	full := d.publishes == 0 || (d.refresh > 0 && d.publishes%d.refresh == 0)
+	d.publishes++
+
+	// filter in place, nothing is written ahead of what has been read
+	changed := nvs[:0]
+	last := make(map[string]interface{}, len(nvs))
+	for _, nv := range nvs {
+		if previous, ok := d.last[nv.name]; full || !ok || previous != nv.value {
+			changed = append(changed, nv)
+		}
+		last[nv.name] = nv.value
+	}
+	d.last = last
+	return changed
+}
+
+// restore forgets the values of the metrics sent by a publish that failed, so
+// that the next publish sends them again.
+func (d *dedupe) restore(sent []tuple) {
+	for _, nv := range sent {
+		delete(d.last, nv.name)
+	}
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+// lastBatch returns the names of the metrics in the last batch bridge received.
+func lastBatch(t *testing.T, bridge *sqmetricstest.Bridge) []string {
+	batches := bridge.Batches()
+	if len(batches) == 0 {
+		t.Fatal("nothing received")
+	}
+	var names []string
+	for _, point := range batches[len(batches)-1] {
+		names = append(names, point.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDedupeSendsChangedMetricsAndRefreshes(t *testing.T) {
+	bridge := sqmetricstest.NewBridge()
+	defer bridge.Close()
+	registry := metrics.NewRegistry()
+	a := metrics.GetOrRegisterGauge("a", registry)
+	metrics.GetOrRegisterGauge("b", registry).Update(1)
+	mb := sqmetrics.NewMetrics(bridge.URL, "app", bridge.Client(), time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithDedupe(3))
+	defer mb.Close()
+
+	for i, want := range [][]string{
+		{"app.a", "app.b"}, // the first publish is complete
+		{"app.a"},
+		{"app.a"},
+		{"app.a", "app.b"}, // and so is every third one
+	} {
+		a.Update(int64(i))
+		if err := mb.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := lastBatch(t, bridge); !equal(got, want) {
+			t.Errorf("publish %d sent %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDedupeResendsAfterAFailedPublish(t *testing.T) {
+	bridge := sqmetricstest.NewBridge()
+	defer bridge.Close()
+	registry := metrics.NewRegistry()
+	a := metrics.GetOrRegisterGauge("a", registry)
+	metrics.GetOrRegisterGauge("b", registry).Update(1)
+	mb := sqmetrics.NewMetrics(bridge.URL, "app", bridge.Client(), time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithDedupe(0))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Update(2)
+	bridge.FailNext(1, http.StatusInternalServerError)
+	if err := mb.Flush(context.Background()); err == nil {
+		t.Fatal("publish didn't fail")
+	}
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lastBatch(t, bridge), []string{"app.a"}; !equal(got, want) {
+		t.Errorf("sent %v after the failure, want %v", got, want)
+	}
+	if point, _ := bridge.Latest("app.a"); point.Value != float64(2) {
+		t.Errorf("a = %v, want 2", point.Value)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// diffGenerations is the number of past snapshots DiffHandler remembers, and
+// so the number of clients it can serve diffs to at once.
+const diffGenerations = 16
+
+// diffState remembers the values of recent DiffHandler responses, so later
+// requests can be answered with what changed since.
+type diffState struct {
+	mutex       sync.Mutex
+	instance    string // distinguishes ids of this process from those of earlier ones
+	next        uint64
+	generations []diffGeneration
+}
+
+type diffGeneration struct {
+	id     string
+	values map[seriesKey]interface{}
+}
+
+func newDiffState() *diffState {
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	return &diffState{instance: hex.EncodeToString(nonce)}
+}
+
+// lookup returns the values of the generation with the given id, if it is
+// still remembered.
+func (d *diffState) lookup(id string) (map[seriesKey]interface{}, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, generation := range d.generations {
+		if generation.id == id {
+			return generation.values, true
+		}
+	}
+	return nil, false
+}
+
+// store remembers values as a new generation and returns its id. It takes the
+// place of the generation with the id replaces, the client's previous one, or
+// else of the oldest one if there are too many.
+func (d *diffState) store(replaces string, values map[seriesKey]interface{}) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.next++
+	id := fmt.Sprintf("%s-%d", d.instance, d.next)
+	for i, generation := range d.generations {
+		if generation.id == replaces {
+			d.generations = append(d.generations[:i], d.generations[i+1:]...)
+			break
+		}
+	}
+	if len(d.generations) == diffGenerations {
+		d.generations = append(d.generations[:0], d.generations[1:]...)
+	}
+	d.generations = append(d.generations, diffGeneration{id, values})
+	return id
+}
+
+// DiffHandler returns an http.Handler that responds with only the metrics
+// whose values changed since the client's previous request, for scraping
+// mostly-static registries. Each response has an ETag; clients pass it back in
+// an If-None-Match header (or as the since query parameter) to get the changes
+// since that response, or 304 Not Modified if there are none. Requests without
+// one, or with one that is no longer remembered, get every metric. The last
+// 16 responses are remembered, but a response to a request passing an ETag
+// takes the place of the one that ETag is from, so that up to 16 clients can
+// poll at once without pushing each other's out. Metrics
+// that were removed are not reported. The response format and query
+// parameters are otherwise those of ServeHTTP, except for pagination, and the
+// handler is protected by WithAuthorizer.
+func (mb *SquareMetrics) DiffHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mb.authorized(w, r) {
+			return
+		}
+		include, err := queryFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		since := r.URL.Query().Get("since")
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			since = strings.Trim(strings.TrimPrefix(match, "W/"), `"`)
+		}
+		previous, known := mb.diffs.lookup(since)
+
+		points := mb.snapshot(include)
+		values := make(map[seriesKey]interface{}, len(points))
+		changed := points[:0]
+		for _, point := range points {
+			key := keyOf(point)
+			values[key] = point.Value
+			if before, ok := previous[key]; !known || !ok || before != point.Value {
+				changed = append(changed, point)
+			}
+		}
+
+		if err := sortPoints(changed, r.URL.Query().Get("sort")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		preventCaching(w)
+		if known && len(changed) == 0 {
+			w.Header().Set("ETag", `"`+since+`"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"`+mb.diffs.store(since, values)+`"`)
+		mb.writePoints(w, r, changed)
+	})
+}
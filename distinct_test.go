@@ -0,0 +1,98 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+// within reports whether got is within fraction of want.
+func within(got, want int64, fraction float64) bool {
+	return math.Abs(float64(got-want)) <= fraction*float64(want)
+}
+
+func TestDistinctEstimatesDistinctItems(t *testing.T) {
+	for _, n := range []int64{10, 1000, 100000} {
+		d := sqmetrics.NewDistinct(sqmetrics.DistinctConfig{})
+		for i := int64(0); i < n; i++ {
+			// items seen more than once only count once
+			d.Add(fmt.Sprint("user-", i))
+			d.Add(fmt.Sprint("user-", i))
+		}
+		if got := d.Estimate(); !within(got, n, 0.05) {
+			t.Errorf("estimated %d distinct items, want about %d", got, n)
+		}
+	}
+}
+
+func TestEstimateSketchesMergesHosts(t *testing.T) {
+	a := sqmetrics.NewDistinct(sqmetrics.DistinctConfig{Sketch: true})
+	b := sqmetrics.NewDistinct(sqmetrics.DistinctConfig{Sketch: true})
+	for i := 0; i < 6000; i++ {
+		a.Add(fmt.Sprint("user-", i))
+	}
+	for i := 4000; i < 10000; i++ {
+		b.Add(fmt.Sprint("user-", i))
+	}
+	got, err := sqmetrics.EstimateSketches(a.Sketch(), b.Sketch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !within(got, 10000, 0.05) {
+		t.Errorf("estimated %d distinct items across hosts, want about 10000", got)
+	}
+
+	coarse := sqmetrics.NewDistinct(sqmetrics.DistinctConfig{Precision: 8})
+	if _, err := sqmetrics.EstimateSketches(a.Sketch(), coarse.Sketch()); err == nil {
+		t.Error("merged sketches of different precisions")
+	}
+}
+
+func TestDistinctIsPublishedWithItsSketch(t *testing.T) {
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, metrics.NewRegistry(), log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink))
+	defer mb.Close()
+	users := mb.Distinct("users", sqmetrics.DistinctConfig{Sketch: true})
+	for i := 0; i < 100; i++ {
+		users.Add(fmt.Sprint("user-", i))
+	}
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	point, ok := sink.Latest("app.users")
+	if !ok {
+		t.Fatal("users not published")
+	}
+	if point.Value != users.Estimate() {
+		t.Errorf("published %v, want the estimate %d", point.Value, users.Estimate())
+	}
+	if got, err := sqmetrics.EstimateSketches(point.Sketch); err != nil || got != users.Estimate() {
+		t.Errorf("published sketch estimates %d (%v), want %d", got, err, users.Estimate())
+	}
+}
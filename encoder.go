@@ -0,0 +1,46 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// JSONEncoder writes JSON values to an output stream, like *json.Encoder.
+// Each value must be followed by a newline, as json.Encoder does.
+type JSONEncoder interface {
+	Encode(v interface{}) error
+}
+
+func newStandardEncoder(w io.Writer) JSONEncoder {
+	return json.NewEncoder(w)
+}
+
+// WithJSONEncoder replaces encoding/json for serializing metrics with another
+// implementation, for registries so large that encoding dominates the cost of
+// publishing. Encoders compatible with encoding/json can be plugged in
+// directly, e.g. for jsoniter:
+//
+//	sqmetrics.WithJSONEncoder(func(w io.Writer) sqmetrics.JSONEncoder {
+//		return jsoniter.ConfigCompatibleWithStandardLibrary.NewEncoder(w)
+//	})
+func WithJSONEncoder(newEncoder func(w io.Writer) JSONEncoder) Option {
+	return func(mb *SquareMetrics) {
+		mb.newEncoder = newEncoder
+	}
+}
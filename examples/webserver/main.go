@@ -0,0 +1,161 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command webserver is an example HTTP service instrumented with sqmetrics. It
+// publishes to a local fake bridge, so it runs without any infrastructure.
+//
+// Run it with -smoke to send a few requests, flush, and exit non-zero unless
+// the bridge received the expected metrics; this doubles as an integration
+// test of the publishing path.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:8080", "address to listen on")
+	interval = flag.Duration("interval", 10*time.Second, "metrics publishing interval")
+	smoke    = flag.Bool("smoke", false, "run a smoke test against the fake bridge and exit")
+)
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// instrument wraps handler, timing each request and counting responses by
+// status code under name.
+func instrument(registry metrics.Registry, name string, handler http.Handler) http.Handler {
+	timer := metrics.GetOrRegisterTimer(name+".requests", registry)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler.ServeHTTP(sw, r)
+		timer.UpdateSince(start)
+		metrics.GetOrRegisterCounter(name+".status."+strconv.Itoa(sw.status), registry).Inc(1)
+	})
+}
+
+func main() {
+	flag.Parse()
+	logger := log.New(os.Stderr, "webserver: ", log.LstdFlags)
+
+	bridge := sqmetricstest.NewBridge()
+	defer bridge.Close()
+
+	registry := metrics.NewRegistry()
+	sqm := sqmetrics.NewMetrics(bridge.URL, "example", bridge.Client(), *interval, registry, logger,
+		sqmetrics.WithSelfMetrics(), sqmetrics.WithHistory(15*time.Minute))
+	defer sqm.Close()
+
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "hello")
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", instrument(registry, "http", hello))
+	mux.Handle("/_metrics", sqm)
+	mux.Handle("/_metrics/stream", sqm.StreamHandler())
+	mux.Handle("/_metrics/diff", sqm.DiffHandler())
+	mux.Handle("/_metrics/history", sqm.HistoryHandler())
+	mux.Handle("/_health", sqm.HealthHandler(3))
+	mux.Handle("/_debug/metrics", sqm.DebugHandler())
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	server.RegisterOnShutdown(sqm.FlushFunc(5 * time.Second))
+
+	if !*smoke {
+		logger.Printf("listening on %s, publishing to fake bridge at %s", listener.Addr(), bridge.URL)
+		logger.Fatal(server.Serve(listener))
+	}
+
+	go server.Serve(listener)
+	if err := smokeTest("http://"+listener.Addr().String(), sqm, bridge); err != nil {
+		logger.Fatalf("smoke test failed: %s", err)
+	}
+	server.Shutdown(context.Background())
+	logger.Print("smoke test passed")
+}
+
+// smokeTest sends requests to the server at base, flushes metrics, and checks
+// what the bridge received.
+func smokeTest(base string, sqm *sqmetrics.SquareMetrics, bridge *sqmetricstest.Bridge) error {
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sqm.Flush(ctx); err != nil {
+		return fmt.Errorf("flushing metrics: %s", err)
+	}
+
+	want := map[string]float64{
+		"example.http.requests.count": 3,
+		"example.http.status.200":     2,
+		"example.http.status.404":     1,
+	}
+	for name, value := range want {
+		point, ok := bridge.Latest(name)
+		if !ok {
+			return fmt.Errorf("bridge did not receive %s", name)
+		}
+		if point.Value != value {
+			return fmt.Errorf("bridge received %s = %v, want %v", name, point.Value, value)
+		}
+	}
+
+	resp, err := http.Get(base + "/_metrics")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metrics endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// maxExponentialScale is the scale exponential histograms start at, before
+// being downscaled to fit their values in the configured number of buckets.
+const maxExponentialScale = 20
+
+// Exponential is implemented by timers that aggregate durations in an
+// exponential histogram, as in OpenTelemetry, so that high dynamic range
+// latencies can be merged server-side without losing precision. The bucket at
+// index i counts the values in (base^i, base^(i+1)], where
+// base = 2^(2^-scale). Besides their usual fields, they are serialized with a
+// <name>.scale, a <name>.zero-count for values of zero, and a
+// <name>.exp-bucket for each bucket that counted values, with its index in the
+// "index" tag. Values are in nanoseconds.
+type Exponential interface {
+	// ExponentialBuckets returns the scale of the histogram, its count of
+	// values of zero, the index of its first bucket and the counts of its
+	// buckets from there on.
+	ExponentialBuckets() (scale int, zeroCount int64, offset int, counts []int64)
+}
+
+// exponentialHistogram aggregates values in exponential buckets, using the
+// highest scale at which they fit in maxBuckets buckets.
+type exponentialHistogram struct {
+	mutex      sync.Mutex
+	maxBuckets int
+	scale      int
+	zeroCount  int64
+	offset     int
+	counts     []int64
+}
+
+func newExponentialHistogram(maxBuckets int) *exponentialHistogram {
+	if maxBuckets < 1 {
+		maxBuckets = 160
+	}
+	return &exponentialHistogram{maxBuckets: maxBuckets, scale: maxExponentialScale}
+}
+
+// exponentialIndex returns the index of the bucket of v at the given scale.
+func exponentialIndex(v int64, scale int) int {
+	return int(math.Ceil(math.Log2(float64(v))*math.Exp2(float64(scale)))) - 1
+}
+
+func (h *exponentialHistogram) observe(v int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if v <= 0 {
+		h.zeroCount++
+		return
+	}
+
+	index := exponentialIndex(v, h.scale)
+	if len(h.counts) == 0 {
+		h.offset, h.counts = index, []int64{0}
+	}
+	// downscale until the range of indexes, including the new one, fits
+	for {
+		low, high := h.offset, h.offset+len(h.counts)-1
+		if index < low {
+			low = index
+		}
+		if index > high {
+			high = index
+		}
+		if high-low+1 <= h.maxBuckets {
+			break
+		}
+		h.downscale()
+		index >>= 1
+	}
+
+	if index < h.offset {
+		grown := make([]int64, h.offset-index+len(h.counts))
+		copy(grown[h.offset-index:], h.counts)
+		h.offset, h.counts = index, grown
+	} else if end := h.offset + len(h.counts); index >= end {
+		h.counts = append(h.counts, make([]int64, index-end+1)...)
+	}
+	h.counts[index-h.offset]++
+}
+
+// downscale halves the resolution, merging pairs of buckets.
+func (h *exponentialHistogram) downscale() {
+	h.scale--
+	offset := h.offset >> 1
+	counts := make([]int64, (h.offset+len(h.counts)-1)>>1-offset+1)
+	for i, count := range h.counts {
+		counts[(h.offset+i)>>1-offset] += count
+	}
+	h.offset, h.counts = offset, counts
+}
+
+func (h *exponentialHistogram) ExponentialBuckets() (int, int64, int, []int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.scale, h.zeroCount, h.offset, append([]int64(nil), h.counts...)
+}
+
+type exponentialTimer struct {
+	metrics.Timer
+	*exponentialHistogram
+}
+
+// NewExponentialTimer returns a timer that also aggregates durations in an
+// exponential histogram of at most maxBuckets buckets (160 if zero).
+func NewExponentialTimer(maxBuckets int) metrics.Timer {
+	return &exponentialTimer{metrics.NewTimer(), newExponentialHistogram(maxBuckets)}
+}
+
+// GetOrRegisterExponentialTimer returns the timer with the given name,
+// registering an exponential timer if needed.
+func GetOrRegisterExponentialTimer(name string, registry metrics.Registry, maxBuckets int) metrics.Timer {
+	return registry.GetOrRegister(name, func() metrics.Timer {
+		return NewExponentialTimer(maxBuckets)
+	}).(metrics.Timer)
+}
+
+func (t *exponentialTimer) Time(f func()) {
+	start := time.Now()
+	f()
+	t.UpdateSince(start)
+}
+
+func (t *exponentialTimer) Update(d time.Duration) {
+	t.Timer.Update(d)
+	t.observe(int64(d))
+}
+
+func (t *exponentialTimer) UpdateSince(start time.Time) {
+	t.Update(time.Since(start))
+}
+
+// appendExponential appends the scale, zero count and non-empty buckets of an
+// exponential timer called name.
+func (mb *SquareMetrics) appendExponential(nvs []tuple, name string, kind MetricType, exponential Exponential) []tuple {
+	scale, zeroCount, offset, counts := exponential.ExponentialBuckets()
+	names := mb.names.exponential(name)
+	nvs = append(nvs,
+		tuple{names.scale, int64(scale), kind},
+		tuple{names.zeroCount, zeroCount, kind},
+	)
+	for i, count := range counts {
+		if count > 0 {
+			nvs = append(nvs, tuple{names.bucket(offset + i), count, kind})
+		}
+	}
+	return nvs
+}
+
+// exponentialNames are the flattened names of an exponential timer. Bucket
+// names are computed as indexes are first seen.
+type exponentialNames struct {
+	scale, zeroCount string
+
+	base    string
+	tags    map[string]string
+	mutex   sync.Mutex
+	buckets map[int]string
+}
+
+func newExponentialNames(name string) *exponentialNames {
+	base, tags := SplitTaggedName(name)
+	return &exponentialNames{
+		scale:     TaggedName(base+".scale", tags),
+		zeroCount: TaggedName(base+".zero-count", tags),
+		base:      base,
+		tags:      tags,
+		buckets:   map[int]string{},
+	}
+}
+
+func (n *exponentialNames) bucket(index int) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	name, ok := n.buckets[index]
+	if !ok {
+		name = TaggedName(n.base+".exp-bucket", mergeMaps(n.tags, map[string]string{"index": strconv.Itoa(index)}))
+		n.buckets[index] = name
+	}
+	return name
+}
+
+// all returns every name computed so far.
+func (n *exponentialNames) all() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	names := []string{n.scale, n.zeroCount}
+	for _, name := range n.buckets {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,99 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestExponentialTimerBucketsEveryValue(t *testing.T) {
+	values := []time.Duration{0, 1, 3, 17, time.Microsecond, 250 * time.Millisecond, time.Second, time.Hour}
+	timer := sqmetrics.NewExponentialTimer(20)
+	for _, value := range values {
+		timer.Update(value)
+	}
+
+	scale, zeroCount, offset, counts := timer.(sqmetrics.Exponential).ExponentialBuckets()
+	if len(counts) > 20 {
+		t.Errorf("got %d buckets, want at most 20", len(counts))
+	}
+	if zeroCount != 1 {
+		t.Errorf("zero count is %d, want 1", zeroCount)
+	}
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total != int64(len(values)-1) {
+		t.Errorf("buckets count %d values, want %d", total, len(values)-1)
+	}
+	// bucket i counts the values in (base^i, base^(i+1)], where
+	// base = 2^(2^-scale)
+	for _, value := range values[1:] {
+		index := int(math.Ceil(math.Log2(float64(value))*math.Exp2(float64(scale)))) - 1
+		if i := index - offset; i < 0 || i >= len(counts) || counts[i] == 0 {
+			t.Errorf("%v is not in bucket %d", value, index)
+		}
+	}
+}
+
+func TestExponentialTimerIsPublished(t *testing.T) {
+	registry := metrics.NewRegistry()
+	timer := sqmetrics.GetOrRegisterExponentialTimer("latency", registry, 0)
+	timer.Update(0)
+	timer.Update(time.Millisecond)
+	timer.Update(time.Millisecond)
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	scale, _, offset, counts := timer.(sqmetrics.Exponential).ExponentialBuckets()
+	if point, ok := sink.Latest("app.latency.scale"); !ok || point.Value != int64(scale) {
+		t.Errorf("published scale %v, want %d", point.Value, scale)
+	}
+	if point, ok := sink.Latest("app.latency.zero-count"); !ok || point.Value != int64(1) {
+		t.Errorf("published zero count %v, want 1", point.Value)
+	}
+	buckets := map[string]interface{}{}
+	for _, point := range sink.Points() {
+		if point.Name == "app.latency.exp-bucket" {
+			buckets[point.Tags["index"]] = point.Value
+		}
+	}
+	for i, count := range counts {
+		if count > 0 && buckets[strconv.Itoa(offset+i)] != count {
+			t.Errorf("bucket %d published as %v, want %d", offset+i, buckets[strconv.Itoa(offset+i)], count)
+		}
+	}
+	if len(buckets) != 1 {
+		t.Errorf("published buckets %v, want only the one counting 1ms", buckets)
+	}
+}
@@ -0,0 +1,40 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import "github.com/square/go-sq-metrics/internal/pattern"
+
+// nameFilter decides which registry metrics are serialized. Patterns are
+// exact metric names, or prefixes when they end in "*" (e.g. "runtime.mem.*").
+type nameFilter struct {
+	include []string
+	exclude []string
+}
+
+// allows reports whether the metric with the given registry name should be
+// serialized: it must match an include pattern, if there are any, and must not
+// match an exclude pattern.
+func (f *nameFilter) allows(name string) bool {
+	if len(f.include) > 0 && !matchesAny(name, f.include) {
+		return false
+	}
+	return !matchesAny(name, f.exclude)
+}
+
+// matchesAny reports whether name matches any of patterns. It is shared with
+// the subpackages.
+var matchesAny = pattern.MatchAny
@@ -0,0 +1,106 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Flush publishes the current metrics right away, rather than waiting for the
+// next interval. It gives up when ctx is done, including while waiting for a
+// publish already in progress to finish. Flush does nothing if there is
+// nowhere to publish to: no bridge URL, dry run writer or sink.
+func (mb *SquareMetrics) Flush(ctx context.Context) error {
+	err := mb.postMetrics(ctx)
+	if err != nil {
+		mb.reportError(err)
+	}
+	return err
+}
+
+// FlushFunc returns a function that flushes metrics, waiting at most timeout,
+// and logs any error. It is meant to be handed to existing shutdown machinery,
+// e.g. http.Server.RegisterOnShutdown or a deferred call in main.
+func (mb *SquareMetrics) FlushFunc(timeout time.Duration) func() {
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := mb.Flush(ctx); err != nil {
+			mb.logger.Printf("error flushing metrics: %s", err)
+		}
+	}
+}
+
+// FlushOnSignal installs a handler that, when the process receives one of the
+// given signals (SIGINT and SIGTERM if none are given), flushes metrics while
+// waiting at most timeout, and then re-raises the signal with the handler
+// removed so the process terminates as it otherwise would have.
+func (mb *SquareMetrics) FlushOnSignal(timeout time.Duration, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		sig := <-ch
+		mb.FlushFunc(timeout)()
+		signal.Stop(ch)
+		if process, err := os.FindProcess(os.Getpid()); err == nil {
+			process.Signal(sig)
+		}
+	}()
+}
+
+// PublishNow asks the publish loop to publish immediately, in addition to the
+// regular schedule, without waiting for the publish to happen. Use Flush to
+// publish synchronously.
+func (mb *SquareMetrics) PublishNow() {
+	select {
+	case mb.trigger <- struct{}{}:
+	default:
+		// a publish is already pending
+	}
+}
+
+// PublishHandler returns an http.Handler that flushes metrics when it receives
+// a POST request, responding 204 No Content once the publish completed or 502
+// Bad Gateway if it failed. It is meant for admin endpoints, and is only
+// protected if an authorizer is configured with WithAuthorizer.
+func (mb *SquareMetrics) PublishHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mb.authorized(w, r) {
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := mb.Flush(r.Context()); err != nil {
+			http.Error(w, fmt.Sprintf("error publishing metrics: %s", err), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,267 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// flushInterval is the number of bytes written to a response after which it
+// is flushed to the client.
+const flushInterval = 64 << 10
+
+// flushingWriter flushes the response it writes to every flushInterval bytes,
+// so that large responses are sent as they are produced rather than buffered.
+type flushingWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	pending int
+}
+
+func newFlushingWriter(w http.ResponseWriter) *flushingWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushingWriter{w: w, flusher: flusher}
+}
+
+func (fw *flushingWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.pending += n
+	if fw.flusher != nil && fw.pending >= flushInterval {
+		fw.flusher.Flush()
+		fw.pending = 0
+	}
+	return n, err
+}
+
+// queryFilter returns a function selecting the registry names requested with
+// the prefix and match query parameters, or nil if there are none.
+func queryFilter(r *http.Request) (func(name string) bool, error) {
+	query := r.URL.Query()
+	prefixes := query["prefix"]
+	var patterns []*regexp.Regexp
+	for _, expr := range query["match"] {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match pattern: %s", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(prefixes) == 0 && len(patterns) == 0 {
+		return nil, nil
+	}
+
+	return func(name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		for _, pattern := range patterns {
+			if pattern.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// queryFlag reports whether a boolean query parameter is set, either without
+// a value (?pretty) or with a true one (?pretty=1).
+func queryFlag(query url.Values, name string) bool {
+	if !query.Has(name) {
+		return false
+	}
+	value := query.Get(name)
+	set, err := strconv.ParseBool(value)
+	return value == "" || (err == nil && set)
+}
+
+// seriesKey identifies the series of a point: names alone are not unique, as
+// the series of a TaggedRegistry share theirs.
+type seriesKey struct {
+	name string
+	tags string // the tags encoded by TaggedName
+}
+
+func keyOf(point MetricPoint) seriesKey {
+	return seriesKey{point.Name, TaggedName("", point.Tags)}
+}
+
+// less orders series by name, and series of the same name by their tags.
+func (k seriesKey) less(other seriesKey) bool {
+	if k.name != other.name {
+		return k.name < other.name
+	}
+	return k.tags < other.tags
+}
+
+// cursor encodes the key as a pagination cursor.
+func (k seriesKey) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(k.name + "\x00" + k.tags))
+}
+
+// parseCursor decodes a cursor encoded by seriesKey.cursor.
+func parseCursor(cursor string) (seriesKey, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return seriesKey{}, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	name, tags, _ := strings.Cut(string(decoded), "\x00")
+	return seriesKey{name, tags}, nil
+}
+
+// bySeries sorts points by their series keys.
+type bySeries struct {
+	points []MetricPoint
+	keys   []seriesKey
+}
+
+func (s bySeries) Len() int           { return len(s.points) }
+func (s bySeries) Less(i, j int) bool { return s.keys[i].less(s.keys[j]) }
+func (s bySeries) Swap(i, j int) {
+	s.points[i], s.points[j] = s.points[j], s.points[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// sortPoints orders points as requested with the sort query parameter.
+// Sorting by name orders points of the same name by their tags.
+func sortPoints(points []MetricPoint, order string) error {
+	switch order {
+	case "":
+	case "name":
+		keys := make([]seriesKey, len(points))
+		for i, point := range points {
+			keys[i] = keyOf(point)
+		}
+		sort.Sort(bySeries{points, keys})
+	default:
+		return fmt.Errorf("unsupported sort order %q, only \"name\" is supported", order)
+	}
+	return nil
+}
+
+// nextCursorHeader is the response header carrying the cursor of the next
+// page of a paginated response.
+const nextCursorHeader = "X-Next-Cursor"
+
+// paginate returns the page of points, sorted by name and tags, selected by
+// the limit and cursor query parameters, and the cursor of the next page if
+// there is one. Cursors are opaque to clients; they encode the last series
+// returned.
+func paginate(points []MetricPoint, query url.Values) ([]MetricPoint, string, error) {
+	if !query.Has("limit") && !query.Has("cursor") {
+		return points, "", nil
+	}
+	if err := sortPoints(points, "name"); err != nil {
+		return nil, "", err
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := parseCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start := sort.Search(len(points), func(i int) bool {
+			return after.less(keyOf(points[i]))
+		})
+		points = points[start:]
+	}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			return nil, "", fmt.Errorf("invalid limit %q, must be a positive integer", query.Get("limit"))
+		}
+		if limit < len(points) {
+			points = points[:limit]
+			return points, keyOf(points[limit-1]).cursor(), nil
+		}
+	}
+	return points, "", nil
+}
+
+// encodePretty streams points to w as an indented JSON array, for humans.
+func encodePretty(w io.Writer, points []MetricPoint) error {
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+	for i := range points {
+		element, err := json.MarshalIndent(&points[i], "  ", "  ")
+		if err != nil {
+			return err
+		}
+		separator := ",\n"
+		if i == len(points)-1 {
+			separator = "\n"
+		}
+		if _, err := fmt.Fprintf(w, "  %s%s", element, separator); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// writePoints writes the response of the metrics handlers, in the format
+// requested by r.
+func (mb *SquareMetrics) writePoints(w http.ResponseWriter, r *http.Request, points []MetricPoint) {
+	w, finish := compressed(w, r)
+	out := newFlushingWriter(w)
+
+	var err error
+	if wantsNDJSON(r) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		err = mb.encodeNDJSON(out, points)
+	} else if queryFlag(r.URL.Query(), "pretty") {
+		w.Header().Set("Content-Type", "application/json")
+		err = encodePretty(out, points)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = mb.encodePoints(out, points)
+	}
+	if finishErr := finish(); err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		mb.reportError(err)
+	}
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// encodeNDJSON streams points to w as newline-delimited JSON.
+func (mb *SquareMetrics) encodeNDJSON(w io.Writer, points []MetricPoint) error {
+	encoder := mb.newEncoder(w)
+	for i := range points {
+		if err := encoder.Encode(&points[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
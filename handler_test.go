@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// newTagged returns a SquareMetrics publishing nowhere, with a TaggedRegistry
+// holding several series named "requests".
+func newTagged(t *testing.T, options ...sqmetrics.Option) (*sqmetrics.SquareMetrics, *sqmetrics.TaggedRegistry) {
+	t.Helper()
+	registry := sqmetrics.NewTaggedRegistry(metrics.NewRegistry())
+	for i, method := range []string{"PUT", "GET", "DELETE", "POST", "HEAD"} {
+		registry.Counter("requests", sqmetrics.Tags{"method": method}).Inc(int64(i + 1))
+	}
+	options = append([]sqmetrics.Option{sqmetrics.WithCollectors(0)}, options...)
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, log.New(io.Discard, "", 0), options...)
+	t.Cleanup(mb.Close)
+	return mb, registry
+}
+
+func get(t *testing.T, handler http.Handler, url string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", url, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) []sqmetrics.MetricPoint {
+	t.Helper()
+	var points []sqmetrics.MetricPoint
+	if err := json.Unmarshal(w.Body.Bytes(), &points); err != nil {
+		t.Fatalf("decoding %q: %s", w.Body.String(), err)
+	}
+	return points
+}
+
+func TestPaginationPagesThroughTaggedSeries(t *testing.T) {
+	mb, _ := newTagged(t)
+	for _, limit := range []string{"1", "2", "3"} {
+		var methods []string
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			w := get(t, mb, "/?limit="+limit+"&cursor="+cursor, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("limit %s: %d %s", limit, w.Code, w.Body)
+			}
+			for _, point := range decode(t, w) {
+				methods = append(methods, point.Tags["method"])
+			}
+			if cursor = w.Header().Get("X-Next-Cursor"); cursor == "" {
+				break
+			}
+		}
+		want := []string{"DELETE", "GET", "HEAD", "POST", "PUT"}
+		if len(methods) != len(want) {
+			t.Fatalf("limit %s: got %v, want %v", limit, methods, want)
+		}
+		for i := range want {
+			if methods[i] != want[i] {
+				t.Errorf("limit %s: got %v, want %v", limit, methods, want)
+				break
+			}
+		}
+	}
+}
+
+func TestDiffComparesTaggedSeriesSeparately(t *testing.T) {
+	mb, registry := newTagged(t)
+	handler := mb.DiffHandler()
+	first := get(t, handler, "/", nil)
+	if points := decode(t, first); len(points) != 5 {
+		t.Fatalf("got %d points, want all 5", len(points))
+	}
+	etag := http.Header{"If-None-Match": {first.Header().Get("ETag")}}
+
+	if w := get(t, handler, "/", etag); w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged registry: %d, want 304", w.Code)
+	}
+
+	registry.Counter("requests", sqmetrics.Tags{"method": "GET"}).Inc(1)
+	points := decode(t, get(t, handler, "/", etag))
+	if len(points) != 1 || points[0].Tags["method"] != "GET" {
+		t.Errorf("got %v, want only the GET series", points)
+	}
+}
+
+func TestQueryReturnsEveryTaggedSeries(t *testing.T) {
+	registry := sqmetrics.NewTaggedRegistry(metrics.NewRegistry())
+	registry.Gauge("queue", sqmetrics.Tags{"name": "b"}).Update(2)
+	registry.Gauge("queue", sqmetrics.Tags{"name": "a"}).Update(1)
+	mb := sqmetrics.NewMetrics("", "app", nil, 10*time.Millisecond, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithHistory(time.Minute))
+	defer mb.Close()
+
+	var samples []sqmetrics.Sample
+	for deadline := time.Now().Add(5 * time.Second); len(samples) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no history recorded")
+		}
+		samples = mb.Query("app.queue", time.Time{})
+	}
+	if len(samples) < 2 || samples[0].Tags["name"] != "a" || samples[1].Tags["name"] != "b" || samples[0].Time != samples[1].Time {
+		t.Fatalf("got %v, want both series of the first snapshot, a first", samples)
+	}
+
+	for _, sample := range mb.Query(sqmetrics.TaggedName("app.queue", map[string]string{"name": "b"}), time.Time{}) {
+		if sample.Tags["name"] != "b" {
+			t.Errorf("querying series b returned %v", sample)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// SetGauge sets the gauge called name in the main registry to value,
+// registering the gauge if needed. Like all metrics of the main registry, it
+// is published with the prefix passed to NewMetrics. It panics if name is used
+// by a metric of another type.
+func (mb *SquareMetrics) SetGauge(name string, value int64) {
+	metrics.GetOrRegisterGauge(name, mb.Registry).Update(value)
+}
+
+// IncCounter increments the counter called name in the main registry by n,
+// registering the counter if needed, as for SetGauge.
+func (mb *SquareMetrics) IncCounter(name string, n int64) {
+	metrics.GetOrRegisterCounter(name, mb.Registry).Inc(n)
+}
+
+// ObserveTimer records a duration in the timer called name in the main
+// registry, registering the timer if needed, as for SetGauge.
+func (mb *SquareMetrics) ObserveTimer(name string, d time.Duration) {
+	metrics.GetOrRegisterTimer(name, mb.Registry).Update(d)
+}
@@ -0,0 +1,173 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sample is the value of a metric at a point in time, as kept by WithHistory.
+// Tags are those of the point, which tell apart the series of a
+// TaggedRegistry with the same name.
+type Sample struct {
+	Time  time.Time         `json:"time"`
+	Value interface{}       `json:"value"`
+	Tags  map[string]string `json:"tags,omitempty"`
+}
+
+// history is a ring of recent snapshots of every metric.
+type history struct {
+	window time.Duration
+
+	mutex     sync.RWMutex
+	snapshots []historySnapshot // oldest first
+}
+
+type historySnapshot struct {
+	at     time.Time
+	points []MetricPoint
+}
+
+// WithHistory keeps a snapshot of every metric at each collection interval
+// for the given window (e.g. 15 minutes), so that recent trends can be seen
+// from within the process with Query or HistoryHandler, even when the bridge
+// is down. Memory use grows with the number of metrics times window/interval.
+func WithHistory(window time.Duration) Option {
+	return func(mb *SquareMetrics) {
+		mb.history = &history{window: window}
+	}
+}
+
+// record adds a snapshot, dropping those that fell out of the window.
+func (h *history) record(at time.Time, points []MetricPoint) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	expired := 0
+	for expired < len(h.snapshots) && at.Sub(h.snapshots[expired].at) > h.window {
+		expired++
+	}
+	if expired > 0 {
+		// shift rather than reslice, so the backing array doesn't grow forever
+		n := copy(h.snapshots, h.snapshots[expired:])
+		for i := n; i < len(h.snapshots); i++ {
+			h.snapshots[i] = historySnapshot{}
+		}
+		h.snapshots = h.snapshots[:n]
+	}
+	h.snapshots = append(h.snapshots, historySnapshot{at, points})
+}
+
+// Query returns the values recorded by WithHistory for the metric with the
+// given published name (including the prefix, as sent to the bridge) since
+// the given time, oldest first. Every series of that name is returned, ordered
+// by tags within each snapshot; a name encoded with TaggedName only selects
+// the series with those tags (among others). It returns nil if history isn't
+// kept.
+func (mb *SquareMetrics) Query(name string, since time.Time) []Sample {
+	h := mb.history
+	if h == nil {
+		return nil
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	name, tags := SplitTaggedName(name)
+	samples := []Sample{}
+	for _, snapshot := range h.snapshots {
+		if snapshot.at.Before(since) {
+			continue
+		}
+		var matched []MetricPoint
+		for _, point := range snapshot.points {
+			if point.Name == name && hasTags(point.Tags, tags) {
+				matched = append(matched, point)
+			}
+		}
+		sortPoints(matched, "name")
+		for _, point := range matched {
+			samples = append(samples, Sample{snapshot.at, point.Value, point.Tags})
+		}
+	}
+	return samples
+}
+
+// HistoryHandler returns an http.Handler that serves the history kept by
+// WithHistory as JSON, an object mapping each requested metric to its samples.
+// Metrics are requested by published name, as for Query, with one or more
+// name query parameters; the since parameter limits the samples to those
+// after a time (RFC 3339) or within a duration before now (e.g. 5m), and
+// defaults to the whole window. The handler is protected by WithAuthorizer.
+func (mb *SquareMetrics) HistoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mb.authorized(w, r) {
+			return
+		}
+		if mb.history == nil {
+			http.Error(w, "metrics history is not enabled", http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		names := query["name"]
+		if len(names) == 0 {
+			http.Error(w, "no metrics requested, pass them as name parameters", http.StatusBadRequest)
+			return
+		}
+		since, err := parseSince(query.Get("since"), mb.clock.Now(), mb.history.window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := make(map[string][]Sample, len(names))
+		for _, name := range names {
+			result[name] = mb.Query(name, since)
+		}
+		preventCaching(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// hasTags reports whether tags include all of want.
+func hasTags(tags, want map[string]string) bool {
+	for key, value := range want {
+		if tagValue, ok := tags[key]; !ok || tagValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSince parses the since parameter of HistoryHandler.
+func parseSince(since string, now time.Time, window time.Duration) (time.Time, error) {
+	if since == "" {
+		return now.Add(-window), nil
+	}
+	if ago, err := time.ParseDuration(since); err == nil {
+		return now.Add(-ago), nil
+	}
+	at, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q, must be a duration or an RFC 3339 time", since)
+	}
+	return at, nil
+}
@@ -0,0 +1,71 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"time"
+)
+
+// PublishEvent describes a completed publish attempt, and is passed to the
+// hooks installed with WithPublishHook. Publishes split into several batches
+// (see WithBatchSize) fire one event per batch, once it has been delivered or
+// given up on with all retries.
+type PublishEvent struct {
+	// BatchSize is the number of metrics in the batch.
+	BatchSize int
+	// PayloadBytes is the size of the serialized batch.
+	PayloadBytes int
+	// Duration is the time taken to deliver the batch, including retries.
+	Duration time.Duration
+	// StatusCode is the HTTP status returned by the bridge, or 0 if there was
+	// no response (transport errors, dry runs).
+	StatusCode int
+	// BatchID and Sequence are the id and sequence number the batch was
+	// posted with (see BatchIDHeader and SequenceHeader), or empty for
+	// batches delivered to a sink.
+	BatchID  string
+	Sequence uint64
+	// Err is the error the publish failed with, or nil if it succeeded.
+	Err error
+}
+
+func (mb *SquareMetrics) firePublishHooks(event PublishEvent) {
+	for _, hook := range mb.hooks {
+		hook(event)
+	}
+}
+
+// debugEnv is the environment variable that turns on logging of every publish
+// attempt, for debugging in the field.
+const debugEnv = "SQMETRICS_DEBUG"
+
+// logPublish is the publish hook installed when debugEnv is set.
+func (mb *SquareMetrics) logPublish(event PublishEvent) {
+	target := mb.currentURL()
+	if mb.sink != nil {
+		target = "sink"
+	} else if mb.dryRun != nil {
+		target = "dry run"
+	}
+	if event.Err != nil {
+		mb.logger.Printf("sqmetrics: publish of %d metrics (%d bytes) to %s failed after %s: status %d: %s",
+			event.BatchSize, event.PayloadBytes, target, event.Duration, event.StatusCode, event.Err)
+		return
+	}
+	mb.logger.Printf("sqmetrics: published %d metrics (%d bytes) to %s in %s: status %d",
+		event.BatchSize, event.PayloadBytes, target, event.Duration, event.StatusCode)
+}
@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"net"
+	"strings"
+)
+
+// HostnameFormat is how the hostname sent with every metric is derived from
+// the one the kernel reports, for WithHostnameFormat.
+type HostnameFormat int
+
+const (
+	// HostnameAsIs sends the hostname as os.Hostname returns it. It is the
+	// default.
+	HostnameAsIs HostnameFormat = iota
+	// HostnameShort sends the hostname up to its first dot.
+	HostnameShort
+	// HostnameFQDN sends the fully qualified domain name, resolved through DNS
+	// if the kernel's hostname is a short name.
+	HostnameFQDN
+)
+
+// WithHostnameFormat normalizes the hostname sent with every metric, so that
+// hosts configured with short names and hosts configured with FQDNs report
+// consistently. Resolving an FQDN happens when NewMetrics is called; if it
+// fails, the error is logged and the kernel's hostname is used.
+func WithHostnameFormat(format HostnameFormat) Option {
+	return func(mb *SquareMetrics) {
+		switch format {
+		case HostnameShort:
+			mb.hostname = shortHostname(mb.hostname)
+		case HostnameFQDN:
+			fqdn, err := resolveFQDN(mb.hostname)
+			if err != nil {
+				mb.logger.Printf("error resolving FQDN of %s, using it as is: %s", mb.hostname, err)
+				return
+			}
+			mb.hostname = fqdn
+		}
+	}
+}
+
+func shortHostname(hostname string) string {
+	if net.ParseIP(hostname) != nil {
+		return hostname
+	}
+	short, _, _ := strings.Cut(hostname, ".")
+	return short
+}
+
+// resolveFQDN returns the fully qualified name of hostname: its canonical
+// name, or else the first reverse lookup of its addresses that extends it.
+func resolveFQDN(hostname string) (string, error) {
+	if strings.Contains(hostname, ".") {
+		return strings.TrimSuffix(hostname, "."), nil
+	}
+	if cname, err := net.LookupCNAME(hostname); err == nil && strings.Contains(strings.TrimSuffix(cname, "."), ".") {
+		return strings.TrimSuffix(cname, "."), nil
+	}
+
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		names, err := net.LookupAddr(addr)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.HasPrefix(name, hostname+".") {
+				return name, nil
+			}
+		}
+	}
+	return "", &net.DNSError{Err: "no fully qualified name found", Name: hostname, IsNotFound: true}
+}
@@ -0,0 +1,71 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sync"
+)
+
+// Info is a metric for static metadata about the process, such as its version,
+// a hash of its configuration or its feature flags. It serializes to a single
+// point valued 1, with the attributes of the Info as tags, so the metadata
+// travels with the metric stream and can be joined against other series.
+type Info struct {
+	mutex      sync.Mutex
+	attributes map[string]string
+	emitted    string
+}
+
+// NewInfo returns an Info with the given attributes.
+func NewInfo(attributes map[string]string) *Info {
+	return &Info{attributes: mergeMaps(attributes)}
+}
+
+// Info returns the Info with the given name, registering a new one with the
+// given attributes if needed. Its name must not be used by a metric of the
+// main registry.
+func (mb *SquareMetrics) Info(name string, attributes map[string]string) *Info {
+	return mb.custom.getOrRegister(name, func() customMetric {
+		return NewInfo(attributes)
+	}).(*Info)
+}
+
+// Set replaces the attributes of the Info.
+func (i *Info) Set(attributes map[string]string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.attributes = mergeMaps(attributes)
+}
+
+// Attributes returns a copy of the attributes of the Info.
+func (i *Info) Attributes() map[string]string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return mergeMaps(i.attributes)
+}
+
+func (i *Info) flatten(names *nameCache, nvs []tuple, name string) []tuple {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	base, tags := SplitTaggedName(name)
+	flattened := TaggedName(base, mergeMaps(i.attributes, tags))
+	if i.emitted != "" && i.emitted != flattened {
+		names.forget(i.emitted)
+	}
+	i.emitted = flattened
+	return append(nvs, tuple{flattened, int64(1), InfoType})
+}
@@ -0,0 +1,91 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fetch reads metrics from sqmetrics ServeHTTP endpoints, for the
+// command-line tools.
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/pattern"
+)
+
+// Points fetches the metrics served at url, in either the JSON array or the
+// newline-delimited JSON format. Values are decoded as float64s.
+func Points(ctx context.Context, client *http.Client, url string) ([]sqmetrics.MetricPoint, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		return decodeNDJSON(resp.Body)
+	}
+
+	var points []sqmetrics.MetricPoint
+	if err := json.NewDecoder(resp.Body).Decode(&points); err != nil {
+		return nil, fmt.Errorf("decoding metrics from %s: %s", url, err)
+	}
+	return points, nil
+}
+
+func decodeNDJSON(r io.Reader) ([]sqmetrics.MetricPoint, error) {
+	points := []sqmetrics.MetricPoint{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var point sqmetrics.MetricPoint
+		if err := json.Unmarshal(line, &point); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, scanner.Err()
+}
+
+// Value returns the numeric value of a fetched point.
+func Value(point sqmetrics.MetricPoint) (float64, bool) {
+	value, ok := point.Value.(float64)
+	return value, ok
+}
+
+// Match reports whether name matches any of patterns, each either an exact
+// name or a prefix ending in "*". An empty list matches every name.
+func Match(name string, patterns []string) bool {
+	return len(patterns) == 0 || pattern.MatchAny(name, patterns)
+}
@@ -0,0 +1,98 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package importer holds what the importers of metrics from other libraries
+// (sqprom, sqotel and sqopencensus) have in common.
+package importer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/tagmap"
+)
+
+// Series sets the gauges of one import in a registry, with their tags encoded
+// by sqmetrics.TaggedName, and keeps track of their names so that the ones no
+// longer imported can be unregistered.
+type Series struct {
+	registry metrics.Registry
+	seen     map[string]bool
+}
+
+// NewSeries returns a Series for an import into registry.
+func NewSeries(registry metrics.Registry) *Series {
+	return &Series{registry: registry, seen: map[string]bool{}}
+}
+
+// SetInt sets the Gauge called name with tags to value.
+func (s *Series) SetInt(name string, tags map[string]string, value int64) {
+	name = sqmetrics.TaggedName(name, tags)
+	metrics.GetOrRegisterGauge(name, s.registry).Update(value)
+	s.seen[name] = true
+}
+
+// SetFloat sets the GaugeFloat64 called name with tags to value, unless value
+// is NaN or infinite.
+func (s *Series) SetFloat(name string, tags map[string]string, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	name = sqmetrics.TaggedName(name, tags)
+	metrics.GetOrRegisterGaugeFloat64(name, s.registry).Update(value)
+	s.seen[name] = true
+}
+
+// Sweep unregisters the names of previous, the result of the previous Sweep,
+// that weren't set by this import, and returns the names that were.
+func (s *Series) Sweep(previous map[string]bool) map[string]bool {
+	for name := range previous {
+		if !s.seen[name] {
+			sqmetrics.UnregisterFrom(s.registry, name)
+		}
+	}
+	return s.seen
+}
+
+// WithTag returns a copy of tags with one more tag.
+func WithTag(tags map[string]string, key, value string) map[string]string {
+	return tagmap.Merge(tags, map[string]string{key: value})
+}
+
+// Start calls run right away and then every interval, until the returned
+// function is called.
+func Start(interval time.Duration, run func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			run()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
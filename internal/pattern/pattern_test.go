@@ -0,0 +1,37 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pattern
+
+import "testing"
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"runtime.mem.*", "requests"}
+	for name, want := range map[string]bool{
+		"runtime.mem.alloc": true,
+		"runtime.mem.":      true,
+		"runtime.memory":    false,
+		"requests":          true,
+		"requests.count":    false,
+	} {
+		if got := MatchAny(name, patterns); got != want {
+			t.Errorf("MatchAny(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if MatchAny("requests", nil) {
+		t.Error("no patterns matched a name")
+	}
+}
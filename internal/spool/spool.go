@@ -0,0 +1,265 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package spool keeps batches that could not be delivered as files in a
+// directory, optionally encrypted, until they can be delivered.
+package spool
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	plainExt     = ".json"
+	encryptedExt = ".json.enc"
+	// corruptExt is appended to the names of batches that can't be read, so
+	// that they are kept for inspection but no longer drained.
+	corruptExt = ".corrupt"
+)
+
+// errNoKey is returned by read for an encrypted batch while the key is not
+// available, which doesn't make the batch unreadable.
+var errNoKey = errors.New("spool key unavailable")
+
+// ErrRejected is returned, possibly wrapped, by the function given to Drain
+// for a batch that will never be accepted, e.g. because the bridge responded
+// with a client error. The batch is dropped rather than retried, and draining
+// carries on with the next one.
+var ErrRejected = errors.New("batch rejected")
+
+// Batch is a spooled batch.
+type Batch struct {
+	// ID and Sequence are the batch id and sequence number the batch was
+	// first posted with, if any.
+	ID       string
+	Sequence uint64
+	// Body is the serialized batch.
+	Body []byte
+}
+
+// Spool is a directory of batches, one file per batch, named so that they sort
+// in the order they were stored. Spooled batches are encrypted with AES-GCM if
+// a key file is set; draining stops at encrypted batches while the key is not
+// available.
+type Spool struct {
+	// Dir is the directory batches are spooled to, created if needed.
+	Dir string
+	// Max is the number of batches kept, the oldest being dropped. There is
+	// no limit if it is zero.
+	Max int
+	// KeyFile, if set, is a file holding the hex encoded AES key (16, 24 or
+	// 32 bytes) batches are encrypted with. It is read once.
+	KeyFile string
+
+	mutex sync.Mutex
+	aead  cipher.AEAD
+}
+
+// Store spools a batch, and returns the names of the batches dropped to keep
+// at most Max.
+func (s *Spool) Store(batch Batch) (dropped []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%020d", time.Now().UnixNano())
+	if batch.ID != "" {
+		name += fmt.Sprintf("-%d-%s", batch.Sequence, batch.ID)
+	}
+	data := batch.Body
+	if s.KeyFile != "" {
+		aead, err := s.cipher()
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		data = aead.Seal(nonce, nonce, batch.Body, []byte(batch.ID))
+		name += encryptedExt
+	} else {
+		name += plainExt
+	}
+	path := filepath.Join(s.Dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+
+	files, _, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for s.Max > 0 && len(files) > s.Max {
+		if err := os.Remove(files[0]); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, files[0])
+		files = files[1:]
+	}
+	return dropped, nil
+}
+
+// Drain delivers spooled batches oldest first, removing each once post
+// succeeds, and stops at the first failure other than ErrRejected. It returns
+// the names of the batches dropped because post rejected them. Batches that
+// can't be read or decrypted, e.g. because they are truncated or were
+// encrypted with another key, are set aside with a .corrupt suffix rather than
+// blocking those behind them; their new names are returned in unreadable.
+func (s *Spool) Drain(post func(Batch) error) (dropped, unreadable []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, _, err := s.files()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		batch, err := s.read(file)
+		if errors.Is(err, errNoKey) {
+			return dropped, unreadable, fmt.Errorf("error reading %s: %w", file, err)
+		} else if err != nil {
+			if err := os.Rename(file, file+corruptExt); err != nil {
+				return dropped, unreadable, err
+			}
+			unreadable = append(unreadable, file+corruptExt)
+			continue
+		}
+		err = post(batch)
+		if err != nil && !errors.Is(err, ErrRejected) {
+			return dropped, unreadable, err
+		}
+		if err := os.Remove(file); err != nil {
+			return dropped, unreadable, err
+		}
+		if err != nil {
+			dropped = append(dropped, file)
+		}
+	}
+	return dropped, unreadable, nil
+}
+
+// Bytes returns the total size of the spooled batches.
+func (s *Spool) Bytes() (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, size, err := s.files()
+	return size, err
+}
+
+// Len returns the number of spooled batches and their total size.
+func (s *Spool) Len() (int, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, size, err := s.files()
+	return len(files), size, err
+}
+
+// files returns the spooled batches, oldest first, and their total size.
+func (s *Spool) files() ([]string, int64, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var files []string
+	var size int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, plainExt) || strings.HasSuffix(name, encryptedExt)) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		files = append(files, filepath.Join(s.Dir, name))
+	}
+	sort.Strings(files)
+	return files, size, nil
+}
+
+// read reads a spooled batch, decrypting it if needed.
+func (s *Spool) read(file string) (Batch, error) {
+	var batch Batch
+	name := filepath.Base(file)
+	encrypted := strings.HasSuffix(name, encryptedExt)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, encryptedExt), plainExt)
+	if parts := strings.SplitN(name, "-", 3); len(parts) == 3 {
+		sequence, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return batch, fmt.Errorf("invalid sequence number %q", parts[1])
+		}
+		batch.ID, batch.Sequence = parts[2], sequence
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil || !encrypted {
+		batch.Body = data
+		return batch, err
+	}
+	aead, err := s.cipher()
+	if err != nil {
+		return batch, fmt.Errorf("%w: %w", errNoKey, err)
+	}
+	if len(data) < aead.NonceSize() {
+		return batch, errors.New("truncated batch")
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	batch.Body, err = aead.Open(nil, nonce, sealed, []byte(batch.ID))
+	return batch, err
+}
+
+// cipher returns the AEAD batches are encrypted with, reading the key file the
+// first time.
+func (s *Spool) cipher() (cipher.AEAD, error) {
+	if s.aead != nil {
+		return s.aead, nil
+	}
+	if s.KeyFile == "" {
+		return nil, errors.New("encrypted batch, but no spool key configured")
+	}
+	data, err := os.ReadFile(s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid spool key in %s: %w", s.KeyFile, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spool key in %s: %w", s.KeyFile, err)
+	}
+	s.aead, err = cipher.NewGCM(block)
+	return s.aead, err
+}
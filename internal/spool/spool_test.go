@@ -0,0 +1,169 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newKey writes a hex encoded AES-128 key to a file and returns its path.
+func newKey(t *testing.T, hexKey string) string {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(hexKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// drainAll drains s, returning the bodies of the batches posted.
+func drainAll(t *testing.T, s *Spool) ([]string, []string) {
+	var bodies []string
+	_, unreadable, err := s.Drain(func(batch Batch) error {
+		bodies = append(bodies, string(batch.Body))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bodies, unreadable
+}
+
+func TestEncryptedBatchesRoundTrip(t *testing.T) {
+	s := &Spool{Dir: t.TempDir(), KeyFile: newKey(t, "000102030405060708090a0b0c0d0e0f")}
+	body := []byte(`[{"metric":"secret.host.name"}]`)
+	if _, err := s.Store(Batch{ID: "abc", Sequence: 7, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _, err := s.files()
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0], encryptedExt) {
+		t.Fatalf("spooled %v (%v), want one encrypted batch", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("the batch is stored in the clear")
+	}
+
+	var got Batch
+	if _, _, err := s.Drain(func(batch Batch) error {
+		got = batch
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "abc" || got.Sequence != 7 || !bytes.Equal(got.Body, body) {
+		t.Errorf("drained %+v, want the stored batch", got)
+	}
+	if files, _, _ := s.files(); len(files) != 0 {
+		t.Errorf("%d batches left after draining", len(files))
+	}
+}
+
+func TestDrainStopsAtTheFirstFailure(t *testing.T) {
+	s := &Spool{Dir: t.TempDir()}
+	for _, body := range []string{"1", "2", "3"} {
+		if _, err := s.Store(Batch{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var posted []string
+	failure := errors.New("bridge down")
+	dropped, _, err := s.Drain(func(batch Batch) error {
+		posted = append(posted, string(batch.Body))
+		switch string(batch.Body) {
+		case "1":
+			return ErrRejected
+		case "2":
+			return failure
+		}
+		return nil
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+	if strings.Join(posted, ",") != "1,2" {
+		t.Errorf("posted %v, want the rejected batch and the failed one", posted)
+	}
+	if len(dropped) != 1 {
+		t.Errorf("dropped %v, want the rejected batch", dropped)
+	}
+	if bodies, _ := drainAll(t, s); strings.Join(bodies, ",") != "2,3" {
+		t.Errorf("drained %v afterwards, want the failed batch and the next one", bodies)
+	}
+}
+
+func TestDrainSetsUnreadableBatchesAside(t *testing.T) {
+	dir := t.TempDir()
+	s := &Spool{Dir: dir, KeyFile: newKey(t, "000102030405060708090a0b0c0d0e0f")}
+	if _, err := s.Store(Batch{Body: []byte("old")}); err != nil {
+		t.Fatal(err)
+	}
+	// a batch from before a key rotation, and one cut short by a full disk
+	other := &Spool{Dir: dir, KeyFile: newKey(t, "0f0e0d0c0b0a09080706050403020100")}
+	if _, err := other.Store(Batch{Body: []byte("rotated")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "99999999999999999998"+encryptedExt), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Store(Batch{Body: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies, unreadable := drainAll(t, s)
+	if strings.Join(bodies, ",") != "old,new" {
+		t.Errorf("drained %v, want the readable batches", bodies)
+	}
+	if len(unreadable) != 2 {
+		t.Fatalf("set aside %v, want the 2 unreadable batches", unreadable)
+	}
+	for _, file := range unreadable {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("unreadable batch not kept: %s", err)
+		}
+	}
+	if files, _, _ := s.files(); len(files) != 0 {
+		t.Errorf("%d batches left to drain, want none", len(files))
+	}
+}
+
+func TestDrainWaitsForTheKey(t *testing.T) {
+	dir := t.TempDir()
+	s := &Spool{Dir: dir, KeyFile: newKey(t, "000102030405060708090a0b0c0d0e0f")}
+	if _, err := s.Store(Batch{Body: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch can't be told apart from a corrupt one without its key
+	keyless := &Spool{Dir: dir}
+	_, unreadable, err := keyless.Drain(func(Batch) error { return nil })
+	if err == nil || len(unreadable) != 0 {
+		t.Errorf("drained without the key: %v, set aside %v", err, unreadable)
+	}
+	if bodies, _ := drainAll(t, s); len(bodies) != 1 {
+		t.Errorf("drained %v once the key is available, want the batch", bodies)
+	}
+}
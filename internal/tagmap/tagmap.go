@@ -0,0 +1,38 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tagmap merges the string maps used for tags and prefix variables,
+// for sqmetrics and its subpackages.
+package tagmap
+
+// Merge returns a new map with the entries of all the given maps, later maps
+// winning, or nil if there are none.
+func Merge(maps ...map[string]string) map[string]string {
+	size := 0
+	for _, tags := range maps {
+		size += len(tags)
+	}
+	if size == 0 {
+		return nil
+	}
+	out := make(map[string]string, size)
+	for _, tags := range maps {
+		for k, v := range tags {
+			out[k] = v
+		}
+	}
+	return out
+}
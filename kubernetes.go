@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// serviceAccountNamespace is where Kubernetes mounts the namespace of a pod
+// that has a service account token.
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// DownwardAPI describes where a pod's metadata is exposed through the
+// Kubernetes downward API, for WithKubernetesTags. Empty fields take the
+// defaults noted.
+type DownwardAPI struct {
+	// PodNameEnv is the environment variable holding metadata.name
+	// (POD_NAME).
+	PodNameEnv string
+	// NamespaceEnv is the environment variable holding metadata.namespace
+	// (POD_NAMESPACE). If it is not set, the service account namespace file is
+	// read instead.
+	NamespaceEnv string
+	// NodeNameEnv is the environment variable holding spec.nodeName
+	// (NODE_NAME).
+	NodeNameEnv string
+	// LabelsFile is the downward API volume file holding metadata.labels
+	// (/etc/podinfo/labels).
+	LabelsFile string
+	// Labels are the pod labels to attach as tags. If empty, all labels are
+	// attached except pod-template-hash and controller-revision-hash, which
+	// change with every rollout.
+	Labels []string
+}
+
+func (d DownwardAPI) withDefaults() DownwardAPI {
+	if d.PodNameEnv == "" {
+		d.PodNameEnv = "POD_NAME"
+	}
+	if d.NamespaceEnv == "" {
+		d.NamespaceEnv = "POD_NAMESPACE"
+	}
+	if d.NodeNameEnv == "" {
+		d.NodeNameEnv = "NODE_NAME"
+	}
+	if d.LabelsFile == "" {
+		d.LabelsFile = "/etc/podinfo/labels"
+	}
+	return d
+}
+
+// WithKubernetesTags tags every published metric with the pod, namespace and
+// node the process runs in, and the pod's labels, as exposed by the Kubernetes
+// downward API. Metadata that isn't available is left out, so the option is
+// harmless outside Kubernetes. It is read once, when NewMetrics is called.
+//
+// The pod spec must expose the metadata, e.g.:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom: {fieldRef: {fieldPath: metadata.name}}
+//	- name: NODE_NAME
+//	  valueFrom: {fieldRef: {fieldPath: spec.nodeName}}
+//	volumes:
+//	- name: podinfo
+//	  downwardAPI:
+//	    items:
+//	    - path: labels
+//	      fieldRef: {fieldPath: metadata.labels}
+func WithKubernetesTags(config DownwardAPI) Option {
+	return func(mb *SquareMetrics) {
+		config = config.withDefaults()
+		tags := map[string]string{}
+
+		labels, err := readLabels(config.LabelsFile)
+		if err != nil && !os.IsNotExist(err) {
+			mb.logger.Printf("error reading pod labels: %s", err)
+		}
+		if len(config.Labels) > 0 {
+			for _, key := range config.Labels {
+				if value, ok := labels[key]; ok {
+					tags[key] = value
+				}
+			}
+		} else {
+			for key, value := range labels {
+				if key != "pod-template-hash" && key != "controller-revision-hash" {
+					tags[key] = value
+				}
+			}
+		}
+
+		// the well-known tags win over labels with the same name
+		if pod := os.Getenv(config.PodNameEnv); pod != "" {
+			tags["pod"] = pod
+		}
+		if node := os.Getenv(config.NodeNameEnv); node != "" {
+			tags["node"] = node
+		}
+		namespace := os.Getenv(config.NamespaceEnv)
+		if namespace == "" {
+			if data, err := os.ReadFile(serviceAccountNamespace); err == nil {
+				namespace = strings.TrimSpace(string(data))
+			}
+		}
+		if namespace != "" {
+			tags["namespace"] = namespace
+		}
+
+		mb.envTags = mergeMaps(mb.envTags, tags)
+		mb.updateTags()
+	}
+}
+
+// readLabels parses a downward API labels file, which has one key="value"
+// line per label with the value quoted as a Go string.
+func readLabels(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	labels := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, quoted, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			value = quoted
+		}
+		labels[key] = value
+	}
+	return labels, scanner.Err()
+}
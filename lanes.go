@@ -0,0 +1,46 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+// lane publishes the metrics matching its patterns only every nth publish.
+type lane struct {
+	every    int
+	patterns []string
+}
+
+// lanes tracks which slow-lane metrics are due for the current publish.
+type lanes struct {
+	lanes     []lane
+	publishes int
+}
+
+// due reports whether the metric with the given registry name is included in
+// the current publish. Metrics not in any lane are always due; otherwise the
+// first matching lane decides.
+func (l *lanes) due(name string) bool {
+	for _, lane := range l.lanes {
+		if matchesAny(name, lane.patterns) {
+			return lane.every <= 1 || l.publishes%lane.every == 0
+		}
+	}
+	return true
+}
+
+// advance moves on to the next publish.
+func (l *lanes) advance() {
+	l.publishes++
+}
@@ -0,0 +1,161 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Log levels recognized by the log counters, from most to least severe.
+var logLevels = []string{"error", "warn", "info", "debug"}
+
+type logCounters map[string]metrics.Counter
+
+func newLogCounters(registry metrics.Registry) logCounters {
+	counters := logCounters{}
+	for _, level := range append(logLevels, "other") {
+		counters[level] = metrics.GetOrRegisterCounter("log."+level, registry)
+	}
+	return counters
+}
+
+// LogWriter wraps an io.Writer (typically the output of a log.Logger) and
+// counts the lines written through it in the "log.<level>" counters. The level
+// of a line is that of its level key (level=error in logfmt, "level":"ERROR"
+// in JSON), or else its first word after any date and time, such as ERROR,
+// [warn] or info:, case-insensitively. Lines of another level, or none, count
+// as "other".
+type LogWriter struct {
+	out      io.Writer
+	counters logCounters
+}
+
+// NewLogWriter returns a LogWriter that forwards to out and counts lines into
+// the given registry.
+func NewLogWriter(out io.Writer, registry metrics.Registry) *LogWriter {
+	return &LogWriter{
+		out:      out,
+		counters: newLogCounters(registry),
+	}
+}
+
+func (lw *LogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		lw.counters[lineLevel(line)].Inc(1)
+	}
+	return lw.out.Write(p)
+}
+
+// levelKeys are the keys structured log lines give their level under, in
+// logfmt and JSON.
+var levelKeys = [][]byte{[]byte("level="), []byte(`"level":`)}
+
+// lineLevel returns the level of a log line: the value of its level key if it
+// has one, and otherwise its first word after any date and time.
+func lineLevel(line []byte) string {
+	lower := bytes.ToLower(line)
+	for _, key := range levelKeys {
+		for start := 0; ; {
+			i := bytes.Index(lower[start:], key)
+			if i < 0 {
+				break
+			}
+			i += start
+			// the key must start a field, so that e.g. loglevel= isn't one
+			if i == 0 || bytes.IndexByte([]byte(" ,{"), lower[i-1]) >= 0 {
+				value := lower[i+len(key):]
+				if end := bytes.IndexAny(value, " ,}"); end >= 0 {
+					value = value[:end]
+				}
+				return wordLevel(value)
+			}
+			start = i + 1
+		}
+	}
+	for _, word := range bytes.Fields(lower) {
+		if word[0] < '0' || word[0] > '9' {
+			return wordLevel(word)
+		}
+	}
+	return "other"
+}
+
+// wordLevel returns the level a word such as ERROR, [warn] or info: names.
+func wordLevel(word []byte) string {
+	switch string(bytes.Trim(word, `[]():"`)) {
+	case "error", "err":
+		return "error"
+	case "warn", "warning":
+		return "warn"
+	case "info":
+		return "info"
+	case "debug":
+		return "debug"
+	}
+	return "other"
+}
+
+// LogHandler is a slog.Handler that counts records by level in the
+// "log.<level>" counters before passing them on to the wrapped handler.
+type LogHandler struct {
+	next     slog.Handler
+	counters logCounters
+}
+
+// NewLogHandler returns a LogHandler that forwards to next and counts records
+// into the given registry.
+func NewLogHandler(next slog.Handler, registry metrics.Registry) *LogHandler {
+	return &LogHandler{
+		next:     next,
+		counters: newLogCounters(registry),
+	}
+}
+
+// Enabled reports whether the wrapped handler handles records at the level.
+func (lh *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return lh.next.Enabled(ctx, level)
+}
+
+// Handle counts the record and passes it to the wrapped handler.
+func (lh *LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	switch {
+	case record.Level >= slog.LevelError:
+		lh.counters["error"].Inc(1)
+	case record.Level >= slog.LevelWarn:
+		lh.counters["warn"].Inc(1)
+	case record.Level >= slog.LevelInfo:
+		lh.counters["info"].Inc(1)
+	default:
+		lh.counters["debug"].Inc(1)
+	}
+	return lh.next.Handle(ctx, record)
+}
+
+// WithAttrs returns a LogHandler wrapping next.WithAttrs, sharing counters.
+func (lh *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{next: lh.next.WithAttrs(attrs), counters: lh.counters}
+}
+
+// WithGroup returns a LogHandler wrapping next.WithGroup, sharing counters.
+func (lh *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{next: lh.next.WithGroup(name), counters: lh.counters}
+}
@@ -0,0 +1,49 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestLogWriterCountsLinesByLevel(t *testing.T) {
+	for _, test := range []struct {
+		line, level string
+	}{
+		{"ERROR connection refused", "error"},
+		{"[warn] disk almost full", "warn"},
+		{"info: no errors found", "info"},
+		{"2026/10/14 07:48:12 DEBUG: polling", "debug"},
+		{"2026/10/14 07:48:12.123456 Warning: slow query", "warn"},
+		{`time=2026-10-14T07:48:12Z level=error msg="write failed"`, "error"},
+		{`{"time":"2026-10-14T07:48:12Z","level":"INFO","msg":"error budget ok"}`, "info"},
+		{"loglevel=debug set by the error handler", "other"},
+		{"request served without errors", "other"},
+	} {
+		t.Run(test.line, func(t *testing.T) {
+			registry := metrics.NewRegistry()
+			writer := sqmetrics.NewLogWriter(io.Discard, registry)
+			io.WriteString(writer, test.line+"\n")
+			sqmetricstest.AssertCounter(t, registry, "log."+test.level, sqmetricstest.Eq(1))
+		})
+	}
+}
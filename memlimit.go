@@ -0,0 +1,55 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"math"
+	"runtime/debug"
+	runtimemetrics "runtime/metrics"
+)
+
+// AddMemoryGauges publishes the GC tuning of the process. runtime.mem.ballast
+// is the size of ballast, a caller-allocated slice kept around to raise the
+// heap goal, or nil if there is none. If a memory limit is set with GOMEMLIMIT
+// or debug.SetMemoryLimit, runtime.mem.limit is the limit, and
+// runtime.mem.limit.headroom how far the memory the runtime counts against it
+// is below it. That memory is everything the runtime has mapped, less what it
+// has released to the OS. The headroom shrinking towards zero means the GC is
+// about to run harder. A limit set after the call is not picked up.
+func (mb *SquareMetrics) AddMemoryGauges(ballast []byte) {
+	size := int64(cap(ballast))
+	mb.AddGauge("runtime.mem.ballast", func() int64 {
+		return size
+	})
+
+	if debug.SetMemoryLimit(-1) == math.MaxInt64 {
+		return
+	}
+	mb.AddGauge("runtime.mem.limit", func() int64 {
+		return debug.SetMemoryLimit(-1)
+	})
+	mb.AddGauge("runtime.mem.limit.headroom", func() int64 {
+		// gauges can be evaluated concurrently, so every call reads its own
+		samples := []runtimemetrics.Sample{
+			{Name: "/memory/classes/total:bytes"},
+			{Name: "/memory/classes/heap/released:bytes"},
+		}
+		runtimemetrics.Read(samples)
+		used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		return debug.SetMemoryLimit(-1) - int64(used)
+	})
+}
@@ -17,31 +17,91 @@
 package sqmetrics
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics/internal/spool"
 )
 
 // SquareMetrics posts metrics to an HTTP/JSON bridge endpoint
 type SquareMetrics struct {
-	Registry metrics.Registry
-	url      string
-	prefix   string
-	hostname string
-	interval time.Duration
-	logger   *log.Logger
-	client   *http.Client
-	mutex    *sync.Mutex
-	gauges   []gaugeWithCallback
+	Registry   metrics.Registry
+	url        string
+	prefix     string
+	prefixVars map[string]string
+	sources    []*registrySource
+	hostname   string
+	tags       map[string]string // userTags merged over envTags
+	userTags   map[string]string
+	envTags    map[string]string
+	interval   time.Duration
+	logger     *log.Logger
+	client     *http.Client
+	mutex      *sync.Mutex
+	settings   *sync.RWMutex // guards the settings that Reload changes
+	publishing chan struct{} // 1-slot semaphore serializing publishes from the loop and Flush
+	gauges     []gaugeWithCallback
+	collectors Collector
+	jitter     float64
+	aligned    bool
+	dedupe     *dedupe
+	ttl        *ttl
+	filter     nameFilter
+	rules      []RewriteRule
+	lanes      lanes
+	seriesCap  *cardinalityCap
+	dryRun     io.Writer
+	probe      *healthProbe
+	token      *tokenFile
+	signer     *signer
+	spool      *spool.Spool
+	acks       bool
+	rejections *rejections
+	handshake  *negotiation
+	authorize  Authorizer
+	streams    *streamHub
+	diffs      *diffState
+	history    *history
+	custom     *customMetrics
+	heartbeat  bool
+	timerUnit  time.Duration // 0 for nanoseconds
+	starts     *startTimes
+	rollup     *rollup
+	thresholds *thresholds
+	sequence   *batchSequence
+	beats      int64
+	trigger    chan struct{}
+	reschedule chan struct{}
+	recollect  chan struct{}
+	stats      *publishStats
+	onError    func(error)
+	hooks      []func(PublishEvent)
+	status     *publishStatus
+	started    time.Time
+	clock      Clock
+	sink       Sink
+	scratch    *publishScratch
+	names      *nameCache
+	live       *liveNames
+	summaries  *summaryCache
+	done       chan struct{}
+	workers    int
+	batchSize  int
+	batchPosts int
+	retries    int
+	backoff    time.Duration
+	newEncoder func(io.Writer) JSONEncoder
+	closeOnce  *sync.Once
 }
 
 type gaugeWithCallback struct {
@@ -49,33 +109,86 @@ type gaugeWithCallback struct {
 	callback func() int64
 }
 
-// NewMetrics is the entry point for this code
-func NewMetrics(metricsURL, metricsPrefix string, client *http.Client, interval time.Duration, registry metrics.Registry, logger *log.Logger) *SquareMetrics {
+// defaultInterval is the interval used when NewMetrics is given an invalid one.
+const defaultInterval = time.Minute
+
+// NewMetrics is the entry point for this code. A nil client or logger means
+// http.DefaultClient or log.Default(), and an interval that isn't positive is
+// replaced by a minute, with a warning.
+func NewMetrics(metricsURL, metricsPrefix string, client *http.Client, interval time.Duration, registry metrics.Registry, logger *log.Logger, options ...Option) *SquareMetrics {
 	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	if interval <= 0 {
+		logger.Printf("invalid metrics interval %s, using %s", interval, defaultInterval)
+		interval = defaultInterval
+	}
 
 	metrics := &SquareMetrics{
-		Registry: registry,
-		url:      metricsURL,
-		prefix:   metricsPrefix,
-		hostname: hostname,
-		interval: interval,
-		logger:   logger,
-		client:   client,
-		mutex:    &sync.Mutex{},
-		gauges:   []gaugeWithCallback{},
+		Registry:   registry,
+		url:        metricsURL,
+		prefix:     metricsPrefix,
+		hostname:   hostname,
+		interval:   interval,
+		logger:     logger,
+		client:     client,
+		mutex:      &sync.Mutex{},
+		settings:   &sync.RWMutex{},
+		publishing: make(chan struct{}, 1),
+		gauges:     []gaugeWithCallback{},
+		collectors: DefaultCollectors,
+		trigger:    make(chan struct{}, 1),
+		reschedule: make(chan struct{}, 1),
+		recollect:  make(chan struct{}, 1),
+		status:     &publishStatus{},
+		streams:    newStreamHub(),
+		diffs:      newDiffState(),
+		sequence:   &batchSequence{},
+		custom:     newCustomMetrics(),
+		clock:      realClock{},
+		names:      newNameCache(),
+		live:       newLiveNames(),
+		scratch:    &publishScratch{},
+		summaries:  newSummaryCache(),
+		done:       make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		newEncoder: newStandardEncoder,
 	}
-
-	if metricsURL != "" {
-		go metrics.publishMetrics()
+	for _, option := range options {
+		option(metrics)
+	}
+	metrics.expandPrefix()
+	metrics.started = metrics.clock.Now()
+	instances.add(metrics)
+	if debug, _ := strconv.ParseBool(os.Getenv(debugEnv)); debug {
+		metrics.hooks = append(metrics.hooks, metrics.logPublish)
 	}
 
+	// the publish loop runs even without a destination, as Reload may set one
+	go metrics.publishMetrics()
 	go metrics.collectMetrics()
+	if metrics.rollup != nil {
+		go metrics.sampleRollups()
+	}
 	return metrics
 }
 
+// Close stops collecting and publishing metrics. It does not publish what was
+// collected since the last publish; call Flush first for that.
+func (mb *SquareMetrics) Close() {
+	mb.closeOnce.Do(func() {
+		close(mb.done)
+		instances.remove(mb)
+	})
+}
+
 // AddGauge installs a callback for a gauge with the given name. The callback
 // will be called every metrics collection interval, and should provide an
 // updated value for the gauge.
@@ -85,22 +198,96 @@ func (mb *SquareMetrics) AddGauge(name string, callback func() int64) {
 	mb.gauges = append(mb.gauges, gaugeWithCallback{metrics.GetOrRegisterGauge(name, mb.Registry), callback})
 }
 
+// ServeHTTP responds with the current metrics. The response is streamed, and
+// flushed to the client periodically, so that serving a large registry doesn't
+// require holding its whole serialization in memory. The metrics are returned
+// as a JSON array, or as newline-delimited JSON if the request has
+// format=ndjson in its query or accepts application/x-ndjson. The response is
+// gzipped if the client accepts it. For humans, pretty=1 indents the JSON
+// array and sort=name orders the metrics by name.
+//
+// Large registries can be fetched in pages, ordered by name, with limit=n. If
+// there are more metrics, the response has an X-Next-Cursor header, to be
+// passed back as the cursor parameter to get the next page.
+//
+// The query parameters prefix and match restrict the response to metrics
+// whose registry names (without the published prefix) start with one of the
+// given prefixes or match one of the given regular expressions, e.g.
+// ?prefix=runtime.mem or ?match=^http\..*\.5xx$.
 func (mb *SquareMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	metrics := mb.SerializeMetrics()
-	raw, err := json.Marshal(metrics)
+	if !mb.authorized(w, r) {
+		return
+	}
+	include, err := queryFilter(r)
 	if err != nil {
-		panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	w.Write(raw)
+
+	points := mb.snapshot(include)
+	query := r.URL.Query()
+	if err := sortPoints(points, query.Get("sort")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	points, next, err := paginate(points, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if next != "" {
+		w.Header().Set(nextCursorHeader, next)
+	}
+
+	preventCaching(w)
+	mb.writePoints(w, r, points)
 }
 
 // Publish metrics to bridge
 func (mb *SquareMetrics) publishMetrics() {
-	for range time.Tick(mb.interval) {
-		err := mb.postMetrics()
-		if err != nil && err != io.EOF {
-			mb.logger.Printf("error reporting metrics: %s", err)
+	due, _ := mb.nextPublish(mb.clock.Now())
+	timer := mb.clock.NewTimer(mb.untilJittered(due))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-mb.done:
+			return
+		case <-mb.trigger:
+			// out-of-band publish, the schedule is unaffected
+			mb.publishOnce()
+			continue
+		case <-mb.reschedule:
+			// the interval changed, start over from now
+			timer.Stop()
+			due, _ = mb.nextPublish(mb.clock.Now())
+			timer.Reset(mb.untilJittered(due))
+			continue
+		case <-timer.C():
 		}
+
+		mb.publishOnce()
+		var skipped int
+		due, skipped = mb.nextPublish(due)
+		if skipped > 0 {
+			mb.stats.skipped(skipped)
+		}
+		timer.Reset(mb.untilJittered(due))
+	}
+}
+
+func (mb *SquareMetrics) publishOnce() {
+	err := mb.postMetrics(context.Background())
+	if err != nil && err != io.EOF {
+		mb.logger.Printf("error reporting metrics: %s", err)
+		mb.reportError(err)
+	}
+}
+
+// reportError passes a publish or serialization error to the error handler
+func (mb *SquareMetrics) reportError(err error) {
+	if mb.onError != nil {
+		mb.onError(err)
 	}
 }
 
@@ -116,39 +303,65 @@ func (mb *SquareMetrics) collectMetrics() {
 		metrics.GetOrRegisterGaugeFloat64(name, mb.Registry).Update(value)
 	}
 
-	sample := metrics.NewExpDecaySample(1028, 0.015)
-	gcHistogram := metrics.GetOrRegisterHistogram("runtime.mem.gc.duration", mb.Registry, sample)
+	var gcHistogram metrics.Histogram
+	if mb.collectors&CollectGC != 0 {
+		sample := metrics.NewExpDecaySample(1028, 0.015)
+		gcHistogram = metrics.GetOrRegisterHistogram("runtime.mem.gc.duration", mb.Registry, sample)
+	}
+
+	ticker := mb.clock.NewTicker(mb.currentInterval())
+	defer func() {
+		ticker.Stop()
+	}()
 
 	var observedPauses uint32
-	for range time.Tick(mb.interval) {
-		runtime.ReadMemStats(&mem)
+	for {
+		select {
+		case <-mb.done:
+			return
+		case <-mb.recollect:
+			ticker.Stop()
+			ticker = mb.clock.NewTicker(mb.currentInterval())
+			continue
+		case <-ticker.C():
+		}
 
-		update("runtime.mem.alloc", mem.Alloc)
-		update("runtime.mem.total-alloc", mem.TotalAlloc)
-		update("runtime.mem.sys", mem.Sys)
-		update("runtime.mem.lookups", mem.Lookups)
-		update("runtime.mem.mallocs", mem.Mallocs)
-		update("runtime.mem.frees", mem.Frees)
+		if mb.collectors&(CollectMemStats|CollectGC) != 0 {
+			runtime.ReadMemStats(&mem)
+		}
 
-		update("runtime.mem.heap.alloc", mem.HeapAlloc)
-		update("runtime.mem.heap.sys", mem.HeapSys)
-		update("runtime.mem.heap.idle", mem.HeapIdle)
-		update("runtime.mem.heap.inuse", mem.HeapInuse)
-		update("runtime.mem.heap.released", mem.HeapReleased)
-		update("runtime.mem.heap.objects", mem.HeapObjects)
+		if mb.collectors&CollectMemStats != 0 {
+			update("runtime.mem.alloc", mem.Alloc)
+			update("runtime.mem.total-alloc", mem.TotalAlloc)
+			update("runtime.mem.sys", mem.Sys)
+			update("runtime.mem.lookups", mem.Lookups)
+			update("runtime.mem.mallocs", mem.Mallocs)
+			update("runtime.mem.frees", mem.Frees)
 
-		update("runtime.mem.stack.inuse", mem.StackInuse)
-		update("runtime.mem.stack.sys", mem.StackSys)
+			update("runtime.mem.heap.alloc", mem.HeapAlloc)
+			update("runtime.mem.heap.sys", mem.HeapSys)
+			update("runtime.mem.heap.idle", mem.HeapIdle)
+			update("runtime.mem.heap.inuse", mem.HeapInuse)
+			update("runtime.mem.heap.released", mem.HeapReleased)
+			update("runtime.mem.heap.objects", mem.HeapObjects)
 
-		update("runtime.goroutines", uint64(runtime.NumGoroutine()))
-		update("runtime.cgo-calls", uint64(runtime.NumCgoCall()))
+			update("runtime.mem.stack.inuse", mem.StackInuse)
+			update("runtime.mem.stack.sys", mem.StackSys)
+		}
+
+		if mb.collectors&CollectGoroutines != 0 {
+			update("runtime.goroutines", uint64(runtime.NumGoroutine()))
+			update("runtime.cgo-calls", uint64(runtime.NumCgoCall()))
+		}
 
-		update("runtime.mem.gc.num-gc", uint64(mem.NumGC))
-		updateFloat("runtime.mem.gc.cpu-fraction", mem.GCCPUFraction)
+		if mb.collectors&CollectGC != 0 {
+			update("runtime.mem.gc.num-gc", uint64(mem.NumGC))
+			updateFloat("runtime.mem.gc.cpu-fraction", mem.GCCPUFraction)
 
-		// Update histogram of GC pauses
-		for ; observedPauses < mem.NumGC; observedPauses++ {
-			gcHistogram.Update(int64(mem.PauseNs[(observedPauses+1)%256]))
+			// Update histogram of GC pauses
+			for ; observedPauses < mem.NumGC; observedPauses++ {
+				gcHistogram.Update(int64(mem.PauseNs[(observedPauses+1)%256]))
+			}
 		}
 
 		// Update gauges
@@ -157,79 +370,511 @@ func (mb *SquareMetrics) collectMetrics() {
 			gauge.gauge.Update(gauge.callback())
 		}
 		mb.mutex.Unlock()
+
+		if mb.history != nil {
+			mb.history.record(mb.clock.Now(), mb.Snapshot())
+		}
 	}
 }
 
-func (mb *SquareMetrics) postMetrics() error {
-	metrics := mb.SerializeMetrics()
-	raw, err := json.Marshal(metrics)
-	if err != nil {
-		panic(err)
+func (mb *SquareMetrics) postMetrics(ctx context.Context) error {
+	// wait for a publish in progress, unless ctx is done first
+	select {
+	case mb.publishing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	resp, err := mb.client.Post(mb.url, "application/json", bytes.NewReader(raw))
-	if resp != nil {
-		defer resp.Body.Close()
+	defer func() {
+		<-mb.publishing
+	}()
+
+	// the settings lock is only held while collecting, not while talking to
+	// the bridge, so that Reload and Unregister don't wait for a slow one
+	target := mb.currentURL()
+	if !mb.hasDestination(target) {
+		mb.streamSnapshot()
+		return nil
+	}
+
+	if !mb.bridgeReady(ctx, target) {
+		mb.stats.dropped()
+		mb.streamSnapshot()
+		return nil
+	}
+
+	if mb.handshake != nil && target != "" && mb.sink == nil && mb.dryRun == nil {
+		if err := mb.negotiate(ctx); err != nil {
+			mb.stats.dropped()
+			mb.streamSnapshot()
+			return err
+		}
+	}
+
+	nvs, points, heartbeat, rollups := mb.collectPublish()
+	if mb.thresholds != nil {
+		mb.evaluateThresholds(nvs)
+	}
+	mb.stream(points)
+	err := mb.postBatches(ctx, target, split(points, mb.batchSize, heartbeat))
+	if err != nil && mb.rollup != nil {
+		mb.rollup.restore(rollups)
+	}
+	if err != nil && mb.dedupe != nil {
+		mb.dedupe.restore(nvs)
+	}
+	if err == nil && mb.spool != nil && mb.sink == nil && mb.dryRun == nil {
+		mb.drainSpool(ctx, target)
+	}
+	return err
+}
+
+// collectPublish collects the metrics due for a publish, returning the
+// flattened tuples and the points to post, both backed by mb.scratch and only
+// valid until the next publish, the heartbeat point to add to every batch if
+// there is one, and the gauge rollup windows it consumed.
+func (mb *SquareMetrics) collectPublish() ([]tuple, []MetricPoint, []MetricPoint, map[string]rollupWindow) {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+
+	mb.scratch.cycle()
+	nvs := mb.collectTuples(mb.lanes.due, mb.scratch)
+	mb.lanes.advance()
+	var rollups map[string]rollupWindow
+	if mb.rollup != nil {
+		rollups = mb.rollup.reset(mb.scratch.entries)
+	}
+	if mb.dedupe != nil {
+		nvs = mb.dedupe.filter(nvs)
+	}
+	points := mb.points(mb.scratch.points, nvs, true)
+	mb.scratch.points = points
+	var heartbeat []MetricPoint
+	if mb.heartbeat {
+		mb.beats++
+		heartbeat = mb.points(nil, []tuple{{selfPrefix + "heartbeat", mb.beats, CounterType}}, true)
+	}
+	return nvs, points, heartbeat, rollups
+}
+
+// postBatch serializes a batch and delivers it, retrying if configured
+func (mb *SquareMetrics) postBatch(ctx context.Context, target string, points []MetricPoint) error {
+	if mb.sink != nil {
+		return mb.sendToSink(ctx, points)
+	}
+
+	buf := getBuffer()
+	if err := mb.encodePoints(buf, mb.negotiated(points)); err != nil {
+		putBuffer(buf)
+		mb.status.record(PublishEvent{Err: err}, mb.clock.Now())
+		return err
+	}
+	body := &pooledBody{buf: buf, id: newBatchID(), sequence: mb.sequence.next()}
+	defer body.release()
+	mb.status.setPayload(buf.Bytes())
+
+	start := mb.clock.Now()
+	status, err := mb.sendWithRetries(withBatchSize(ctx, len(points)), target, body)
+	end := mb.clock.Now()
+	event := PublishEvent{
+		BatchSize:    len(points),
+		PayloadBytes: buf.Len(),
+		Duration:     end.Sub(start),
+		StatusCode:   status,
+		BatchID:      body.id,
+		Sequence:     body.sequence,
+		Err:          err,
+	}
+	spooled := err != nil && mb.spool != nil && mb.dryRun == nil && retryable(status, err) && mb.spoolBatch(body)
+	if err != nil && !spooled {
+		mb.stats.dropped()
 	}
+	mb.status.record(event, end)
+	mb.firePublishHooks(event)
 	return err
 }
 
-func (mb *SquareMetrics) serializeMetric(now int64, metric tuple) map[string]interface{} {
-	return map[string]interface{}{
-		"timestamp": now,
-		"metric":    fmt.Sprintf("%s.%s", mb.prefix, metric.name),
-		"value":     metric.value,
-		"hostname":  mb.hostname,
+// InstanceHeader is the request header carrying an id that is unique to each
+// SquareMetrics, so that receivers such as relays can tell publishers apart.
+const InstanceHeader = "X-Sqmetrics-Instance"
+
+// send delivers a serialized batch to the bridge at target (or the dry run
+// writer), and returns the response status code, if any.
+func (mb *SquareMetrics) send(ctx context.Context, target string, body *pooledBody) (int, error) {
+	raw := body.buf.Bytes()
+	if mb.dryRun != nil {
+		_, err := fmt.Fprintf(mb.dryRun, "%s\n", raw)
+		return 0, err
+	}
+	sent := body
+	if mb.handshake.supports(FeatureGzip) {
+		sent = &pooledBody{buf: compress(raw)}
+		defer sent.release()
+		raw = sent.buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, sent.reader())
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = int64(len(raw))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return sent.reader(), nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sent != body {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set(InstanceHeader, mb.diffs.instance)
+	req.Header.Set(BatchIDHeader, body.id)
+	req.Header.Set(IdempotencyKeyHeader, body.id)
+	req.Header.Set(SequenceHeader, strconv.FormatUint(body.sequence, 10))
+	if body.replay {
+		req.Header.Set(ReplayHeader, "true")
+	}
+	if err := mb.token.authorize(req); err != nil {
+		return 0, err
+	}
+	if err := mb.signer.sign(req, raw); err != nil {
+		return 0, err
+	}
+	if mb.acks {
+		req.Header.Set(AckHeader, "required")
+	}
+	start := mb.clock.Now()
+	resp, err := mb.client.Do(req)
+	end := mb.clock.Now()
+	if err == nil && resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("metrics bridge responded with %s", resp.Status)
+	} else if err == nil && (mb.acks || resp.StatusCode == http.StatusMultiStatus) {
+		err = mb.readResponse(resp, body.id)
+	}
+	mb.stats.record(len(raw), mb.clock.Now().Sub(start), err)
+	mb.observePublish(resp, target)
+	mb.stats.certificate(resp, end)
+	mb.stats.clockSkew(resp, start, end)
+	if resp == nil {
+		return 0, err
 	}
+	defer resp.Body.Close()
+	return resp.StatusCode, err
+}
+
+func (mb *SquareMetrics) serializeMetric(point MetricPoint) map[string]interface{} {
+	m := map[string]interface{}{
+		"timestamp": point.Timestamp,
+		"metric":    point.Name,
+		"value":     point.Value,
+		"hostname":  point.Hostname,
+	}
+	if point.StartTimestamp != 0 {
+		m["start_timestamp"] = point.StartTimestamp
+	}
+	if len(point.Tags) > 0 {
+		m["tags"] = point.Tags
+	}
+	if point.Sketch != "" {
+		m["sketch"] = point.Sketch
+	}
+	return m
 }
 
 type tuple struct {
 	name  string
 	value interface{}
+	kind  MetricType
 }
 
 // SerializeMetrics returns a map of the collected metrics, suitable for JSON marshalling
 func (mb *SquareMetrics) SerializeMetrics() []map[string]interface{} {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+	return mb.serializeTuples(mb.collectTuples(nil, nil))
+}
+
+// collectTuples flattens the registry into name/value pairs. If due is not
+// nil, only metrics for which it returns true are included. If scratch is not
+// nil, the collection is for a publish: its slices are reused for the result,
+// which is only valid until the next call with the same scratch, and metrics
+// that expired, exceed the series cap or were unregistered from their
+// registry directly are unregistered or forgotten.
+func (mb *SquareMetrics) collectTuples(due func(name string) bool, scratch *publishScratch) []tuple {
+	entries := []registryEntry{}
 	nvs := []tuple{}
+	if scratch != nil {
+		entries, nvs = scratch.entries[:0], scratch.tuples[:0]
+	}
+	mb.eachMetric(func(name, registryName string, i interface{}) {
+		if scratch != nil {
+			mb.live.mark(name)
+		}
+		entries = append(entries, registryEntry{name, registryName, i})
+	})
+
+	parallel := mb.workers > 1 && len(entries) >= parallelThreshold
+	var expired, rejected []string
+	if parallel {
+		entries, expired, rejected = mb.selectParallel(entries, due, scratch != nil)
+	} else {
+		entries, expired, rejected = mb.selectEntries(entries, due, scratch != nil)
+	}
+
+	// only publishes unregister metrics, so that serializing the registry
+	// in between doesn't change what is published
+	if scratch != nil {
+		if mb.ttl != nil && mb.ttl.unregister {
+			for _, name := range expired {
+				mb.unregister(name)
+			}
+		}
+		for _, name := range rejected {
+			mb.unregister(name)
+		}
+		for _, name := range mb.live.sweep() {
+			mb.forget(name)
+		}
+	}
+
+	if parallel {
+		nvs = mb.flattenParallel(nvs, entries)
+	} else {
+		nvs = mb.flatten(nvs, entries)
+	}
+	if scratch != nil {
+		scratch.entries, scratch.tuples = entries, nvs
+	}
+	return nvs
+}
+
+type registryEntry struct {
+	name         string
+	registryName string
+	metric       interface{}
+}
 
-	mb.Registry.Each(func(name string, i interface{}) {
-		switch metric := i.(type) {
+// selectEntries filters entries in place down to the metrics to serialize,
+// and returns the names of those that expired or exceed the series cap,
+// which is only filled up by publishes.
+func (mb *SquareMetrics) selectEntries(entries []registryEntry, due func(name string) bool, publish bool) ([]registryEntry, []string, []string) {
+	now := mb.clock.Now()
+	var expired, rejected []string
+	selected := entries[:0]
+	for _, entry := range entries {
+		if !mb.wanted(entry, due) {
+			continue
+		}
+		if mb.seriesCap != nil && !mb.seriesCap.admit(entry.name, publish) {
+			rejected = append(rejected, entry.name)
+			continue
+		}
+		if mb.ttl != nil && mb.ttl.stale(now, entry.name, entry.metric) {
+			expired = append(expired, entry.name)
+			continue
+		}
+		selected = append(selected, entry)
+	}
+	return selected, expired, rejected
+}
+
+// wanted reports whether the filters let the metric through, and it is due.
+func (mb *SquareMetrics) wanted(entry registryEntry, due func(name string) bool) bool {
+	return mb.filter.allows(entry.registryName) && (due == nil || due(entry.registryName))
+}
+
+// flatten appends the name/value pairs of the given registry metrics to nvs
+func (mb *SquareMetrics) flatten(nvs []tuple, entries []registryEntry) []tuple {
+	for _, entry := range entries {
+		name := entry.name
+		switch metric := entry.metric.(type) {
 		case metrics.Counter:
-			nvs = append(nvs, tuple{name, metric.Count()})
+			nvs = append(nvs, tuple{name, metric.Count(), CounterType})
 		case metrics.Gauge:
-			nvs = append(nvs, tuple{name, metric.Value()})
+			value := metric.Value()
+			nvs = append(nvs, tuple{name, value, GaugeType})
+			if mb.rollup != nil {
+				nvs = mb.appendRollup(nvs, name, GaugeType, float64(value))
+			}
 		case metrics.GaugeFloat64:
-			nvs = append(nvs, tuple{name, metric.Value()})
+			value := metric.Value()
+			nvs = append(nvs, tuple{name, value, GaugeFloat64Type})
+			if mb.rollup != nil {
+				nvs = mb.appendRollup(nvs, name, GaugeFloat64Type, value)
+			}
 		case metrics.Histogram:
-			histogram := metric.Snapshot()
-			nvs = append(nvs, []tuple{
-				{fmt.Sprintf("%s.count", name), histogram.Count()},
-				{fmt.Sprintf("%s.min", name), histogram.Min()},
-				{fmt.Sprintf("%s.max", name), histogram.Max()},
-				{fmt.Sprintf("%s.mean", name), histogram.Mean()},
-				{fmt.Sprintf("%s.50-percentile", name), histogram.Percentile(0.5)},
-				{fmt.Sprintf("%s.75-percentile", name), histogram.Percentile(0.75)},
-				{fmt.Sprintf("%s.95-percentile", name), histogram.Percentile(0.95)},
-				{fmt.Sprintf("%s.99-percentile", name), histogram.Percentile(0.99)},
-			}...)
+			s := mb.summaries.histogram(name, metric)
+			nvs = appendSummary(nvs, mb.names.summary(name, ""), HistogramType, s)
+			if bucketed, ok := metric.(Bucketed); ok {
+				bounds, counts := bucketed.Buckets()
+				nvs = appendBuckets(nvs, mb.names.buckets(name, bounds, 0), HistogramType, s.count, counts)
+			}
 		case metrics.Timer:
-			timer := metric.Snapshot()
-			nvs = append(nvs, []tuple{
-				{fmt.Sprintf("%s.count", name), timer.Count()},
-				{fmt.Sprintf("%s.min", name), timer.Min()},
-				{fmt.Sprintf("%s.max", name), timer.Max()},
-				{fmt.Sprintf("%s.mean", name), timer.Mean()},
-				{fmt.Sprintf("%s.50-percentile", name), timer.Percentile(0.5)},
-				{fmt.Sprintf("%s.75-percentile", name), timer.Percentile(0.75)},
-				{fmt.Sprintf("%s.95-percentile", name), timer.Percentile(0.95)},
-				{fmt.Sprintf("%s.99-percentile", name), timer.Percentile(0.99)},
-			}...)
+			s := mb.summaries.timer(name, metric)
+			nvs = mb.appendTimerSummary(nvs, name, s)
+			if bucketed, ok := metric.(Bucketed); ok {
+				bounds, counts := bucketed.Buckets()
+				nvs = appendBuckets(nvs, mb.names.buckets(name, bounds, mb.timerUnit), TimerType, s.count, counts)
+			}
+			if exponential, ok := metric.(Exponential); ok {
+				nvs = mb.appendExponential(nvs, name, TimerType, exponential)
+			}
+		case customMetric:
+			nvs = metric.flatten(mb.names, nvs, name)
 		}
-	})
+	}
+	return nvs
+}
 
-	now := time.Now().Unix()
+// unregister removes a metric from the registry along with everything
+// remembered about it
+func (mb *SquareMetrics) unregister(name string) {
+	if prefix, registryName, ok := splitName(name); ok {
+		if source := mb.source(prefix); source != nil {
+			source.registry.Unregister(registryName)
+		}
+	} else {
+		mb.Registry.Unregister(name)
+		mb.custom.unregister(name)
+	}
+	mb.forget(name)
+}
+
+// forget drops everything remembered about a metric that is no longer
+// registered.
+func (mb *SquareMetrics) forget(name string) {
+	if prefix, registryName, ok := splitName(name); ok {
+		if source := mb.source(prefix); source != nil {
+			source.names.Delete(registryName)
+		}
+	}
+	mb.names.forget(name)
+	mb.summaries.forget(name)
+	if mb.ttl != nil {
+		mb.ttl.forget(name)
+	}
+	if mb.seriesCap != nil {
+		mb.seriesCap.forget(name)
+	}
+	if mb.starts != nil {
+		mb.starts.forget(name)
+	}
+	if mb.rollup != nil {
+		mb.rollup.forget(name)
+	}
+	if mb.thresholds != nil {
+		mb.thresholds.forget(name)
+	}
+	if mb.rejections != nil {
+		if published, ok := mb.publishedName(name); ok {
+			mb.rejections.forget(published)
+		}
+	}
+}
+
+// appendSummary appends the flattened values of a histogram or timer, named
+// after names (see nameCache.summary).
+func appendSummary(nvs []tuple, names []string, kind MetricType, s summary) []tuple {
+	nvs = append(nvs,
+		tuple{names[0], s.count, kind},
+		tuple{names[1], s.min, kind},
+		tuple{names[2], s.max, kind},
+		tuple{names[3], s.mean, kind},
+	)
+	for i, percentile := range s.percentiles {
+		nvs = append(nvs, tuple{names[4+i], percentile, kind})
+	}
+	return nvs
+}
+
+func (mb *SquareMetrics) serializeTuples(nvs []tuple) []map[string]interface{} {
 	out := []map[string]interface{}{}
+	for _, point := range mb.points(nil, nvs, false) {
+		out = append(out, mb.serializeMetric(point))
+	}
+
+	return out
+}
+
+// encodePoints streams points to w as a JSON array, one element at a time,
+// without materializing the whole serialized batch first.
+func (mb *SquareMetrics) encodePoints(w io.Writer, points []MetricPoint) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	element := getBuffer()
+	defer putBuffer(element)
+	encoder := mb.newEncoder(element)
+	for i, point := range points {
+		element.Reset()
+		if i > 0 {
+			element.WriteByte(',')
+		}
+		if err := encoder.Encode(&point); err != nil {
+			return err
+		}
+		// drop the newline the encoder terminates each value with
+		if _, err := w.Write(element.Bytes()[:element.Len()-1]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// publishedName computes the name a flattened metric is published under,
+// and false if it is dropped by a rewrite rule
+func (mb *SquareMetrics) publishedName(name string) (string, bool) {
+	prefix := mb.prefix
+	if source, registryName, ok := splitName(name); ok {
+		prefix, name = source, registryName
+	}
+	name, _ = SplitTaggedName(name)
+	return rewrite(mb.rules, prefix+"."+name)
+}
+
+// points turns name/value pairs into MetricPoints with their final names,
+// appending them to dst[:0] so that its capacity can be reused. NaN and
+// infinite values are left out, as JSON can't represent them. Only publishes
+// advance the counter start times.
+func (mb *SquareMetrics) points(dst []MetricPoint, nvs []tuple, publish bool) []MetricPoint {
+	now := mb.clock.Now().Unix()
+	out := dst[:0]
 	for _, nv := range nvs {
-		out = append(out, mb.serializeMetric(now, nv))
+		if value, ok := nv.value.(float64); ok && (math.IsNaN(value) || math.IsInf(value, 0)) {
+			continue
+		}
+		name, ok := mb.names.publishedName(nv.name, mb.publishedName)
+		if !ok || (mb.rejections != nil && mb.rejections.drops(name)) {
+			continue
+		}
+		tags := mb.tags
+		if len(mb.sources) > 0 {
+			if prefix, _, ok := splitName(nv.name); ok {
+				tags = mb.source(prefix).merged
+			}
+		}
+		if seriesTags := mb.names.seriesTags(nv.name); seriesTags != nil {
+			tags = mergeMaps(tags, seriesTags)
+		}
+		var start int64
+		if value, ok := nv.value.(int64); ok && mb.starts != nil && nv.kind == CounterType {
+			if publish {
+				start = mb.starts.get(nv.name, value, now, mb.started.Unix())
+			} else {
+				start = mb.starts.peek(nv.name, value, mb.started.Unix())
+			}
+		}
+		value, sketch := nv.value, ""
+		if sketched, ok := value.(sketchValue); ok {
+			value, sketch = sketched.count, sketched.sketch
+		}
+		out = append(out, MetricPoint{
+			Timestamp:      now,
+			StartTimestamp: start,
+			Name:           name,
+			Value:          value,
+			Hostname:       mb.hostname,
+			Type:           nv.kind,
+			Tags:           tags,
+			Sketch:         sketch,
+		})
 	}
 
 	return out
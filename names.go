@@ -0,0 +1,229 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sync"
+	"time"
+)
+
+// summarySuffixes are appended to the names of histograms and timers for each
+// of the values they are flattened into, in the order serialized.
+var summarySuffixes = []string{
+	"count", "min", "max", "mean",
+	"50-percentile", "75-percentile", "95-percentile", "99-percentile",
+}
+
+// summaryPercentiles are the percentiles serialized for histograms and timers.
+var summaryPercentiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// nameCache remembers the names derived from registry names, so that
+// steady-state serialization does no string formatting: the flattened names of
+// histogram and timer values and buckets, final published names (with prefix
+// and rewrite rules applied) and the tags encoded in names by TaggedName.
+type nameCache struct {
+	mutex        sync.RWMutex
+	summaries    map[string][]string
+	bucketed     map[string][]string
+	exponentials map[string]*exponentialNames
+	stated       map[string][]string
+	rollups      map[string][]string
+	published    map[string]publishedName
+	tags         map[string]map[string]string
+}
+
+type publishedName struct {
+	name string
+	ok   bool // false if dropped by a rewrite rule
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{
+		summaries:    map[string][]string{},
+		bucketed:     map[string][]string{},
+		exponentials: map[string]*exponentialNames{},
+		stated:       map[string][]string{},
+		rollups:      map[string][]string{},
+		published:    map[string]publishedName{},
+		tags:         map[string]map[string]string{},
+	}
+}
+
+// summary returns the flattened names of the histogram or timer called name,
+// one per summarySuffixes entry, tagged with unit unless it is empty.
+func (c *nameCache) summary(name, unit string) []string {
+	c.mutex.RLock()
+	names, ok := c.summaries[name]
+	c.mutex.RUnlock()
+	if ok {
+		return names
+	}
+
+	base := withUnit(name, unit)
+	names = make([]string, len(summarySuffixes))
+	for i, suffix := range summarySuffixes {
+		names[i] = base + "." + suffix
+	}
+	c.mutex.Lock()
+	c.summaries[name] = names
+	c.mutex.Unlock()
+	return names
+}
+
+// buckets returns the flattened names of the buckets of the bucketed histogram
+// or timer called name, one per bound and one for +Inf.
+func (c *nameCache) buckets(name string, bounds []int64, unit time.Duration) []string {
+	c.mutex.RLock()
+	names, ok := c.bucketed[name]
+	c.mutex.RUnlock()
+	if ok {
+		return names
+	}
+
+	names = bucketNames(name, bounds, unit)
+	c.mutex.Lock()
+	c.bucketed[name] = names
+	c.mutex.Unlock()
+	return names
+}
+
+// rollup returns the flattened names of the aggregates of the rolled up gauge
+// called name, one per rollupSuffixes entry.
+func (c *nameCache) rollup(name string) []string {
+	c.mutex.RLock()
+	names, ok := c.rollups[name]
+	c.mutex.RUnlock()
+	if ok {
+		return names
+	}
+
+	names = make([]string, len(rollupSuffixes))
+	for i, suffix := range rollupSuffixes {
+		names[i] = name + "." + suffix
+	}
+	c.mutex.Lock()
+	c.rollups[name] = names
+	c.mutex.Unlock()
+	return names
+}
+
+// states returns the names of the points of the State called name, one per
+// state.
+func (c *nameCache) states(name string, states []string) []string {
+	c.mutex.RLock()
+	names, ok := c.stated[name]
+	c.mutex.RUnlock()
+	if ok {
+		return names
+	}
+
+	names = stateNames(name, states)
+	c.mutex.Lock()
+	c.stated[name] = names
+	c.mutex.Unlock()
+	return names
+}
+
+// exponential returns the flattened names of the exponential timer called
+// name.
+func (c *nameCache) exponential(name string) *exponentialNames {
+	c.mutex.RLock()
+	names, ok := c.exponentials[name]
+	c.mutex.RUnlock()
+	if ok {
+		return names
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if names, ok = c.exponentials[name]; !ok {
+		names = newExponentialNames(name)
+		c.exponentials[name] = names
+	}
+	return names
+}
+
+// publishedName returns the name a flattened metric is published under, and
+// false if it is dropped, computing it with compute the first time.
+func (c *nameCache) publishedName(name string, compute func(string) (string, bool)) (string, bool) {
+	c.mutex.RLock()
+	cached, ok := c.published[name]
+	c.mutex.RUnlock()
+	if ok {
+		return cached.name, cached.ok
+	}
+
+	cached.name, cached.ok = compute(name)
+	c.mutex.Lock()
+	c.published[name] = cached
+	c.mutex.Unlock()
+	return cached.name, cached.ok
+}
+
+// seriesTags returns the tags encoded in the name of a flattened metric, or
+// nil if it has none.
+func (c *nameCache) seriesTags(name string) map[string]string {
+	c.mutex.RLock()
+	tags, ok := c.tags[name]
+	c.mutex.RUnlock()
+	if ok {
+		return tags
+	}
+
+	_, tags = SplitTaggedName(unqualified(name))
+	c.mutex.Lock()
+	c.tags[name] = tags
+	c.mutex.Unlock()
+	return tags
+}
+
+// forget drops the cached names of an unregistered metric.
+func (c *nameCache) forget(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if summary, ok := c.summaries[name]; ok {
+		for _, flattened := range summary {
+			delete(c.published, flattened)
+			delete(c.tags, flattened)
+		}
+		delete(c.summaries, name)
+	}
+	for _, flattened := range c.bucketed[name] {
+		delete(c.published, flattened)
+		delete(c.tags, flattened)
+	}
+	delete(c.bucketed, name)
+	for _, flattened := range c.stated[name] {
+		delete(c.published, flattened)
+		delete(c.tags, flattened)
+	}
+	delete(c.stated, name)
+	for _, flattened := range c.rollups[name] {
+		delete(c.published, flattened)
+		delete(c.tags, flattened)
+	}
+	delete(c.rollups, name)
+	if names, ok := c.exponentials[name]; ok {
+		for _, flattened := range names.all() {
+			delete(c.published, flattened)
+			delete(c.tags, flattened)
+		}
+		delete(c.exponentials, name)
+	}
+	delete(c.published, name)
+	delete(c.tags, name)
+}
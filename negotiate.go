@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Payload features that can be negotiated with the bridge, see
+// WithNegotiation.
+const (
+	// FeatureTags is the support of point tags.
+	FeatureTags = "tags"
+	// FeatureGzip is the support of gzip compressed request bodies.
+	FeatureGzip = "gzip"
+	// FeatureStartTimestamps is the support of counter start timestamps, see
+	// WithStartTimes.
+	FeatureStartTimestamps = "start-timestamps"
+)
+
+// WithNegotiation makes sqmetrics ask the bridge which payload features it
+// supports before publishing to it, and use the richest payload it accepts.
+// A GET request is sent to path (resolved against the bridge URL, as for
+// WithHealthProbe), which should respond with a JSON document of the form
+// {"version": 1, "features": ["tags", "gzip", "start-timestamps"]}. Features
+// the bridge doesn't list are not used. A bridge that responds 404 Not Found,
+// 405 Method Not Allowed or 501 Not Implemented, or with an invalid document,
+// doesn't negotiate and supports none of them: batches are then sent in the
+// legacy schema, without tags and start timestamps, so series that only
+// differ by their tags are indistinguishable. Without negotiation, every
+// feature but gzip is used. Protobuf payloads are not implemented.
+//
+// Until the bridge answers (while it can't be reached, or responds with
+// another error, e.g. 401 Unauthorized or 429 Too Many Requests), nothing is
+// published, rather than publishing or spooling batches in a schema the
+// bridge may not need: publishes fail, and negotiation is attempted again
+// before each of them. Counters keep counting in the meantime. Features are
+// negotiated again after Reload changes the bridge URL.
+func WithNegotiation(path string) Option {
+	return func(mb *SquareMetrics) {
+		mb.handshake = &negotiation{path: path, url: probeURL(mb.url, path)}
+	}
+}
+
+// negotiation is the outcome of the handshake with the bridge.
+type negotiation struct {
+	path string
+
+	mutex    sync.Mutex
+	url      string
+	answered bool            // the bridge answered, with features or not
+	features map[string]bool // nil if the bridge doesn't negotiate
+}
+
+type versionResponse struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// supports reports whether the bridge supports a payload feature. It must
+// only be relied on once negotiate succeeded.
+func (n *negotiation) supports(feature string) bool {
+	if n == nil {
+		return feature != FeatureGzip
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.features[feature]
+}
+
+// reset forgets the outcome of the handshake, when the bridge URL changes.
+func (n *negotiation) reset(bridge string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.url = probeURL(bridge, n.path)
+	n.answered, n.features = false, nil
+}
+
+// doesntNegotiate reports whether a response status means that the bridge
+// doesn't implement negotiation, as opposed to failing to answer for now.
+func doesntNegotiate(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented
+}
+
+// negotiate asks the bridge which features it supports, unless it already
+// answered, and returns an error if it didn't answer.
+func (mb *SquareMetrics) negotiate(ctx context.Context) error {
+	n := mb.handshake
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.answered {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", n.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := mb.token.authorize(req); err != nil {
+		return err
+	}
+	resp, err := mb.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error negotiating features with the metrics bridge: %w", err)
+	}
+	defer resp.Body.Close()
+	if doesntNegotiate(resp.StatusCode) {
+		n.answered = true
+		mb.logger.Printf("metrics bridge doesn't negotiate features, using the legacy schema")
+		return nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error negotiating features with the metrics bridge: it responded with %s", resp.Status)
+	}
+
+	n.answered = true
+	var version versionResponse
+	if json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&version) != nil {
+		mb.logger.Printf("metrics bridge responded with an invalid version document, using the legacy schema")
+		return nil
+	}
+	n.features = map[string]bool{}
+	for _, feature := range version.Features {
+		n.features[feature] = true
+	}
+	features := append([]string(nil), version.Features...)
+	sort.Strings(features)
+	mb.logger.Printf("metrics bridge version %d supports %v", version.Version, features)
+	return nil
+}
+
+// negotiated returns the points of a batch with the features the bridge does
+// not support removed, copying them if needed.
+func (mb *SquareMetrics) negotiated(points []MetricPoint) []MetricPoint {
+	tags := mb.handshake.supports(FeatureTags)
+	starts := mb.handshake.supports(FeatureStartTimestamps)
+	if tags && starts {
+		return points
+	}
+	stripped := make([]MetricPoint, len(points))
+	for i, point := range points {
+		if !tags {
+			point.Tags = nil
+		}
+		if !starts {
+			point.StartTimestamp = 0
+		}
+		stripped[i] = point
+	}
+	return stripped
+}
+
+// compress returns the gzip compressed body.
+func compress(body []byte) *bytes.Buffer {
+	buf := getBuffer()
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(buf)
+	gz.Write(body)
+	gz.Close()
+	gz.Reset(nil)
+	gzipWriters.Put(gz)
+	return buf
+}
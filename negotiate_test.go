@@ -0,0 +1,150 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// negotiatingBridge answers the handshake at /version with status and
+// version, and records the batches posted to it.
+type negotiatingBridge struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	status  int
+	version string
+	gzipped []bool
+	batches [][]map[string]interface{}
+}
+
+func newNegotiatingBridge(status int, version string) *negotiatingBridge {
+	b := &negotiatingBridge{status: status, version: version}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if r.URL.Path == "/version" {
+			w.WriteHeader(b.status)
+			io.WriteString(w, b.version)
+			return
+		}
+		body := r.Body
+		gzipped := r.Header.Get("Content-Encoding") == "gzip"
+		if gzipped {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		var batch []map[string]interface{}
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.gzipped = append(b.gzipped, gzipped)
+		b.batches = append(b.batches, batch)
+	}))
+	return b
+}
+
+func (b *negotiatingBridge) answer(status int, version string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.status, b.version = status, version
+}
+
+func (b *negotiatingBridge) received() ([][]map[string]interface{}, []bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.batches, b.gzipped
+}
+
+func publishTo(t *testing.T, bridge *negotiatingBridge) *sqmetrics.SquareMetrics {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", registry).Inc(1)
+	mb := sqmetrics.NewMetrics(bridge.URL+"/publish", "app", bridge.Client(), time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithTags(map[string]string{"pod": "web-1"}),
+		sqmetrics.WithNegotiation("/version"))
+	t.Cleanup(mb.Close)
+	return mb
+}
+
+func TestNegotiationUsesTheFeaturesTheBridgeSupports(t *testing.T) {
+	bridge := newNegotiatingBridge(http.StatusOK, `{"version": 2, "features": ["tags", "gzip"]}`)
+	defer bridge.Close()
+	if err := publishTo(t, bridge).Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, gzipped := bridge.received()
+	if len(batches) != 1 || !gzipped[0] {
+		t.Fatalf("got %d batches, gzipped %v, want a gzipped batch", len(batches), gzipped)
+	}
+	if tags, _ := batches[0][0]["tags"].(map[string]interface{}); tags["pod"] != "web-1" {
+		t.Errorf("sent tags %v, want pod web-1", batches[0][0]["tags"])
+	}
+}
+
+func TestNegotiationFallsBackToTheLegacySchema(t *testing.T) {
+	bridge := newNegotiatingBridge(http.StatusNotFound, "")
+	defer bridge.Close()
+	if err := publishTo(t, bridge).Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, gzipped := bridge.received()
+	if len(batches) != 1 || gzipped[0] {
+		t.Fatalf("got %d batches, gzipped %v, want an uncompressed batch", len(batches), gzipped)
+	}
+	if tags, ok := batches[0][0]["tags"]; ok {
+		t.Errorf("sent tags %v to a bridge that doesn't support them", tags)
+	}
+}
+
+func TestNothingIsPublishedUntilTheBridgeAnswers(t *testing.T) {
+	bridge := newNegotiatingBridge(http.StatusServiceUnavailable, "")
+	defer bridge.Close()
+	mb := publishTo(t, bridge)
+	if err := mb.Flush(context.Background()); err == nil {
+		t.Fatal("publish didn't fail")
+	}
+	if batches, _ := bridge.received(); len(batches) != 0 {
+		t.Fatalf("published %d batches before negotiating", len(batches))
+	}
+
+	bridge.answer(http.StatusOK, `{"version": 1, "features": ["tags"]}`)
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if batches, _ := bridge.received(); len(batches) != 1 {
+		t.Errorf("got %d batches once the bridge answered, want 1", len(batches))
+	}
+}
@@ -0,0 +1,279 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"io"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Option configures optional behaviour of SquareMetrics. Options are passed to
+// NewMetrics and applied before any collection or publishing starts.
+type Option func(*SquareMetrics)
+
+// maxJitter is the largest jitter fraction. Two publishes can be jittered
+// towards each other by up to twice the fraction of an interval, so this keeps
+// them at least half an interval apart.
+const maxJitter = 0.25
+
+// WithJitter randomizes the publish schedule by up to ±fraction of the
+// interval (e.g. 0.1 for ±10%), so that a fleet of processes started at the
+// same time doesn't post to the bridge in lockstep. Fractions above 0.25 are
+// reduced to 0.25, and negative ones (or NaN) disable jitter, with a warning.
+func WithJitter(fraction float64) Option {
+	return func(mb *SquareMetrics) {
+		switch {
+		case !(fraction >= 0):
+			mb.logger.Printf("invalid metrics jitter %g, not jittering publishes", fraction)
+			fraction = 0
+		case fraction > maxJitter:
+			mb.logger.Printf("metrics jitter %g is too large, using %g", fraction, maxJitter)
+			fraction = maxJitter
+		}
+		mb.jitter = fraction
+	}
+}
+
+// WithAlignedPublishing aligns publishes to wall-clock multiples of the
+// interval (e.g. on the minute for a 60s interval) rather than to the time the
+// process started. Jitter is not applied to aligned publishes.
+func WithAlignedPublishing() Option {
+	return func(mb *SquareMetrics) {
+		mb.aligned = true
+	}
+}
+
+// WithDedupe only publishes metrics whose value changed since the previous
+// publish. Every refreshEvery publishes (starting with the first) all metrics
+// are sent regardless, so static values still reach the bridge periodically;
+// if refreshEvery is zero only the first publish is complete. Metrics of a
+// publish that failed are sent again by the next one. ServeHTTP always returns
+// every metric.
+func WithDedupe(refreshEvery int) Option {
+	return func(mb *SquareMetrics) {
+		mb.dedupe = &dedupe{refresh: refreshEvery}
+	}
+}
+
+// WithTTL stops publishing metrics that have not been updated within window.
+// A metric counts as updated when its value, or for histograms and timers its
+// count, changes; gauges that are deliberately static should therefore be kept
+// out of scope by passing the prefixes of the dynamically-named metrics the TTL
+// should apply to (all metrics if none are given). If unregister is true,
+// expired metrics are also removed from the registry, so that they start over
+// if they are ever used again.
+func WithTTL(window time.Duration, unregister bool, prefixes ...string) Option {
+	return func(mb *SquareMetrics) {
+		mb.ttl = &ttl{
+			window:     window,
+			unregister: unregister,
+			prefixes:   prefixes,
+			seen:       map[string]ttlEntry{},
+		}
+	}
+}
+
+// WithInclude restricts serialization to metrics matching one of the given
+// patterns. A pattern is an exact registry name, or a prefix if it ends in "*",
+// e.g. "runtime.mem.*". May be combined with WithExclude.
+func WithInclude(patterns ...string) Option {
+	return func(mb *SquareMetrics) {
+		mb.filter.include = append(mb.filter.include, patterns...)
+	}
+}
+
+// WithExclude leaves metrics matching one of the given patterns out of
+// serialization. Patterns are as for WithInclude, and exclusions take
+// precedence over inclusions.
+func WithExclude(patterns ...string) Option {
+	return func(mb *SquareMetrics) {
+		mb.filter.exclude = append(mb.filter.exclude, patterns...)
+	}
+}
+
+// WithTags attaches the given tags to every published metric. Tags from
+// repeated WithTags options are merged, later values winning, and take
+// precedence over tags derived from the environment. The tags map of
+// a MetricPoint is shared between points and must not be modified.
+func WithTags(tags map[string]string) Option {
+	return func(mb *SquareMetrics) {
+		mb.userTags = mergeMaps(mb.userTags, tags)
+		mb.updateTags()
+	}
+}
+
+// WithRewriteRules applies the given rules, in order, to the full name of
+// every serialized metric, to drop or rename metrics without changing the code
+// that records them.
+func WithRewriteRules(rules ...RewriteRule) Option {
+	return func(mb *SquareMetrics) {
+		mb.rules = append(mb.rules, rules...)
+	}
+}
+
+// WithPublishEvery puts the metrics matching patterns in a slow lane that is
+// only included in every nth publish (starting with the first), e.g. n=300 for
+// metrics that need 5 minute resolution when publishing every second. Patterns
+// are as for WithInclude; if a metric matches several lanes the first one
+// configured wins. ServeHTTP always returns every metric.
+func WithPublishEvery(n int, patterns ...string) Option {
+	return func(mb *SquareMetrics) {
+		mb.lanes.lanes = append(mb.lanes.lanes, lane{n, patterns})
+	}
+}
+
+// WithMaxSeries caps the number of distinct metric names in the registry that
+// are serialized. Once the cap is reached, metrics with new names are
+// unregistered at the next publish (code holding on to them keeps working, but
+// they are no longer published) and counted in the sqmetrics.dropped-series
+// counter, once for each name. Metrics removed with Unregister or
+// UnregisterFrom release their slot right away, those removed from their
+// registry directly at the next publish.
+func WithMaxSeries(max int) Option {
+	return func(mb *SquareMetrics) {
+		mb.seriesCap = &cardinalityCap{
+			max:      max,
+			dropped:  metrics.GetOrRegisterCounter(selfPrefix+"dropped-series", mb.Registry),
+			admitted: map[string]struct{}{},
+			rejected: map[string]struct{}{},
+		}
+	}
+}
+
+// WithDryRun serializes each publish as usual but writes the payload to out,
+// one JSON batch per line, instead of posting it to the bridge. Publishing
+// happens even if no bridge URL is configured. Pass the logger's writer (e.g.
+// log.Writer()) to see payloads in the log.
+func WithDryRun(out io.Writer) Option {
+	return func(mb *SquareMetrics) {
+		mb.dryRun = out
+	}
+}
+
+// WithHealthProbe pauses publishing while the bridge is unhealthy. Once a
+// publish fails with a transport or server error, each subsequent interval
+// only sends a HEAD request to path (resolved against the bridge URL; empty for
+// the bridge URL itself) until it succeeds, and then resumes publishing.
+func WithHealthProbe(path string) Option {
+	return func(mb *SquareMetrics) {
+		mb.probe = &healthProbe{path: path}
+	}
+}
+
+// WithHeartbeat adds a sqmetrics.heartbeat counter, incremented on every
+// publish, to every batch sent to the bridge. It bypasses filters, slow lanes
+// and dedupe, so a batch is never empty and absence-of-data alerts can tell a
+// dead process from one with nothing to report.
+func WithHeartbeat() Option {
+	return func(mb *SquareMetrics) {
+		mb.heartbeat = true
+	}
+}
+
+// WithSelfMetrics records metrics about publishing itself in the registry. A
+// publish fails if the request errors or the bridge responds with a non-2xx
+// status.
+//
+//	sqmetrics.publish.success        counter, successful publishes
+//	sqmetrics.publish.failure        counter, failed publishes
+//	sqmetrics.publish.latency        timer, of the POST to the bridge
+//	sqmetrics.publish.payload-bytes  gauge, size of the last payload
+//	sqmetrics.publish.skipped        counter, publishes skipped, the previous one still running
+//	sqmetrics.publish.rejected       counter, metrics the bridge rejected (see Rejection)
+//	sqmetrics.batches.dropped        counter, batches never delivered
+//	sqmetrics.batches.queued         gauge, batches waiting to be delivered
+//	sqmetrics.spool.bytes            gauge, size of the spool (see WithSpool)
+//	sqmetrics.tls.cert-expiry-days   gauge, days until the bridge's certificates expire
+//	sqmetrics.clock-skew             gauge, seconds the clock is ahead of the bridge's
+//
+// The data of skipped publishes goes out with the next one. Batches are
+// dropped if they fail, or are skipped while the bridge is unhealthy. The
+// certificate expiry is only recorded when publishing over HTTPS, and checked
+// daily. The clock skew is estimated from the Date header of the bridge's
+// responses.
+func WithSelfMetrics() Option {
+	return func(mb *SquareMetrics) {
+		mb.stats = newPublishStats(mb.Registry)
+	}
+}
+
+// WithErrorHandler calls handler with every error encountered while
+// publishing or serializing metrics, in addition to logging it, so that
+// applications can feed them into their own alerting. The handler is called
+// synchronously from the publish loop and must not block.
+func WithErrorHandler(handler func(error)) Option {
+	return func(mb *SquareMetrics) {
+		mb.onError = handler
+	}
+}
+
+// WithPublishHook calls hook after every publish attempt, successful or not,
+// with a description of the attempt. It can be given several times to install
+// several hooks, which are called synchronously in order from the publish loop
+// (or, with WithConcurrentBatches, from the goroutines posting batches) and
+// must not block. Setting SQMETRICS_DEBUG=1 in the environment installs a
+// hook that logs every attempt.
+func WithPublishHook(hook func(PublishEvent)) Option {
+	return func(mb *SquareMetrics) {
+		mb.hooks = append(mb.hooks, hook)
+	}
+}
+
+// WithParallelSerialization spreads the filtering and flattening of large
+// registries (many thousands of metrics) over the given number of goroutines,
+// for registries so big that serializing them sequentially takes a sizeable
+// part of the publish interval. Metrics serialized in parallel are sorted by
+// name, tags included, so their order is the same from one publish to the
+// next.
+func WithParallelSerialization(workers int) Option {
+	return func(mb *SquareMetrics) {
+		mb.workers = workers
+	}
+}
+
+// WithBatchSize splits publishes into batches of at most size metrics each,
+// for bridges that limit the size of the requests they accept. With
+// WithHeartbeat, every batch carries the heartbeat, which counts towards size.
+func WithBatchSize(size int) Option {
+	return func(mb *SquareMetrics) {
+		mb.batchSize = size
+	}
+}
+
+// WithConcurrentBatches posts up to n batches of a publish to the bridge
+// concurrently, rather than one after the other. Only useful together with
+// WithBatchSize.
+func WithConcurrentBatches(n int) Option {
+	return func(mb *SquareMetrics) {
+		mb.batchPosts = n
+	}
+}
+
+// WithRetries retries each batch up to attempts more times if posting it
+// fails with a transport error, a 429 Too Many Requests or a server error,
+// waiting backoff before the first retry and twice as long before each
+// subsequent one. Batches that still fail are dropped. Retries carry the same
+// IdempotencyKeyHeader as the first attempt, so that a bridge which processed
+// a batch whose response was lost can tell and not process it twice.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(mb *SquareMetrics) {
+		mb.retries = attempts
+		mb.backoff = backoff
+	}
+}
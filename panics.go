@@ -0,0 +1,46 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// RecoverPanics wraps fn so that any panic it raises is recovered, logged and
+// counted in the "panics" counter. If repanic is true the panic is re-raised
+// after it has been counted, so the process still crashes as it would have
+// without the wrapper. The returned function may be called directly or started
+// as a goroutine:
+//
+//	go metrics.RecoverPanics(worker, true)()
+func (mb *SquareMetrics) RecoverPanics(fn func(), repanic bool) func() {
+	panics := metrics.GetOrRegisterCounter("panics", mb.Registry)
+	return func() {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			panics.Inc(1)
+			mb.logger.Printf("recovered panic: %v", r)
+			if repanic {
+				panic(r)
+			}
+		}()
+		fn()
+	}
+}
@@ -0,0 +1,129 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// parallelThreshold is the number of registry metrics below which
+// serialization stays sequential even if workers are configured, as the
+// overhead of fanning out outweighs the gain.
+const parallelThreshold = 4096
+
+// eachShard splits n items into at most mb.workers contiguous shards, and
+// calls fn with the bounds of each on its own goroutine, returning once all
+// are done.
+func (mb *SquareMetrics) eachShard(n int, fn func(shard, start, end int)) {
+	shardSize := (n + mb.workers - 1) / mb.workers
+	var wg sync.WaitGroup
+	for i := 0; i < mb.workers; i++ {
+		start, end := i*shardSize, (i+1)*shardSize
+		if start >= n {
+			break
+		}
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			fn(i, start, end)
+		}(i, start, end)
+	}
+	wg.Wait()
+}
+
+// selectParallel is selectEntries with the filters and TTL checks spread over
+// mb.workers goroutines. The entries are sorted by name first, which makes
+// the order of the output deterministic even though registries are walked in
+// no particular order. Series cap admission depends on that order, so it runs
+// sequentially in between.
+func (mb *SquareMetrics) selectParallel(entries []registryEntry, due func(name string) bool, publish bool) ([]registryEntry, []string, []string) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	now := mb.clock.Now()
+	entries = mb.keepParallel(entries, func(entry registryEntry) bool {
+		return mb.wanted(entry, due)
+	})
+
+	var rejected []string
+	if mb.seriesCap != nil {
+		admitted := entries[:0]
+		for _, entry := range entries {
+			if mb.seriesCap.admit(entry.name, publish) {
+				admitted = append(admitted, entry)
+			} else {
+				rejected = append(rejected, entry.name)
+			}
+		}
+		entries = admitted
+	}
+
+	var expired []string
+	if mb.ttl != nil {
+		var mutex sync.Mutex
+		entries = mb.keepParallel(entries, func(entry registryEntry) bool {
+			if !mb.ttl.stale(now, entry.name, entry.metric) {
+				return true
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			expired = append(expired, entry.name)
+			return false
+		})
+	}
+	return entries, expired, rejected
+}
+
+// keepParallel filters entries in place, in order, down to those keep returns
+// true for, checking each shard on its own goroutine.
+func (mb *SquareMetrics) keepParallel(entries []registryEntry, keep func(registryEntry) bool) []registryEntry {
+	kept := make([]int, mb.workers)
+	mb.eachShard(len(entries), func(shard, start, end int) {
+		n := start
+		for _, entry := range entries[start:end] {
+			if keep(entry) {
+				entries[n] = entry
+				n++
+			}
+		}
+		kept[shard] = n - start
+	})
+
+	// each shard kept a prefix of its range; close the gaps between them
+	n := 0
+	shardSize := (len(entries) + mb.workers - 1) / mb.workers
+	for shard, count := range kept {
+		n += copy(entries[n:], entries[shard*shardSize:shard*shardSize+count])
+	}
+	return entries[:n]
+}
+
+// flattenParallel flattens the entries on mb.workers goroutines, each taking a
+// contiguous shard, and appends the shards to nvs in order, so the result is
+// the same as that of flatten.
+func (mb *SquareMetrics) flattenParallel(nvs []tuple, entries []registryEntry) []tuple {
+	shards := make([][]tuple, mb.workers)
+	mb.eachShard(len(entries), func(shard, start, end int) {
+		shards[shard] = mb.flatten(make([]tuple, 0, end-start), entries[start:end])
+	})
+	for _, shard := range shards {
+		nvs = append(nvs, shard...)
+	}
+	return nvs
+}
@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestParallelSerializationIsSortedAndComplete(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 5000; i++ {
+		metrics.GetOrRegisterCounter(fmt.Sprintf("shard.%d", i), registry).Inc(int64(i))
+	}
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink), sqmetrics.WithParallelSerialization(4),
+		// scattered through every shard
+		sqmetrics.WithExclude("shard.1*")) // spread over every shard
+	defer mb.Close()
+
+	var previous []string
+	for publish := 0; publish < 2; publish++ {
+		sink.Reset()
+		if err := mb.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, point := range sink.Points() {
+			names = append(names, point.Name)
+		}
+		if len(names) != 3889 {
+			t.Fatalf("publish %d sent %d metrics, want the 3889 not excluded", publish, len(names))
+		}
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("publish %d isn't sorted by name", publish)
+		}
+		if previous != nil && !equal(names, previous) {
+			t.Errorf("publish %d is in a different order from the previous one", publish)
+		}
+		previous = names
+	}
+}
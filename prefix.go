@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// prefixVariable matches the {name} placeholders of a prefix template.
+var prefixVariable = regexp.MustCompile(`\{([A-Za-z0-9_]*)\}`)
+
+// WithPrefixVars sets the values of variables in a prefix template, e.g.
+// {"env": "production"} for the prefix "{env}.{service}". Values from repeated
+// options are merged, later values winning.
+func WithPrefixVars(vars map[string]string) Option {
+	return func(mb *SquareMetrics) {
+		mb.prefixVars = mergeMaps(mb.prefixVars, vars)
+	}
+}
+
+// ExpandPrefix resolves the {name} placeholders of a prefix template such as
+// "{env}.{service}.{region}". Each variable takes its value from vars, or else
+// from the environment variable of the same name in upper case (e.g. $REGION
+// for {region}). It is an error for a variable to be missing or empty, so the
+// naming convention can't be broken silently.
+//
+// NewMetrics expands its prefix this way, with the variables of
+// WithPrefixVars and {hostname} for the hostname sent with metrics. If that
+// fails, it logs the error and uses the template as it is, rather than take
+// the service down over its metrics. Call ExpandPrefix first to handle the
+// error instead.
+func ExpandPrefix(template string, vars map[string]string) (string, error) {
+	var missing []string
+	expanded := prefixVariable.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := vars[name]
+		if !ok {
+			value = os.Getenv(strings.ToUpper(name))
+		}
+		if value == "" {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("metrics prefix %q: no value for %s", template, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// expandPrefix expands the prefix templates passed to NewMetrics and
+// WithRegistry.
+func (mb *SquareMetrics) expandPrefix() {
+	vars := mergeMaps(map[string]string{"hostname": mb.hostname}, mb.prefixVars)
+	expand := func(template string) string {
+		if !strings.Contains(template, "{") {
+			return template
+		}
+		prefix, err := ExpandPrefix(template, vars)
+		if err != nil {
+			mb.logger.Printf("%s, using it as it is", err)
+			return template
+		}
+		return prefix
+	}
+
+	mb.prefix = expand(mb.prefix)
+	for _, source := range mb.sources {
+		source.prefix = expand(source.prefix)
+		source.key = source.prefix + sourceSeparator
+	}
+}
@@ -0,0 +1,85 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// healthProbe pauses publishing while the bridge is down. After a failed
+// publish the bridge is marked unhealthy, and until a probe request (HEAD) to
+// the probe URL succeeds again only probes are sent instead of full payloads.
+type healthProbe struct {
+	path      string
+	unhealthy atomic.Bool
+}
+
+// probeURL resolves the probe path against the bridge URL. An empty path
+// probes the bridge URL itself.
+func probeURL(bridge, path string) string {
+	if base, err := url.Parse(bridge); err == nil && path != "" {
+		if ref, err := url.Parse(path); err == nil {
+			return base.ResolveReference(ref).String()
+		}
+	}
+	return bridge
+}
+
+// bridgeReady reports whether the bridge at target is believed to be able to
+// take a publish, probing it first if it was unhealthy.
+func (mb *SquareMetrics) bridgeReady(ctx context.Context, target string) bool {
+	probe := mb.probe
+	if probe == nil || !probe.unhealthy.Load() {
+		return true
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", probeURL(target, probe.path), nil)
+	if err != nil {
+		return false
+	}
+	if err := mb.token.authorize(req); err != nil {
+		return false
+	}
+	resp, err := mb.client.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		return false
+	}
+
+	probe.unhealthy.Store(false)
+	mb.logger.Printf("metrics bridge is healthy again, resuming publishing")
+	return true
+}
+
+// observePublish marks the bridge at target unhealthy if a publish failed
+// because of a transport error (no response) or a server error.
+func (mb *SquareMetrics) observePublish(resp *http.Response, target string) {
+	probe := mb.probe
+	if probe == nil {
+		return
+	}
+	if resp == nil || resp.StatusCode >= 500 {
+		if !probe.unhealthy.Swap(true) {
+			mb.logger.Printf("metrics bridge is unhealthy, pausing publishing until %s responds", probeURL(target, probe.path))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Queue instruments a work queue. Producers call Enqueue when they add an item
+// and consumers call Dequeue, passing the time returned by Enqueue, when they
+// take it off again. The queue maintains the following metrics, all under the
+// name given to InstrumentQueue:
+//
+//	<name>.depth     gauge, items currently queued
+//	<name>.enqueued  counter, items added
+//	<name>.dequeued  counter, items removed
+//	<name>.wait      timer, time spent in the queue
+type Queue struct {
+	depth    metrics.Gauge
+	enqueued metrics.Counter
+	dequeued metrics.Counter
+	wait     metrics.Timer
+}
+
+// InstrumentQueue registers the metrics for a work queue called name. The
+// depth gauge is also refreshed every collection interval from the depth
+// callback, if one is given (for example, func() int64 { return int64(len(ch)) }
+// for a buffered channel), which keeps it accurate even when items are added or
+// removed without going through Enqueue/Dequeue.
+func (mb *SquareMetrics) InstrumentQueue(name string, depth func() int64) *Queue {
+	queue := &Queue{
+		depth:    metrics.GetOrRegisterGauge(name+".depth", mb.Registry),
+		enqueued: metrics.GetOrRegisterCounter(name+".enqueued", mb.Registry),
+		dequeued: metrics.GetOrRegisterCounter(name+".dequeued", mb.Registry),
+		wait:     metrics.GetOrRegisterTimer(name+".wait", mb.Registry),
+	}
+	if depth != nil {
+		mb.AddGauge(name+".depth", depth)
+	}
+	return queue
+}
+
+// Enqueue records that an item was added to the queue, and returns the time
+// to pass to Dequeue once the item is taken off.
+func (q *Queue) Enqueue() time.Time {
+	q.enqueued.Inc(1)
+	q.depth.Update(q.enqueued.Count() - q.dequeued.Count())
+	return time.Now()
+}
+
+// Dequeue records that an item added at enqueued was taken off the queue.
+func (q *Queue) Dequeue(enqueued time.Time) {
+	q.dequeued.Inc(1)
+	q.depth.Update(q.enqueued.Count() - q.dequeued.Count())
+	q.wait.UpdateSince(enqueued)
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// sourceSeparator separates the prefix of an additional registry from a metric
+// name in the names used internally for its metrics, keeping them apart from
+// those of other registries.
+const sourceSeparator = "\x00"
+
+// registrySource is an additional registry published along with the main one.
+type registrySource struct {
+	registry metrics.Registry
+	prefix   string
+	key      string            // prefix + sourceSeparator
+	tags     map[string]string // the registry's own tags
+	merged   map[string]string // the common tags with the registry's own ones
+	names    sync.Map          // registry name -> internal name
+}
+
+// WithRegistry also publishes the metrics of registry, in the same batches as
+// those of the main registry, with prefix instead of the prefix passed to
+// NewMetrics and with tags added to (and overriding) the common ones. It is
+// meant for processes that embed several components, each instrumented with
+// its own registry. Each registry must have a distinct prefix, which may be a
+// template as for NewMetrics.
+//
+// Filters, slow lanes, TTLs and other options apply to the metrics of all
+// registries alike, with patterns matched against the names within each
+// registry; rewrite rules see full names, including the registry's prefix.
+func WithRegistry(registry metrics.Registry, prefix string, tags map[string]string) Option {
+	return func(mb *SquareMetrics) {
+		mb.sources = append(mb.sources, &registrySource{
+			registry: registry,
+			prefix:   prefix,
+			key:      prefix + sourceSeparator,
+			tags:     mergeMaps(tags),
+		})
+		mb.updateTags()
+	}
+}
+
+// internalName returns the name under which a metric of the source is known
+// internally.
+func (s *registrySource) internalName(name string) string {
+	if cached, ok := s.names.Load(name); ok {
+		return cached.(string)
+	}
+	internal := s.key + name
+	s.names.Store(name, internal)
+	return internal
+}
+
+// splitName splits an internal name into the prefix of the registry the metric
+// belongs to (empty for the main registry) and the metric's name within it.
+func splitName(name string) (prefix, registryName string, ok bool) {
+	return strings.Cut(name, sourceSeparator)
+}
+
+// unqualified returns the name of a metric within its registry.
+func unqualified(name string) string {
+	if _, registryName, ok := splitName(name); ok {
+		return registryName
+	}
+	return name
+}
+
+// source returns the additional registry with the given prefix.
+func (mb *SquareMetrics) source(prefix string) *registrySource {
+	for _, source := range mb.sources {
+		if source.prefix == prefix {
+			return source
+		}
+	}
+	return nil
+}
+
+// eachMetric calls fn with the internal name of every metric of every
+// registry, custom metrics included, and the name within its registry.
+func (mb *SquareMetrics) eachMetric(fn func(name, registryName string, metric interface{})) {
+	mb.Registry.Each(func(name string, metric interface{}) {
+		fn(name, name, metric)
+	})
+	mb.custom.each(func(name string, metric customMetric) {
+		fn(name, name, metric)
+	})
+	for _, source := range mb.sources {
+		source.registry.Each(func(name string, metric interface{}) {
+			fn(source.internalName(name), name, metric)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// Rejection is a metric that the bridge rejected from a batch it otherwise
+// accepted, such as one with an invalid name or a timestamp too old. Bridges
+// list them in 207 Multi-Status responses with a JSON body of the form
+// {"rejected": [{"metric": "<name>", "reason": "<reason>"}]}, where the name is
+// the published one. Rejected metrics are logged, and with WithSelfMetrics
+// counted in sqmetrics.publish.rejected.
+type Rejection struct {
+	Metric string `json:"metric"`
+	Reason string `json:"reason"`
+}
+
+// WithRejectionLimit stops publishing metrics once the bridge has rejected
+// them limit times (see Rejection), so that persistent offenders don't keep
+// wasting space in batches. Dropped metrics are also left out of Snapshot and
+// SerializeMetrics. They are published again after a restart, after a Reload
+// to another bridge URL, or once unregistered and registered again. A limit
+// that isn't positive is logged and ignored.
+func WithRejectionLimit(limit int) Option {
+	return func(mb *SquareMetrics) {
+		if limit <= 0 {
+			mb.logger.Printf("invalid metrics rejection limit %d, not dropping rejected metrics", limit)
+			return
+		}
+		mb.rejections = &rejections{limit: limit, counts: map[string]int{}, dropped: map[string]bool{}}
+	}
+}
+
+// rejections counts the rejections of each metric, by published name.
+type rejections struct {
+	limit int
+
+	mutex   sync.RWMutex
+	counts  map[string]int
+	dropped map[string]bool
+}
+
+// drops reports whether the metric published as name was rejected too many
+// times to be published anymore.
+func (r *rejections) drops(name string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.dropped[name]
+}
+
+// record counts a rejection, and reports whether the metric is now dropped.
+func (r *rejections) record(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.dropped[name] {
+		return false
+	}
+	r.counts[name]++
+	if r.counts[name] < r.limit {
+		return false
+	}
+	delete(r.counts, name)
+	r.dropped[name] = true
+	return true
+}
+
+// forget drops the counts of the metric published as name, and of the metrics
+// flattened from it.
+func (r *rejections) forget(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key := range r.counts {
+		if key == name || strings.HasPrefix(key, name+".") {
+			delete(r.counts, key)
+		}
+	}
+	for key := range r.dropped {
+		if key == name || strings.HasPrefix(key, name+".") {
+			delete(r.dropped, key)
+		}
+	}
+}
+
+// reset drops all counts, for a new bridge that may accept the metrics.
+func (r *rejections) reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts = map[string]int{}
+	r.dropped = map[string]bool{}
+}
+
+// recordRejections logs and counts the metrics rejected from a batch.
+func (mb *SquareMetrics) recordRejections(rejected []Rejection) {
+	mb.logger.Printf("metrics bridge rejected %d metrics, including %s: %s", len(rejected), rejected[0].Metric, rejected[0].Reason)
+	if mb.stats != nil {
+		mb.stats.rejected.Inc(int64(len(rejected)))
+	}
+	for _, rejection := range rejected {
+		if mb.rejections != nil && mb.rejections.record(rejection.Metric) {
+			mb.logger.Printf("metrics bridge rejected %s %d times, no longer publishing it", rejection.Metric, mb.rejections.limit)
+		}
+	}
+}
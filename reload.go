@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Settings are the publisher settings that can be changed at runtime with
+// Reload, without restarting the process or losing registry state.
+type Settings struct {
+	// URL is the bridge to post to. If it is empty, nothing is posted unless a
+	// dry run writer or sink is configured.
+	URL string
+	// Interval is the collection and publishing interval.
+	Interval time.Duration
+	// Include and Exclude replace the patterns given to WithInclude and
+	// WithExclude.
+	Include []string
+	Exclude []string
+	// Tags replace the tags given to WithTags. Tags derived from the
+	// environment, e.g. by WithKubernetesTags, are kept.
+	Tags map[string]string
+}
+
+// Settings returns the current reloadable settings.
+func (mb *SquareMetrics) Settings() Settings {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+	return Settings{
+		URL:      mb.url,
+		Interval: mb.interval,
+		Include:  append([]string(nil), mb.filter.include...),
+		Exclude:  append([]string(nil), mb.filter.exclude...),
+		Tags:     mergeMaps(mb.userTags),
+	}
+}
+
+// Reload replaces the reloadable settings. The registry, and state derived
+// from it such as dedupe history, TTLs and series caps, is kept. Reload waits
+// for the metrics of a publish in progress to be collected, but not for them
+// to be delivered: batches being posted still go to the previous bridge URL.
+// If the interval changed, collection and publishing are rescheduled from now.
+func (mb *SquareMetrics) Reload(settings Settings) error {
+	if settings.Interval <= 0 {
+		return fmt.Errorf("invalid metrics interval %s", settings.Interval)
+	}
+	if settings.URL != "" {
+		if _, err := url.Parse(settings.URL); err != nil {
+			return fmt.Errorf("invalid metrics bridge URL: %s", err)
+		}
+	}
+
+	mb.settings.Lock()
+	rescheduled := settings.Interval != mb.interval
+	if mb.probe != nil && settings.URL != mb.url {
+		mb.probe.unhealthy.Store(false)
+	}
+	if mb.handshake != nil && settings.URL != mb.url {
+		mb.handshake.reset(settings.URL)
+	}
+	if mb.rejections != nil && settings.URL != mb.url {
+		mb.rejections.reset()
+	}
+	mb.url = settings.URL
+	mb.interval = settings.Interval
+	mb.filter = nameFilter{
+		include: append([]string(nil), settings.Include...),
+		exclude: append([]string(nil), settings.Exclude...),
+	}
+	mb.userTags = mergeMaps(settings.Tags)
+	mb.updateTags()
+	mb.settings.Unlock()
+
+	if rescheduled {
+		notify(mb.reschedule)
+		notify(mb.recollect)
+	}
+	return nil
+}
+
+// ReloadOnSignal calls load and reloads the settings it returns whenever the
+// process receives one of the given signals (SIGHUP if none are given). If
+// load or Reload fails the error is logged and passed to the error handler,
+// and the current settings are kept. It stops when Close is called.
+func (mb *SquareMetrics) ReloadOnSignal(load func() (Settings, error), signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+
+	go func() {
+		defer signal.Stop(received)
+		for {
+			select {
+			case <-mb.done:
+				return
+			case <-received:
+			}
+
+			settings, err := load()
+			if err == nil {
+				err = mb.Reload(settings)
+			}
+			if err != nil {
+				mb.logger.Printf("error reloading metrics settings: %s", err)
+				mb.reportError(err)
+				continue
+			}
+			mb.logger.Printf("reloaded metrics settings")
+		}
+	}()
+}
+
+// currentInterval returns the interval, which may be changed by Reload
+func (mb *SquareMetrics) currentInterval() time.Duration {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+	return mb.interval
+}
+
+// currentURL returns the bridge URL, which may be changed by Reload
+func (mb *SquareMetrics) currentURL() string {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+	return mb.url
+}
+
+// notify wakes up a loop waiting on c, unless it already has a wakeup pending
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// resetResult is the response of ResetHandler.
+type resetResult struct {
+	Reset   []string `json:"reset"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// ResetHandler returns an http.Handler that resets counters and clears
+// histograms, e.g. after a test run or an incident. It takes POST requests
+// with one or more name query parameters, each an exact registry name or a
+// prefix ending in "*", and responds with the names of the metrics that were
+// reset as JSON. Timers can't be reset through the go-metrics API and gauges
+// reflect current state, so matching timers and gauges are left alone and
+// reported as skipped. The cached summaries, names and start times of reset
+// metrics are forgotten as well. Every reset is logged along with the client's
+// address.
+//
+// As resetting metrics destroys data, the handler refuses all requests unless
+// an authorizer is configured with WithAuthorizer.
+func (mb *SquareMetrics) ResetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mb.authorize == nil {
+			http.Error(w, "resetting metrics requires an authorizer to be configured", http.StatusForbidden)
+			return
+		}
+		if !mb.authorized(w, r) {
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		patterns := r.URL.Query()["name"]
+		if len(patterns) == 0 {
+			http.Error(w, "no metrics to reset given, pass them as name parameters", http.StatusBadRequest)
+			return
+		}
+
+		result := resetResult{Reset: []string{}}
+		mb.eachMetric(func(name, registryName string, metric interface{}) {
+			if !matchesAny(registryName, patterns) {
+				return
+			}
+			published, ok := mb.publishedName(name)
+			if !ok {
+				published = registryName
+			}
+			switch metric := metric.(type) {
+			case metrics.Counter:
+				metric.Clear()
+			case metrics.Histogram:
+				metric.Clear()
+			default:
+				result.Skipped = append(result.Skipped, published)
+				return
+			}
+			// the metric stays registered, but what was cached about its
+			// previous values no longer holds
+			mb.summaries.forget(name)
+			mb.names.forget(name)
+			if mb.starts != nil {
+				mb.starts.forget(name)
+			}
+			result.Reset = append(result.Reset, published)
+			mb.logger.Printf("metric %s reset by request from %s", published, r.RemoteAddr)
+		})
+		sort.Strings(result.Reset)
+		sort.Strings(result.Skipped)
+
+		preventCaching(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
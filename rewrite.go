@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RewriteRule rewrites or drops serialized metrics whose full name (including
+// the prefix) matches a regular expression. Rules are applied in order, each to
+// the output of the previous one, and a dropped metric is not considered by
+// later rules.
+type RewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	drop        bool
+}
+
+// DropRule drops metrics whose name matches expr. It panics if expr is not a
+// valid regular expression.
+func DropRule(expr string) RewriteRule {
+	return RewriteRule{pattern: regexp.MustCompile(expr), drop: true}
+}
+
+// RenameRule replaces the parts of metric names matching expr with
+// replacement, which may refer to submatches as in regexp.ReplaceAllString
+// (e.g. RenameRule(`\.latency\.(.*)$`, ".duration.$1")). It panics if expr is
+// not a valid regular expression.
+func RenameRule(expr, replacement string) RewriteRule {
+	return RewriteRule{pattern: regexp.MustCompile(expr), replacement: replacement}
+}
+
+// ReprefixRule replaces the leading oldPrefix of metric names with newPrefix.
+func ReprefixRule(oldPrefix, newPrefix string) RewriteRule {
+	return RewriteRule{
+		pattern:     regexp.MustCompile("^" + regexp.QuoteMeta(oldPrefix)),
+		replacement: strings.ReplaceAll(newPrefix, "$", "$$"),
+	}
+}
+
+// rewrite applies the rules to name, returning the new name and false if the
+// metric was dropped.
+func rewrite(rules []RewriteRule, name string) (string, bool) {
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(name) {
+			continue
+		}
+		if rule.drop {
+			return "", false
+		}
+		name = rule.pattern.ReplaceAllString(name, rule.replacement)
+	}
+	return name, true
+}
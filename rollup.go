@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// rollupSuffixes are appended to the names of rolled up gauges for each of the
+// values aggregated over the interval, in the order serialized.
+var rollupSuffixes = []string{"min", "max", "avg"}
+
+// WithGaugeRollup samples gauges matching one of the given patterns (all
+// gauges if none are given) every period in between publishes, and publishes
+// the minimum, maximum and average of the samples since the previous publish
+// along with each gauge's current value, as <name>.min, <name>.max and
+// <name>.avg. It is meant for long publish intervals, where the instantaneous
+// value alone misses spikes. Patterns are as for WithInclude. Gauges updated
+// by AddGauge callbacks only change once per interval, so rolling them up is
+// pointless. If a publish fails, its samples are aggregated into the next one.
+// A period that isn't positive is ignored, with a warning.
+func WithGaugeRollup(period time.Duration, patterns ...string) Option {
+	return func(mb *SquareMetrics) {
+		if period <= 0 {
+			mb.logger.Printf("invalid gauge rollup period %s, not rolling up gauges", period)
+			return
+		}
+		mb.rollup = &rollup{
+			period:   period,
+			patterns: patterns,
+			windows:  map[string]rollupWindow{},
+		}
+	}
+}
+
+// rollup aggregates the samples of gauges since they were last published.
+type rollup struct {
+	period   time.Duration
+	patterns []string
+
+	mutex   sync.Mutex
+	windows map[string]rollupWindow
+}
+
+type rollupWindow struct {
+	min, max, sum float64
+	count         int64
+}
+
+func (w rollupWindow) add(value float64) rollupWindow {
+	if w.count == 0 || value < w.min {
+		w.min = value
+	}
+	if w.count == 0 || value > w.max {
+		w.max = value
+	}
+	w.sum += value
+	w.count++
+	return w
+}
+
+// merge combines the samples of two windows.
+func (w rollupWindow) merge(other rollupWindow) rollupWindow {
+	if other.count == 0 {
+		return w
+	}
+	if w.count == 0 {
+		return other
+	}
+	if other.min < w.min {
+		w.min = other.min
+	}
+	if other.max > w.max {
+		w.max = other.max
+	}
+	w.sum += other.sum
+	w.count += other.count
+	return w
+}
+
+func (r *rollup) applies(name string) bool {
+	return len(r.patterns) == 0 || matchesAny(unqualified(name), r.patterns)
+}
+
+// sampleRollups samples the rolled up gauges every period until Close.
+func (mb *SquareMetrics) sampleRollups() {
+	ticker := mb.clock.NewTicker(mb.rollup.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mb.done:
+			return
+		case <-ticker.C():
+		}
+
+		mb.eachMetric(func(name, registryName string, metric interface{}) {
+			if !mb.rollup.applies(name) {
+				return
+			}
+			switch metric := metric.(type) {
+			case metrics.Gauge:
+				mb.rollup.sample(name, float64(metric.Value()))
+			case metrics.GaugeFloat64:
+				mb.rollup.sample(name, metric.Value())
+			}
+		})
+	}
+}
+
+func (r *rollup) sample(name string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.windows[name] = r.windows[name].add(value)
+}
+
+// appendRollup appends the aggregates of the gauge called name, whose current
+// value is value, if it is rolled up. The current value counts as a sample,
+// without being recorded.
+func (mb *SquareMetrics) appendRollup(nvs []tuple, name string, kind MetricType, value float64) []tuple {
+	if !mb.rollup.applies(name) {
+		return nvs
+	}
+	mb.rollup.mutex.Lock()
+	window := mb.rollup.windows[name].add(value)
+	mb.rollup.mutex.Unlock()
+
+	names := mb.names.rollup(name)
+	var min, max interface{} = window.min, window.max
+	if kind == GaugeType {
+		min, max = int64(window.min), int64(window.max)
+	}
+	return append(nvs,
+		tuple{names[0], min, kind},
+		tuple{names[1], max, kind},
+		tuple{names[2], window.sum / float64(window.count), kind},
+	)
+}
+
+// reset starts new windows for the gauges of entries, once they are
+// collected for a publish, and returns the previous ones for restore.
+func (r *rollup) reset(entries []registryEntry) map[string]rollupWindow {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	taken := map[string]rollupWindow{}
+	for _, entry := range entries {
+		if window, ok := r.windows[entry.name]; ok {
+			taken[entry.name] = window
+			delete(r.windows, entry.name)
+		}
+	}
+	return taken
+}
+
+// restore puts back the windows taken by reset when the publish failed, so
+// that their samples are aggregated into the next one.
+func (r *rollup) restore(taken map[string]rollupWindow) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, window := range taken {
+		r.windows[name] = window.merge(r.windows[name])
+	}
+}
+
+// forget drops the samples of a gauge that was unregistered.
+func (r *rollup) forget(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.windows, name)
+}
@@ -0,0 +1,53 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"math/rand"
+	"time"
+)
+
+// nextPublish returns when the publish following the one due at prev is due,
+// and how many publishes were skipped in between. Publishes are scheduled
+// relative to when the previous one was due rather than when it finished, so
+// that time spent publishing doesn't make the schedule drift. Only one publish
+// is ever in flight: slots that were missed entirely because a publish overran
+// are skipped, and their data is coalesced into the next publish.
+func (mb *SquareMetrics) nextPublish(prev time.Time) (time.Time, int) {
+	now := mb.clock.Now()
+	interval := mb.currentInterval()
+	if mb.aligned {
+		next := now.Truncate(interval).Add(interval)
+		return next, int(next.Sub(prev)/interval) - 1
+	}
+
+	next := prev.Add(interval)
+	if behind := now.Sub(next); behind >= 0 {
+		skipped := behind/interval + 1
+		return next.Add(skipped * interval), int(skipped)
+	}
+	return next, 0
+}
+
+// untilJittered returns how long to wait for a publish due at due, with jitter
+// applied. Jitter only moves individual publishes; it doesn't accumulate.
+func (mb *SquareMetrics) untilJittered(due time.Time) time.Duration {
+	if mb.jitter > 0 && !mb.aligned {
+		due = due.Add(time.Duration((rand.Float64()*2 - 1) * mb.jitter * float64(mb.currentInterval())))
+	}
+	return due.Sub(mb.clock.Now())
+}
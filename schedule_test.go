@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"io"
+	"log"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frozenClock is a Clock that is always at the same time.
+type frozenClock struct {
+	realClock
+	now time.Time
+}
+
+func (c frozenClock) Now() time.Time {
+	return c.now
+}
+
+func newScheduled(now time.Time, interval time.Duration, options ...Option) *SquareMetrics {
+	mb := &SquareMetrics{
+		interval: interval,
+		settings: &sync.RWMutex{},
+		clock:    frozenClock{now: now},
+		logger:   log.New(io.Discard, "", 0),
+	}
+	for _, option := range options {
+		option(mb)
+	}
+	return mb
+}
+
+func TestWithJitterBoundsTheFraction(t *testing.T) {
+	for _, test := range []struct {
+		fraction, want float64
+	}{
+		{0, 0},
+		{0.1, 0.1},
+		{0.25, 0.25},
+		{0.5, maxJitter},
+		{3, maxJitter},
+		{-0.1, 0},
+		{math.NaN(), 0},
+		{math.Inf(1), maxJitter},
+	} {
+		mb := newScheduled(time.Unix(0, 0), time.Minute, WithJitter(test.fraction))
+		if mb.jitter != test.want {
+			t.Errorf("WithJitter(%g): jitter is %g, want %g", test.fraction, mb.jitter, test.want)
+		}
+	}
+}
+
+func TestJitteredPublishesStayHalfAnIntervalApart(t *testing.T) {
+	now := time.Unix(1000, 0)
+	interval := time.Minute
+	mb := newScheduled(now, interval, WithJitter(1))
+	for i := 0; i < 1000; i++ {
+		// the earliest and latest a publish and the one after it can be
+		first := mb.untilJittered(now.Add(interval))
+		second := mb.untilJittered(now.Add(2 * interval))
+		if gap := second - first; gap < interval/2 {
+			t.Fatalf("publishes jittered to %s apart, want at least %s", gap, interval/2)
+		}
+		if first < interval*3/4 || first > interval*5/4 {
+			t.Fatalf("publish due in %s jittered to %s", interval, first)
+		}
+	}
+}
+
+func TestNextPublishSkipsMissedSlots(t *testing.T) {
+	start := time.Unix(6000, 0)
+	interval := 10 * time.Second
+	for _, test := range []struct {
+		name    string
+		now     time.Duration // since start
+		aligned bool
+		next    time.Duration // since start
+		skipped int
+	}{
+		{"on time", 3 * time.Second, false, 10 * time.Second, 0},
+		{"overran one slot", 12 * time.Second, false, 20 * time.Second, 1},
+		{"overran three slots", 35 * time.Second, false, 40 * time.Second, 3},
+		{"aligned", 3 * time.Second, true, 10 * time.Second, 0},
+		{"aligned and late", 27 * time.Second, true, 30 * time.Second, 2},
+	} {
+		mb := newScheduled(start.Add(test.now), interval)
+		mb.aligned = test.aligned
+		next, skipped := mb.nextPublish(start)
+		if got := next.Sub(start); got != test.next || skipped != test.skipped {
+			t.Errorf("%s: next publish in %s skipping %d, want %s skipping %d", test.name, got, skipped, test.next, test.skipped)
+		}
+	}
+}
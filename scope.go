@@ -0,0 +1,127 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// Scope registers metrics in the main registry under a common name prefix,
+// and optionally with common tags, so that libraries can take a scope rather
+// than hardcoding full metric names:
+//
+//	db := metrics.Scope("db")
+//	db.Timer("query").Time(run) // registered as db.query
+type Scope struct {
+	mb       *SquareMetrics
+	registry *TaggedRegistry
+	prefix   string
+	tags     Tags
+}
+
+// Scope returns a scope whose metrics are named name.<metric>.
+func (mb *SquareMetrics) Scope(name string) *Scope {
+	return &Scope{
+		mb:       mb,
+		registry: NewTaggedRegistry(mb.Registry),
+		prefix:   name + ".",
+	}
+}
+
+// Scope returns a nested scope whose metrics are named <scope>.name.<metric>,
+// with the tags of this scope.
+func (s *Scope) Scope(name string) *Scope {
+	scope := *s
+	scope.prefix += name + "."
+	return &scope
+}
+
+// Tagged returns a scope with the same names as this one, whose metrics also
+// have the given tags, added to (and overriding) those of this scope.
+func (s *Scope) Tagged(tags Tags) *Scope {
+	scope := *s
+	scope.tags = mergeMaps(s.tags, tags)
+	return &scope
+}
+
+// Name returns the registry name of the scope's metric called name, with the
+// scope's tags encoded by TaggedName.
+func (s *Scope) Name(name string) string {
+	return TaggedName(s.prefix+name, s.tags)
+}
+
+// Counter returns the scope's counter called name, registering it if needed.
+func (s *Scope) Counter(name string) metrics.Counter {
+	return s.registry.Counter(s.prefix+name, s.tags)
+}
+
+// Gauge returns the scope's gauge called name, registering it if needed.
+func (s *Scope) Gauge(name string) metrics.Gauge {
+	return s.registry.Gauge(s.prefix+name, s.tags)
+}
+
+// GaugeFloat64 returns the scope's float gauge called name, registering it if
+// needed.
+func (s *Scope) GaugeFloat64(name string) metrics.GaugeFloat64 {
+	return s.registry.GaugeFloat64(s.prefix+name, s.tags)
+}
+
+// Meter returns the scope's meter called name, registering it if needed.
+func (s *Scope) Meter(name string) metrics.Meter {
+	return s.registry.Meter(s.prefix+name, s.tags)
+}
+
+// Histogram returns the scope's histogram called name, registering it if
+// needed, as for TaggedRegistry.Histogram.
+func (s *Scope) Histogram(name string) metrics.Histogram {
+	return s.registry.Histogram(s.prefix+name, s.tags)
+}
+
+// Timer returns the scope's timer called name, registering it if needed.
+func (s *Scope) Timer(name string) metrics.Timer {
+	return s.registry.Timer(s.prefix+name, s.tags)
+}
+
+// AddGauge installs a callback for the scope's gauge called name, as for
+// SquareMetrics.AddGauge.
+func (s *Scope) AddGauge(name string, callback func() int64) {
+	s.mb.AddGauge(s.Name(name), callback)
+}
+
+// TopK returns the scope's TopK called name, registering it if needed, as for
+// SquareMetrics.TopK.
+func (s *Scope) TopK(name string, k int) *TopK {
+	return s.mb.TopK(s.Name(name), k)
+}
+
+// Distinct returns the scope's Distinct called name, registering it if needed,
+// as for SquareMetrics.Distinct.
+func (s *Scope) Distinct(name string, config DistinctConfig) *Distinct {
+	return s.mb.Distinct(s.Name(name), config)
+}
+
+// State returns the scope's State called name, registering it if needed, as
+// for SquareMetrics.State.
+func (s *Scope) State(name string, style StateStyle, states ...string) *State {
+	return s.mb.State(s.Name(name), style, states...)
+}
+
+// Info returns the scope's Info called name, registering it if needed, as for
+// SquareMetrics.Info.
+func (s *Scope) Info(name string, attributes map[string]string) *Info {
+	return s.mb.Info(s.Name(name), attributes)
+}
@@ -0,0 +1,166 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// publishStats are the metrics sqmetrics records about its own publishes.
+type publishStats struct {
+	success      metrics.Counter
+	failure      metrics.Counter
+	latency      metrics.Timer
+	payloadBytes metrics.Gauge
+	skippedTicks metrics.Counter
+	rejected     metrics.Counter
+
+	// batch accounting, so that data loss is quantifiable
+	droppedBatches metrics.Counter
+	queuedBatches  metrics.Gauge
+	spoolBytes     metrics.Gauge
+
+	// the bridge's certificate expiry, registered on the first HTTPS publish
+	registry    metrics.Registry
+	certMutex   sync.Mutex
+	certExpiry  metrics.GaugeFloat64
+	certChecked time.Time
+
+	// the offset of the local clock from the bridge's, registered on the
+	// first response with a Date header
+	skewOnce sync.Once
+	skew     metrics.GaugeFloat64
+}
+
+func newPublishStats(registry metrics.Registry) *publishStats {
+	return &publishStats{
+		success:      metrics.GetOrRegisterCounter(selfPrefix+"publish.success", registry),
+		failure:      metrics.GetOrRegisterCounter(selfPrefix+"publish.failure", registry),
+		latency:      metrics.GetOrRegisterTimer(selfPrefix+"publish.latency", registry),
+		payloadBytes: metrics.GetOrRegisterGauge(selfPrefix+"publish.payload-bytes", registry),
+		skippedTicks: metrics.GetOrRegisterCounter(selfPrefix+"publish.skipped", registry),
+		rejected:     metrics.GetOrRegisterCounter(selfPrefix+"publish.rejected", registry),
+
+		droppedBatches: metrics.GetOrRegisterCounter(selfPrefix+"batches.dropped", registry),
+		queuedBatches:  metrics.GetOrRegisterGauge(selfPrefix+"batches.queued", registry),
+		spoolBytes:     metrics.GetOrRegisterGauge(selfPrefix+"spool.bytes", registry),
+
+		registry: registry,
+	}
+}
+
+// clockSkew records how far the local clock is ahead of the bridge's, in
+// seconds, from the Date header of resp, the response to a request sent at
+// start and answered at end. Dates only have a resolution of a second, so the
+// bridge's time is estimated as half a second past the date, at the midpoint
+// of the request.
+func (s *publishStats) clockSkew(resp *http.Response, start, end time.Time) {
+	if s == nil || resp == nil {
+		return
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	s.skewOnce.Do(func() {
+		s.skew = metrics.GetOrRegisterGaugeFloat64(selfPrefix+"clock-skew", s.registry)
+	})
+	midpoint := start.Add(end.Sub(start) / 2)
+	s.skew.Update(midpoint.Sub(date.Add(time.Second / 2)).Seconds())
+}
+
+// certCheckInterval is how often the expiry of the bridge's certificate is
+// checked.
+const certCheckInterval = 24 * time.Hour
+
+// certificate records the days until the certificate chain the bridge
+// presented in resp expires, at most once every certCheckInterval.
+func (s *publishStats) certificate(resp *http.Response, now time.Time) {
+	if s == nil || resp == nil || resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return
+	}
+	s.certMutex.Lock()
+	defer s.certMutex.Unlock()
+	if !s.certChecked.IsZero() && now.Sub(s.certChecked) < certCheckInterval {
+		return
+	}
+	s.certChecked = now
+
+	// the chain expires with the first of its certificates to expire
+	expiry := resp.TLS.PeerCertificates[0].NotAfter
+	for _, cert := range resp.TLS.PeerCertificates[1:] {
+		if cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	if s.certExpiry == nil {
+		s.certExpiry = metrics.GetOrRegisterGaugeFloat64(selfPrefix+"tls.cert-expiry-days", s.registry)
+	}
+	s.certExpiry.Update(expiry.Sub(now).Hours() / 24)
+}
+
+// record accounts for a publish of size bytes that took latency and failed
+// with err, if not nil. It does nothing if self metrics are disabled.
+func (s *publishStats) record(size int, latency time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.failure.Inc(1)
+	} else {
+		s.success.Inc(1)
+	}
+	s.latency.Update(latency)
+	s.payloadBytes.Update(int64(size))
+}
+
+// skipped accounts for scheduled publishes that were skipped because the
+// previous publish overran them.
+func (s *publishStats) skipped(publishes int) {
+	if s == nil {
+		return
+	}
+	s.skippedTicks.Inc(int64(publishes))
+}
+
+// dropped accounts for a batch that was given up on without being delivered.
+func (s *publishStats) dropped() {
+	if s == nil {
+		return
+	}
+	s.droppedBatches.Inc(1)
+}
+
+// queued records the number of batches waiting to be delivered.
+func (s *publishStats) queued(batches int) {
+	if s == nil {
+		return
+	}
+	s.queuedBatches.Update(int64(batches))
+}
+
+// spooled records the number of bytes of batches held in the spool.
+func (s *publishStats) spooled(bytes int64) {
+	if s == nil {
+		return
+	}
+	s.spoolBytes.Update(bytes)
+}
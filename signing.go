@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// SignatureHeader is the request header carrying the signature of the body of
+// a batch, when signing is enabled with WithSigningKey or WithSigningKeyFile,
+// as returned by Signature.
+const SignatureHeader = "X-Sqmetrics-Signature"
+
+// signer signs request bodies with an HMAC key.
+type signer struct {
+	key  []byte
+	file *tokenFile
+}
+
+// WithSigningKey signs the body of every batch posted to the bridge with
+// HMAC-SHA256 and key, sending the signature in SignatureHeader, so that the
+// bridge can verify the integrity and origin of batches without mutual TLS.
+func WithSigningKey(key []byte) Option {
+	return func(mb *SquareMetrics) {
+		mb.signer = &signer{key: key}
+	}
+}
+
+// WithSigningKeyFile is like WithSigningKey, with the key read from the file
+// at path, which is re-read when it changes as for WithTokenFile.
+// Surrounding whitespace is not part of the key.
+func WithSigningKeyFile(path string) Option {
+	return func(mb *SquareMetrics) {
+		mb.signer = &signer{file: &tokenFile{path: path}}
+	}
+}
+
+// Signature returns the signature of body with key, as sent in
+// SignatureHeader: "sha256=" followed by the hex-encoded HMAC-SHA256.
+func Signature(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign adds the signature of body to req.
+func (s *signer) sign(req *http.Request, body []byte) error {
+	if s == nil {
+		return nil
+	}
+	key := s.key
+	if s.file != nil {
+		s.file.mutex.Lock()
+		s.file.refresh(false)
+		key = []byte(s.file.token)
+		s.file.mutex.Unlock()
+		if len(key) == 0 {
+			return fmt.Errorf("no metrics signing key in %s", s.file.path)
+		}
+	}
+	req.Header.Set(SignatureHeader, Signature(key, body))
+	return nil
+}
@@ -0,0 +1,59 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"context"
+)
+
+// Sink receives published batches instead of the bridge, for delivering
+// metrics elsewhere or capturing them in tests. The batch is only valid for
+// the duration of the call; sinks that hold on to points must copy them.
+type Sink interface {
+	Send(ctx context.Context, batch []MetricPoint) error
+}
+
+// WithSink publishes to sink instead of posting to the bridge. Publishing
+// happens even if no bridge URL is configured.
+func WithSink(sink Sink) Option {
+	return func(mb *SquareMetrics) {
+		mb.sink = sink
+	}
+}
+
+// hasDestination reports whether there is anywhere to publish metrics to,
+// given the bridge URL.
+func (mb *SquareMetrics) hasDestination(url string) bool {
+	return url != "" || mb.dryRun != nil || mb.sink != nil
+}
+
+func (mb *SquareMetrics) sendToSink(ctx context.Context, points []MetricPoint) error {
+	start := mb.clock.Now()
+	err := mb.sink.Send(ctx, points)
+	end := mb.clock.Now()
+	event := PublishEvent{
+		BatchSize: len(points),
+		Duration:  end.Sub(start),
+		Err:       err,
+	}
+	if err != nil {
+		mb.stats.dropped()
+	}
+	mb.status.record(event, end)
+	mb.firePublishHooks(event)
+	return err
+}
@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+// MetricType is the kind of registry metric a MetricPoint was taken from.
+type MetricType string
+
+// Metric types. Histograms and timers are flattened into several points (count,
+// min, max, mean and percentiles) that all carry the type of the metric they
+// came from.
+const (
+	CounterType      MetricType = "counter"
+	GaugeType        MetricType = "gauge"
+	GaugeFloat64Type MetricType = "gauge-float64"
+	HistogramType    MetricType = "histogram"
+	TimerType        MetricType = "timer"
+	TopKType         MetricType = "top-k"
+	DistinctType     MetricType = "distinct"
+	StateType        MetricType = "state"
+	InfoType         MetricType = "info"
+)
+
+// MetricPoint is a single serialized metric value, as it is sent to the
+// bridge. Its JSON encoding is the bridge's wire format.
+type MetricPoint struct {
+	// Timestamp is the time of the snapshot, in seconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+	// StartTimestamp is, for counters when WithStartTimes is used, the time
+	// the counter started counting from, in seconds since the epoch.
+	StartTimestamp int64 `json:"start_timestamp,omitempty"`
+	// Name is the full metric name, including prefix and any rewrites.
+	Name string `json:"metric"`
+	// Value is an int64 or a float64, depending on the metric.
+	Value    interface{}       `json:"value"`
+	Hostname string            `json:"hostname"`
+	Type     MetricType        `json:"-"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// Sketch is, for Distincts configured to serialize it, their encoded
+	// sketch, for EstimateSketches.
+	Sketch string `json:"sketch,omitempty"`
+}
+
+// Snapshot returns the current value of every metric in the registry as typed
+// points. It is the counterpart of SerializeMetrics for programmatic
+// consumers, and applies the same filters and rewrite rules.
+func (mb *SquareMetrics) Snapshot() []MetricPoint {
+	return mb.snapshot(nil)
+}
+
+// snapshot is Snapshot, restricted to the registry names for which include
+// returns true if it is not nil.
+func (mb *SquareMetrics) snapshot(include func(name string) bool) []MetricPoint {
+	mb.settings.RLock()
+	defer mb.settings.RUnlock()
+	return mb.points(nil, mb.collectTuples(include, nil), false)
+}
@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/square/go-sq-metrics/internal/spool"
+)
+
+// WithSpool spools batches that could not be delivered to the bridge, after
+// any retries, to files in dir instead of dropping them, keeping at most max
+// of them (the oldest are dropped beyond that). Spooled batches are delivered
+// oldest first after the next successful publish, as they were serialized:
+// their points keep their original timestamps, rather than being stamped
+// with the time they are finally delivered at. They are sent with
+// ReplayHeader, and the batch id and sequence number they were first posted
+// with so that the bridge can tell them apart from new ones. With
+// WithSelfMetrics, the total size of the spool is recorded in
+// sqmetrics.spool.bytes.
+func WithSpool(dir string, max int) Option {
+	return func(mb *SquareMetrics) {
+		mb.spool = &spool.Spool{Dir: dir, Max: max}
+	}
+}
+
+// WithEncryptedSpool is like WithSpool, with spooled batches encrypted at rest
+// with AES-GCM, since they can reveal internal hostnames and topology. The key
+// is read from keyFile, hex encoded, the first time it is needed; it must be
+// 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+func WithEncryptedSpool(dir string, max int, keyFile string) Option {
+	return func(mb *SquareMetrics) {
+		mb.spool = &spool.Spool{Dir: dir, Max: max, KeyFile: keyFile}
+	}
+}
+
+// spoolBatch spools a batch that could not be delivered, and reports whether
+// it was.
+func (mb *SquareMetrics) spoolBatch(body *pooledBody) bool {
+	dropped, err := mb.spool.Store(spool.Batch{ID: body.id, Sequence: body.sequence, Body: body.buf.Bytes()})
+	for range dropped {
+		mb.stats.dropped()
+	}
+	if len(dropped) > 0 {
+		mb.logger.Printf("metrics spool full, dropped %d batches", len(dropped))
+	}
+	mb.recordSpool()
+	if err != nil {
+		mb.logger.Printf("error spooling metrics: %s", err)
+		mb.reportError(fmt.Errorf("error spooling metrics: %w", err))
+		return false
+	}
+	return true
+}
+
+// drainSpool delivers the spooled batches, oldest first, until one fails.
+// Batches the bridge rejects with an error that retrying won't fix, e.g. a
+// client error after a schema or credential change, are dropped instead of
+// blocking those behind them, and so are batches that can't be read back.
+func (mb *SquareMetrics) drainSpool(ctx context.Context, target string) {
+	dropped, unreadable, err := mb.spool.Drain(func(batch spool.Batch) error {
+		buf := getBuffer()
+		buf.Write(batch.Body)
+		body := &pooledBody{buf: buf, id: batch.ID, sequence: batch.Sequence, replay: true}
+		defer body.release()
+		status, err := mb.send(ctx, target, body)
+		if err != nil && !retryable(status, err) {
+			return fmt.Errorf("%w: %w", spool.ErrRejected, err)
+		}
+		return err
+	})
+	for range dropped {
+		mb.stats.dropped()
+	}
+	if len(dropped) > 0 {
+		mb.logger.Printf("metrics bridge rejected %d spooled batches, dropped them", len(dropped))
+	}
+	for _, file := range unreadable {
+		mb.stats.dropped()
+		mb.logger.Printf("unreadable spooled metrics batch, set aside as %s", file)
+	}
+	mb.recordSpool()
+	if err != nil {
+		mb.logger.Printf("error delivering spooled metrics: %s", err)
+		mb.reportError(fmt.Errorf("error delivering spooled metrics: %w", err))
+	}
+}
+
+func (mb *SquareMetrics) recordSpool() {
+	if mb.stats == nil {
+		return
+	}
+	if size, err := mb.spool.Bytes(); err == nil {
+		mb.stats.spooled(size)
+	}
+}
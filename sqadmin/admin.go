@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqadmin bundles the handlers of sqmetrics and the runtime profiles
+// into a single admin mux. Unlike net/http/pprof, importing it registers
+// nothing on http.DefaultServeMux.
+package sqadmin
+
+import (
+	"net/http"
+	"strings"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// healthIntervals is the number of publish intervals without a successful
+// publish after which the health endpoint reports the publisher unhealthy.
+const healthIntervals = 3
+
+// Handler returns an http.Handler serving, under prefix (e.g. "/_admin/"):
+//
+//	metrics          the current metrics (SquareMetrics.ServeHTTP)
+//	metrics/stream   StreamHandler
+//	metrics/diff     DiffHandler
+//	metrics/history  HistoryHandler
+//	health           HealthHandler, unhealthy after 3 intervals without a publish
+//	status           DebugHandler
+//	pprof/           the runtime profiles, in the format of net/http/pprof
+//
+// Everything but the health endpoint is protected by the authorizer configured
+// with sqmetrics.WithAuthorizer, if any; without one, the mux should not be
+// reachable from outside.
+func Handler(mb *sqmetrics.SquareMetrics, prefix string) http.Handler {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	if prefix == "//" {
+		prefix = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"metrics", mb)
+	mux.Handle(prefix+"metrics/stream", mb.StreamHandler())
+	mux.Handle(prefix+"metrics/diff", mb.DiffHandler())
+	mux.Handle(prefix+"metrics/history", mb.HistoryHandler())
+	mux.Handle(prefix+"health", mb.HealthHandler(healthIntervals))
+	mux.Handle(prefix+"status", mb.DebugHandler())
+
+	profiles := prefix + "pprof/"
+	mux.Handle(profiles, mb.Protect(index(profiles)))
+	mux.Handle(profiles+"cmdline", mb.Protect(http.HandlerFunc(cmdline)))
+	mux.Handle(profiles+"profile", mb.Protect(http.HandlerFunc(cpuProfile)))
+	mux.Handle(profiles+"symbol", mb.Protect(http.HandlerFunc(symbol)))
+	mux.Handle(profiles+"trace", mb.Protect(http.HandlerFunc(executionTrace)))
+	return mux
+}
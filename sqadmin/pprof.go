@@ -0,0 +1,165 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqadmin
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The profile handlers are built on runtime/pprof rather than net/http/pprof,
+// whose import registers them on http.DefaultServeMux, unprotected, for every
+// service importing this package.
+
+// index serves the index page of the profiles at path, and the named profiles
+// below it.
+func index(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := strings.TrimPrefix(r.URL.Path, path); name != "" {
+			serveProfile(w, r, name)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintln(w, "<html><head><title>profiles</title></head><body><ul>")
+		for _, profile := range pprof.Profiles() {
+			name := html.EscapeString(profile.Name())
+			fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", name, name, profile.Count())
+		}
+		fmt.Fprintln(w, "<li><a href=\"cmdline\">cmdline</a></li>")
+		fmt.Fprintln(w, "<li><a href=\"profile\">profile</a> (CPU, ?seconds=30)</li>")
+		fmt.Fprintln(w, "<li><a href=\"trace\">trace</a> (?seconds=1)</li>")
+		fmt.Fprintln(w, "</ul></body></html>")
+	})
+}
+
+// serveProfile writes the named runtime profile, in the text format if the
+// debug parameter is positive. With gc=1, heap profiles are taken after a
+// garbage collection.
+func serveProfile(w http.ResponseWriter, r *http.Request, name string) {
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		http.Error(w, "unknown profile "+name, http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if name == "heap" && r.FormValue("gc") == "1" {
+		runtime.GC()
+	}
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	profile.WriteTo(w, debug)
+}
+
+// cmdline serves the command line of the process, its arguments separated by
+// NUL bytes.
+func cmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
+
+// cpuProfile serves a CPU profile of the number of seconds in the seconds
+// parameter, 30 by default.
+func cpuProfile(w http.ResponseWriter, r *http.Request) {
+	duration := seconds(r, 30*time.Second)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		serverError(w, "could not enable CPU profiling", err)
+		return
+	}
+	sleep(r, duration)
+	pprof.StopCPUProfile()
+}
+
+// executionTrace serves an execution trace of the number of seconds in the
+// seconds parameter, 1 by default.
+func executionTrace(w http.ResponseWriter, r *http.Request) {
+	duration := seconds(r, time.Second)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		serverError(w, "could not enable tracing", err)
+		return
+	}
+	sleep(r, duration)
+	trace.Stop()
+}
+
+// symbol looks up the function names of the program counters posted as a
+// "+"-separated list of hexadecimal addresses, for the pprof tool. A GET
+// reports that symbols are available.
+func symbol(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "num_symbols: 1")
+	if r.Method == http.MethodPost {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		addresses := strings.FieldsFunc(string(body), func(c rune) bool {
+			return c == '+' || unicode.IsSpace(c)
+		})
+		for _, address := range addresses {
+			pc, err := strconv.ParseUint(address, 0, 64)
+			if err != nil {
+				continue
+			}
+			if fn := runtime.FuncForPC(uintptr(pc)); fn != nil {
+				fmt.Fprintf(&out, "%#x %s\n", pc, fn.Name())
+			}
+		}
+	}
+	w.Write(out.Bytes())
+}
+
+// seconds parses the seconds parameter of r, or returns fallback.
+func seconds(r *http.Request, fallback time.Duration) time.Duration {
+	if s, err := strconv.ParseFloat(r.FormValue("seconds"), 64); err == nil && s > 0 {
+		return time.Duration(s * float64(time.Second))
+	}
+	return fallback
+}
+
+// sleep waits for duration, or until the client goes away.
+func sleep(r *http.Request, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// serverError reports a profiling error that occurred before anything was
+// written.
+func serverError(w http.ResponseWriter, message string, err error) {
+	w.Header().Del("Content-Disposition")
+	http.Error(w, fmt.Sprintf("%s: %s", message, err), http.StatusInternalServerError)
+}
@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqbridge
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyKeys remembers the idempotency keys of recently received batches.
+type idempotencyKeys struct {
+	mutex    sync.Mutex
+	received map[string]time.Time
+	order    []receivedKey // oldest first
+}
+
+type receivedKey struct {
+	key      string
+	received time.Time
+}
+
+// seen reports whether key was received within window of now, forgetting the
+// keys received before that.
+func (k *idempotencyKeys) seen(key string, now time.Time, window time.Duration) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for len(k.order) > 0 && now.Sub(k.order[0].received) > window {
+		oldest := k.order[0]
+		if k.received[oldest.key].Equal(oldest.received) {
+			delete(k.received, oldest.key)
+		}
+		k.order = k.order[1:]
+	}
+	_, ok := k.received[key]
+	return ok
+}
+
+// remember records that the batch with the given key was received.
+func (k *idempotencyKeys) remember(key string, now time.Time) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.received == nil {
+		k.received = map[string]time.Time{}
+	}
+	k.received[key] = now
+	k.order = append(k.order, receivedKey{key, now})
+}
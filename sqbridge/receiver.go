@@ -0,0 +1,341 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqbridge implements the receiving side of the sqmetrics bridge
+// protocol: an HTTP handler that validates and decodes posted batches and
+// hands them to a callback. It is meant for building collectors and for
+// end-to-end tests against the exact wire format.
+//
+//	http.Handle("/metrics", sqbridge.NewHandler(func(ctx context.Context, batch []sqmetrics.MetricPoint) error {
+//		return store.Write(ctx, batch)
+//	}))
+package sqbridge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// DefaultMaxBodyBytes is the largest request body accepted by default.
+const DefaultMaxBodyBytes = 16 << 20
+
+// maxReportedErrors is the number of invalid points described in an error.
+const maxReportedErrors = 10
+
+// Handler is an http.Handler that receives batches posted by sqmetrics.
+type Handler struct {
+	// Receive is called with each valid batch. If it returns an error, the
+	// request fails with that error's status if it is an *Error, and 500
+	// Internal Server Error otherwise, so that the publisher retries. If it
+	// returns nil, the batch is acknowledged to publishers that asked for it
+	// (see sqmetrics.WithAcks), so it must only do so once the batch is
+	// safely stored.
+	Receive func(ctx context.Context, batch []sqmetrics.MetricPoint) error
+	// MaxBodyBytes limits the size of request bodies, after decompression;
+	// DefaultMaxBodyBytes if zero.
+	MaxBodyBytes int64
+	// Authorize, if set, decides which requests are allowed, as for
+	// sqmetrics.WithAuthorizer.
+	Authorize sqmetrics.Authorizer
+	// Dedupe, if positive, is how long the idempotency keys of received
+	// batches (see sqmetrics.IdempotencyKeyHeader, or the batch id for
+	// publishers that don't send one) are remembered. A batch whose key was
+	// received within that time is a retry of one already received, and is
+	// acknowledged without calling Receive again. Batches retried while the
+	// first attempt is still being received are not detected.
+	Dedupe time.Duration
+	// SigningKey, if set, is the key batches must be signed with (see
+	// sqmetrics.WithSigningKey). Unsigned batches and those with an invalid
+	// signature are rejected with 401 Unauthorized.
+	SigningKey []byte
+
+	keys idempotencyKeys
+}
+
+// NewHandler returns a Handler that passes batches to receive.
+func NewHandler(receive func(ctx context.Context, batch []sqmetrics.MetricPoint) error) *Handler {
+	return &Handler{Receive: receive}
+}
+
+// ProtocolVersion is the version of the bridge protocol implemented by Handler.
+const ProtocolVersion = 1
+
+// VersionHandler returns an http.Handler answering the feature negotiation of
+// sqmetrics.WithNegotiation with the payload features Handler supports.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":  ProtocolVersion,
+			"features": []string{sqmetrics.FeatureTags, sqmetrics.FeatureGzip, sqmetrics.FeatureStartTimestamps},
+		})
+	})
+}
+
+type replayKey struct{}
+
+// Replayed reports whether the batch passed to Receive with ctx was replayed
+// from a spool after an outage (see sqmetrics.ReplayHeader), and so holds past
+// values rather than current ones.
+func Replayed(ctx context.Context) bool {
+	replayed, _ := ctx.Value(replayKey{}).(bool)
+	return replayed
+}
+
+// Error is an error with the HTTP status to respond with.
+type Error struct {
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned by Receive when it stored a batch except for some
+// of its metrics. The batch is acknowledged, and the rejected metrics are
+// listed in a 207 Multi-Status response.
+type PartialError struct {
+	Rejected []sqmetrics.Rejection
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d metrics rejected", len(e.Rejected))
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Authorize != nil && !h.Authorize(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	batch, err := h.decodeRequest(w, r)
+	key := r.Header.Get(sqmetrics.IdempotencyKeyHeader)
+	if key == "" {
+		key = r.Header.Get(sqmetrics.BatchIDHeader)
+	}
+	if h.Dedupe <= 0 {
+		key = ""
+	}
+	if err == nil && key != "" && h.keys.seen(key, time.Now(), h.Dedupe) {
+		acknowledge(w, r, nil)
+		return
+	}
+	if err == nil {
+		ctx := r.Context()
+		if r.Header.Get(sqmetrics.ReplayHeader) == "true" {
+			ctx = context.WithValue(ctx, replayKey{}, true)
+		}
+		err = h.Receive(ctx, batch)
+	}
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		var httpErr *Error
+		if !errors.As(err, &httpErr) {
+			httpErr = &Error{http.StatusInternalServerError, err}
+		}
+		http.Error(w, httpErr.Error(), httpErr.Status)
+		return
+	}
+	if key != "" {
+		h.keys.remember(key, time.Now())
+	}
+	var rejected []sqmetrics.Rejection
+	if partial != nil {
+		rejected = partial.Rejected
+	}
+	acknowledge(w, r, rejected)
+}
+
+// acknowledge responds to a batch that was received, with an acknowledgement
+// if the publisher asked for one (see sqmetrics.AckHeader), and a 207
+// Multi-Status listing the rejected metrics if there are any.
+func acknowledge(w http.ResponseWriter, r *http.Request, rejected []sqmetrics.Rejection) {
+	ack := r.Header.Get(sqmetrics.AckHeader) != ""
+	if !ack && len(rejected) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body := map[string]interface{}{}
+	if ack {
+		body["ack"] = r.Header.Get(sqmetrics.BatchIDHeader)
+	}
+	status := http.StatusOK
+	if len(rejected) > 0 {
+		body["rejected"] = rejected
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// decodeRequest checks the request and decodes its batch.
+func (h *Handler) decodeRequest(w http.ResponseWriter, r *http.Request) ([]sqmetrics.MetricPoint, error) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return nil, &Error{http.StatusMethodNotAllowed, errors.New("method not allowed")}
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			return nil, &Error{http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", contentType)}
+		}
+	}
+
+	limit := h.MaxBodyBytes
+	if limit == 0 {
+		limit = DefaultMaxBodyBytes
+	}
+	var body io.Reader = r.Body
+	if h.SigningKey != nil {
+		raw, err := h.verify(w, r, limit)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(raw)
+	}
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, &Error{http.StatusBadRequest, fmt.Errorf("invalid gzip body: %s", err)}
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return nil, &Error{http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))}
+	}
+	body = http.MaxBytesReader(w, io.NopCloser(body), limit)
+
+	batch, err := Decode(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &Error{http.StatusRequestEntityTooLarge, err}
+		}
+		return nil, &Error{http.StatusBadRequest, err}
+	}
+	return batch, nil
+}
+
+// verify reads the body of the request and checks its signature.
+func (h *Handler) verify(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &Error{http.StatusRequestEntityTooLarge, err}
+		}
+		return nil, &Error{http.StatusBadRequest, err}
+	}
+	signature := r.Header.Get(sqmetrics.SignatureHeader)
+	if signature == "" {
+		return nil, &Error{http.StatusUnauthorized, errors.New("unsigned batch")}
+	}
+	if !hmac.Equal([]byte(signature), []byte(sqmetrics.Signature(h.SigningKey, raw))) {
+		return nil, &Error{http.StatusUnauthorized, errors.New("invalid batch signature")}
+	}
+	return raw, nil
+}
+
+// wirePoint is a point as encoded on the wire, with its value kept as a
+// number literal so integers aren't turned into floats.
+type wirePoint struct {
+	Timestamp      *int64            `json:"timestamp"`
+	StartTimestamp int64             `json:"start_timestamp"`
+	Name           string            `json:"metric"`
+	Value          json.Number       `json:"value"`
+	Hostname       string            `json:"hostname"`
+	Tags           map[string]string `json:"tags"`
+	Sketch         string            `json:"sketch"`
+}
+
+// Decode reads a batch in the wire format, a JSON array of points, and
+// validates it. Integer values are decoded as int64s and others as float64s;
+// the Type of the points is not part of the wire format and is left empty.
+// Unknown fields are ignored, so newer publishers remain compatible.
+func Decode(r io.Reader) ([]sqmetrics.MetricPoint, error) {
+	var wire []wirePoint
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&wire); err != nil {
+		return nil, fmt.Errorf("invalid batch: %w", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid batch: unexpected data after the array")
+	}
+
+	batch := make([]sqmetrics.MetricPoint, len(wire))
+	var errs []error
+	for i, point := range wire {
+		var err error
+		batch[i], err = point.decode()
+		if err != nil {
+			if len(errs) < maxReportedErrors {
+				errs = append(errs, fmt.Errorf("point %d: %s", i, err))
+			} else if len(errs) == maxReportedErrors {
+				errs = append(errs, errors.New("more invalid points omitted"))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid batch: %w", errors.Join(errs...))
+	}
+	return batch, nil
+}
+
+func (p wirePoint) decode() (sqmetrics.MetricPoint, error) {
+	point := sqmetrics.MetricPoint{StartTimestamp: p.StartTimestamp, Name: p.Name, Hostname: p.Hostname, Tags: p.Tags, Sketch: p.Sketch}
+	switch {
+	case p.Name == "":
+		return point, errors.New("missing metric name")
+	case p.Timestamp == nil:
+		return point, fmt.Errorf("%s: missing timestamp", p.Name)
+	case *p.Timestamp <= 0:
+		return point, fmt.Errorf("%s: invalid timestamp %d", p.Name, *p.Timestamp)
+	case p.Hostname == "":
+		return point, fmt.Errorf("%s: missing hostname", p.Name)
+	case p.Value == "":
+		return point, fmt.Errorf("%s: missing value", p.Name)
+	case p.StartTimestamp < 0:
+		return point, fmt.Errorf("%s: invalid start timestamp %d", p.Name, p.StartTimestamp)
+	}
+	point.Timestamp = *p.Timestamp
+
+	if value, err := p.Value.Int64(); err == nil {
+		point.Value = value
+	} else if value, err := p.Value.Float64(); err == nil {
+		point.Value = value
+	} else {
+		return point, fmt.Errorf("%s: invalid value %s", p.Name, p.Value)
+	}
+	return point, nil
+}
@@ -0,0 +1,59 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqbridge_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqbridge"
+)
+
+func TestHandlerDedupesRetries(t *testing.T) {
+	for _, header := range []string{sqmetrics.IdempotencyKeyHeader, sqmetrics.BatchIDHeader} {
+		t.Run(header, func(t *testing.T) {
+			received := 0
+			handler := sqbridge.NewHandler(func(ctx context.Context, batch []sqmetrics.MetricPoint) error {
+				received++
+				return nil
+			})
+			handler.Dedupe = time.Minute
+
+			post := func(key string) int {
+				req := httptest.NewRequest("POST", "/", strings.NewReader(`[{"timestamp":1,"metric":"app.requests","value":1,"hostname":"h"}]`))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set(header, key)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w.Code
+			}
+			for i, key := range []string{"a", "a", "b"} {
+				if code := post(key); code != http.StatusOK {
+					t.Fatalf("post %d: status %d", i, code)
+				}
+			}
+			if received != 2 {
+				t.Errorf("received %d batches, want 2", received)
+			}
+		})
+	}
+}
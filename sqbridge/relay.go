@@ -0,0 +1,314 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/fetch"
+)
+
+// RelayConfig configures a Relay.
+type RelayConfig struct {
+	// URL is the upstream bridge endpoint that combined batches are posted to.
+	URL string
+	// Client posts to the upstream bridge; http.DefaultClient if nil.
+	Client *http.Client
+	// Interval is how often the combined batch is forwarded; a minute if not
+	// positive.
+	Interval time.Duration
+	// Sum lists the metrics whose values are summed across publishers, as
+	// exact names or prefixes ending in "*". These are usually counters. All
+	// other metrics take the most recent value received from any publisher.
+	Sum []string
+	// Expiry is how long the values of a publisher are kept after its last
+	// batch; three intervals if zero.
+	Expiry time.Duration
+	// Source identifies the publisher of a request. The default uses the
+	// sqmetrics.InstanceHeader sent by sqmetrics, and the remote host for
+	// other publishers.
+	Source func(r *http.Request) string
+	// Authorize, if set, decides which publishers are allowed to post.
+	Authorize sqmetrics.Authorizer
+	// Logger reports errors forwarding to the bridge; log.Default() if nil.
+	Logger *log.Logger
+	// Clock is the source of time for forwarding and expiry;
+	// sqmetrics.SystemClock() if nil.
+	Clock sqmetrics.Clock
+}
+
+// defaultRelayInterval is the forwarding interval when none is configured.
+const defaultRelayInterval = time.Minute
+
+// Relay accepts batches from several local publishers, merges them, and
+// forwards the combined batch upstream on a schedule. It is meant for hosts
+// running many small processes, which then post to the relay rather than to
+// the bridge.
+//
+// The relay keeps the latest values of each publisher, so a combined batch
+// reflects every publisher heard from within the expiry. As sqmetrics
+// publishes cumulative counts, summed metrics drop when a publisher expires.
+//
+// Batches are acknowledged (see sqmetrics.WithAcks) as soon as the relay has
+// merged them in memory, not once they are forwarded: what was received since
+// the last forward is lost if the relay dies or the bridge rejects it. As
+// publishers post cumulative counts and current values, the next forward
+// usually makes up for it, except for the gauge values in between.
+type Relay struct {
+	config  RelayConfig
+	handler *Handler
+
+	mutex   sync.Mutex
+	sources map[string]*relaySource
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type relaySource struct {
+	points map[string]sqmetrics.MetricPoint // by series, see seriesKey
+	seen   time.Time
+}
+
+// seriesKey identifies the series of a point: its name and tags, as a
+// TaggedRegistry name. Points of the same name with different tags, such as
+// histogram buckets, are separate series.
+func seriesKey(point sqmetrics.MetricPoint) string {
+	return sqmetrics.TaggedName(point.Name, point.Tags)
+}
+
+type sourceKey struct{}
+
+// NewRelay starts a relay, which forwards every interval until closed. Serve
+// it where the publishers post to.
+func NewRelay(config RelayConfig) *Relay {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultRelayInterval
+	}
+	if config.Expiry == 0 {
+		config.Expiry = 3 * config.Interval
+	}
+	if config.Source == nil {
+		config.Source = defaultSource
+	}
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = sqmetrics.SystemClock()
+	}
+
+	relay := &Relay{
+		config:  config,
+		sources: map[string]*relaySource{},
+		done:    make(chan struct{}),
+	}
+	relay.handler = &Handler{Receive: relay.receive, Authorize: config.Authorize}
+	go relay.forwardMetrics()
+	return relay
+}
+
+func defaultSource(r *http.Request) string {
+	if instance := r.Header.Get(sqmetrics.InstanceHeader); instance != "" {
+		return instance
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Close stops forwarding. It does not forward what was received since the
+// last forward; call Flush first for that.
+func (r *Relay) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := context.WithValue(req.Context(), sourceKey{}, r.config.Source(req))
+	r.handler.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// receive replaces the values of the batch's publisher, unless they are older
+// than those already received, as are those of batches replayed from a spool.
+func (r *Relay) receive(ctx context.Context, batch []sqmetrics.MetricPoint) error {
+	name, _ := ctx.Value(sourceKey{}).(string)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	source, ok := r.sources[name]
+	if !ok {
+		source = &relaySource{points: map[string]sqmetrics.MetricPoint{}}
+		r.sources[name] = source
+	}
+	for _, point := range batch {
+		key := seriesKey(point)
+		// replayed batches must not override newer values
+		if previous, ok := source.points[key]; ok && previous.Timestamp > point.Timestamp {
+			continue
+		}
+		source.points[key] = point
+	}
+	source.seen = r.config.Clock.Now()
+	return nil
+}
+
+// Combined returns the merged batch that the next forward would post, sorted
+// by name and tags. The points of different publishers are merged if they
+// have the same name and tags. Publishers not heard from within the expiry are
+// forgotten.
+func (r *Relay) Combined() []sqmetrics.MetricPoint {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// merge in a stable order, so that ties resolve the same every time
+	now := r.config.Clock.Now()
+	names := make([]string, 0, len(r.sources))
+	for name, source := range r.sources {
+		if now.Sub(source.seen) > r.config.Expiry {
+			delete(r.sources, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combined := map[string]sqmetrics.MetricPoint{}
+	for _, name := range names {
+		for key, point := range r.sources[name].points {
+			merged, ok := combined[key]
+			if !ok {
+				combined[key] = point
+				continue
+			}
+			combined[key] = r.merge(merged, point)
+		}
+	}
+
+	keys := make([]string, 0, len(combined))
+	for key := range combined {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := combined[keys[i]], combined[keys[j]]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return keys[i] < keys[j]
+	})
+	points := make([]sqmetrics.MetricPoint, 0, len(keys))
+	for _, key := range keys {
+		points = append(points, combined[key])
+	}
+	return points
+}
+
+// merge combines the points of two publishers for the same series.
+func (r *Relay) merge(a, b sqmetrics.MetricPoint) sqmetrics.MetricPoint {
+	if b.Timestamp > a.Timestamp {
+		a, b = b, a
+	}
+	merged := a
+	if len(r.config.Sum) > 0 && fetch.Match(a.Name, r.config.Sum) {
+		merged.Value = sum(a.Value, b.Value)
+		// the sum restarts whenever any of its terms does
+		if b.StartTimestamp > merged.StartTimestamp {
+			merged.StartTimestamp = b.StartTimestamp
+		}
+	}
+	return merged
+}
+
+// sum adds two point values, keeping integers as integers.
+func sum(a, b interface{}) interface{} {
+	x, xInt := a.(int64)
+	y, yInt := b.(int64)
+	if xInt && yInt {
+		return x + y
+	}
+	return toFloat(a) + toFloat(b)
+}
+
+func toFloat(value interface{}) float64 {
+	switch value := value.(type) {
+	case int64:
+		return float64(value)
+	case float64:
+		return value
+	}
+	return 0
+}
+
+func (r *Relay) forwardMetrics() {
+	ticker := r.config.Clock.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			ctx, cancel := context.WithTimeout(context.Background(), r.config.Interval)
+			if err := r.Flush(ctx); err != nil {
+				r.config.Logger.Printf("error forwarding metrics: %s", err)
+			}
+			cancel()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Flush forwards the combined batch right away. Nothing is posted if no
+// publisher was heard from within the expiry.
+func (r *Relay) Flush(ctx context.Context) error {
+	points := r.Combined()
+	if len(points) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("metrics bridge responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqbridge_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqbridge"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestRelayKeepsTaggedSeriesApart(t *testing.T) {
+	bridge := sqmetricstest.NewBridge()
+	defer bridge.Close()
+	relay := sqbridge.NewRelay(sqbridge.RelayConfig{
+		URL:    bridge.URL,
+		Client: bridge.Client(),
+		Sum:    []string{"app.requests"},
+		Logger: log.New(io.Discard, "", 0),
+	})
+	defer relay.Close()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	publish := func(host string, get, post int64) {
+		registry := sqmetrics.NewTaggedRegistry(metrics.NewRegistry())
+		registry.Counter("requests", sqmetrics.Tags{"method": "GET"}).Inc(get)
+		registry.Counter("requests", sqmetrics.Tags{"method": "POST"}).Inc(post)
+		mb := sqmetrics.NewMetrics(server.URL, "app", server.Client(), time.Hour, registry,
+			log.New(io.Discard, "", 0), sqmetrics.WithCollectors(0), sqmetrics.WithTags(map[string]string{"host": host}))
+		defer mb.Close()
+		if err := mb.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two publishers on host a, whose requests are summed, and one on b
+	publish("a", 1, 2)
+	publish("a", 3, 4)
+	publish("b", 10, 20)
+
+	combined := relay.Combined()
+	want := []struct {
+		host, method string
+		value        int64
+	}{
+		{"a", "GET", 4},
+		{"a", "POST", 6},
+		{"b", "GET", 10},
+		{"b", "POST", 20},
+	}
+	if len(combined) != len(want) {
+		t.Fatalf("got %d points, want %d: %v", len(combined), len(want), combined)
+	}
+	for i, w := range want {
+		point := combined[i]
+		if point.Name != "app.requests" || point.Tags["host"] != w.host || point.Tags["method"] != w.method {
+			t.Errorf("point %d is %s %v, want app.requests with host %s and method %s", i, point.Name, point.Tags, w.host, w.method)
+		}
+		if toInt(point.Value) != w.value {
+			t.Errorf("point %d (%v) is %v, want %d", i, point.Tags, point.Value, w.value)
+		}
+	}
+
+	if err := relay.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if points := bridge.Points(); len(points) != len(want) {
+		t.Errorf("bridge received %d points, want %d", len(points), len(want))
+	}
+}
+
+func toInt(value interface{}) int64 {
+	switch value := value.(type) {
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	}
+	return -1
+}
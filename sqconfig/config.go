@@ -0,0 +1,473 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqconfig loads sqmetrics publisher settings from YAML or JSON files,
+// so that metrics configuration can be managed alongside other deployment
+// config rather than in code.
+//
+// A config file looks like:
+//
+//	url: https://bridge.example.com/metrics
+//	prefix: myservice
+//	interval: 30s
+//	jitter: 0.1
+//	exclude: ["runtime.mem.lookups", "debug.*"]
+//	tags:
+//	  env: production
+//
+// and is used with:
+//
+//	config, err := sqconfig.Load("/etc/myservice/metrics.yaml")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	metrics, err := config.NewMetrics(client, registry, logger)
+package sqconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/internal/tagmap"
+	"gopkg.in/yaml.v3"
+)
+
+// Sinks that may be selected in a config.
+const (
+	// SinkBridge posts metrics to the bridge at URL. It is the default.
+	SinkBridge = "bridge"
+	// SinkDryRun writes payloads to DryRunPath, or standard error if it is
+	// empty, instead of posting them.
+	SinkDryRun = "dry-run"
+	// SinkNone does not publish; metrics are still collected and served.
+	SinkNone = "none"
+)
+
+// collectors are the names of the system metrics groups in configs.
+var collectors = map[string]sqmetrics.Collector{
+	"memstats":   sqmetrics.CollectMemStats,
+	"gc":         sqmetrics.CollectGC,
+	"goroutines": sqmetrics.CollectGoroutines,
+}
+
+// hostnameFormats are the names of the hostname formats in configs.
+var hostnameFormats = map[string]sqmetrics.HostnameFormat{
+	"":      sqmetrics.HostnameAsIs,
+	"as-is": sqmetrics.HostnameAsIs,
+	"short": sqmetrics.HostnameShort,
+	"fqdn":  sqmetrics.HostnameFQDN,
+}
+
+// timerUnits are the names of the units timers can be serialized in.
+var timerUnits = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "1m30s".
+type Duration time.Duration
+
+// UnmarshalText parses a duration in the time.ParseDuration format.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalText formats the duration in the time.Duration.String format.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Config holds publisher settings. The zero value of each field is the
+// sqmetrics default.
+type Config struct {
+	// URL is the metrics bridge endpoint, required for the bridge sink.
+	URL string `json:"url" yaml:"url"`
+	// Prefix is prepended to every metric name. It may be a template such as
+	// "{env}.{service}", see sqmetrics.ExpandPrefix.
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// PrefixVars are the values of the variables of a prefix template.
+	PrefixVars map[string]string `json:"prefix_vars" yaml:"prefix_vars"`
+	// Interval is the publishing interval; it is required.
+	Interval Duration `json:"interval" yaml:"interval"`
+	// Jitter randomizes the schedule by up to ±Jitter of the interval, at
+	// most 0.25.
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+	// Aligned aligns publishes to wall-clock multiples of the interval.
+	Aligned bool `json:"aligned" yaml:"aligned"`
+	// Include and Exclude are name patterns, as for sqmetrics.WithInclude.
+	Include []string `json:"include" yaml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude"`
+	// Tags are attached to every published metric.
+	Tags map[string]string `json:"tags" yaml:"tags"`
+	// Sink selects where metrics are published: "bridge", "dry-run" or
+	// "none".
+	Sink string `json:"sink" yaml:"sink"`
+	// DryRunPath is the file the dry-run sink appends payloads to.
+	DryRunPath string `json:"dry_run_path" yaml:"dry_run_path"`
+	// MaxSeries caps the number of distinct metric names published.
+	MaxSeries int `json:"max_series" yaml:"max_series"`
+	// BatchSize splits publishes into batches of at most this many points.
+	BatchSize int `json:"batch_size" yaml:"batch_size"`
+	// Retries and RetryBackoff configure retrying failed batches.
+	Retries      int      `json:"retries" yaml:"retries"`
+	RetryBackoff Duration `json:"retry_backoff" yaml:"retry_backoff"`
+	// TokenFile is a file holding a bearer token for the bridge, re-read when
+	// it changes. If APIKeyHeader is set, the contents are sent in that
+	// header instead, as is.
+	TokenFile    string `json:"token_file" yaml:"token_file"`
+	APIKeyHeader string `json:"api_key_header" yaml:"api_key_header"`
+	// SpoolDir, if set, is a directory batches that could not be delivered
+	// are spooled to, at most SpoolMax of them (1000 if zero). They are
+	// encrypted with the hex encoded AES key in SpoolKeyFile, if set.
+	SpoolDir     string `json:"spool_dir" yaml:"spool_dir"`
+	SpoolMax     int    `json:"spool_max" yaml:"spool_max"`
+	SpoolKeyFile string `json:"spool_key_file" yaml:"spool_key_file"`
+	// Acks only counts batches as delivered once the bridge acknowledges
+	// them, for at-least-once delivery along with SpoolDir.
+	Acks bool `json:"acks" yaml:"acks"`
+	// SigningKeyFile is a file holding a key to sign batches with, re-read
+	// when it changes.
+	SigningKeyFile string `json:"signing_key_file" yaml:"signing_key_file"`
+	// HealthProbe, if set, is the path on the bridge (resolved against URL)
+	// to probe while the bridge is unhealthy.
+	HealthProbe string `json:"health_probe" yaml:"health_probe"`
+	// Negotiation, if set, is the path on the bridge (resolved against URL)
+	// to negotiate payload features with.
+	Negotiation string `json:"negotiation" yaml:"negotiation"`
+	// SelfMetrics publishes metrics about publishing itself.
+	SelfMetrics bool `json:"self_metrics" yaml:"self_metrics"`
+	// StartTimes includes a start timestamp with every counter point.
+	StartTimes bool `json:"start_times" yaml:"start_times"`
+	// SystemdWatchdog notifies the systemd watchdog after every delivered
+	// batch, so a service whose publishes stall gets restarted.
+	SystemdWatchdog bool `json:"systemd_watchdog" yaml:"systemd_watchdog"`
+	// Collectors lists the system metrics groups to collect: "memstats", "gc"
+	// and "goroutines". All are collected if it is absent; an empty list
+	// collects none.
+	Collectors []string `json:"collectors" yaml:"collectors"`
+	// Hostname normalizes the hostname sent with metrics: "as-is" (the
+	// default), "short" or "fqdn".
+	Hostname string `json:"hostname" yaml:"hostname"`
+	// TimerUnit is the unit timer durations are published in: "ns" (the
+	// default), "us", "ms" or "s".
+	TimerUnit string `json:"timer_unit" yaml:"timer_unit"`
+}
+
+// Load reads and validates the config file at path. Files ending in .json are
+// parsed as JSON, others as YAML.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config *Config
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		config, err = ParseJSON(data)
+	} else {
+		config, err = ParseYAML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseJSON parses and validates a JSON config. Unknown fields are an error.
+func ParseJSON(data []byte) (*Config, error) {
+	config := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid metrics config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ParseYAML parses and validates a YAML config. Unknown fields are an error.
+func ParseYAML(data []byte) (*Config, error) {
+	config := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid metrics config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the config for missing or inconsistent settings, reporting
+// every problem found.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	switch c.sink() {
+	case SinkBridge:
+		if c.URL == "" {
+			fail("url", "required when publishing to the bridge (or set sink to %q or %q)", SinkDryRun, SinkNone)
+		}
+	case SinkDryRun, SinkNone:
+	default:
+		fail("sink", "unknown sink %q, must be one of %q, %q or %q", c.Sink, SinkBridge, SinkDryRun, SinkNone)
+	}
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil {
+			fail("url", "%s", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			fail("url", "%q must be an http or https URL", c.URL)
+		}
+	}
+	// {hostname} is provided by NewMetrics, any value will do to validate
+	if _, err := sqmetrics.ExpandPrefix(c.Prefix, tagmap.Merge(map[string]string{"hostname": "hostname"}, c.PrefixVars)); err != nil {
+		fail("prefix", "%s", err)
+	}
+	if c.DryRunPath != "" && c.sink() != SinkDryRun {
+		fail("dry_run_path", "only used with sink %q", SinkDryRun)
+	}
+	if c.APIKeyHeader != "" && c.TokenFile == "" {
+		fail("api_key_header", "requires token_file")
+	}
+	if c.Interval <= 0 {
+		fail("interval", "must be a positive duration such as \"30s\"")
+	}
+	if !(c.Jitter >= 0 && c.Jitter <= 0.25) {
+		fail("jitter", "must be between 0 and 0.25, got %v", c.Jitter)
+	}
+	if c.Aligned && c.Jitter > 0 {
+		fail("jitter", "has no effect on aligned publishing")
+	}
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if i := strings.Index(pattern, "*"); i >= 0 && i != len(pattern)-1 {
+			fail("include/exclude", "pattern %q may only have a \"*\" at the end", pattern)
+		}
+	}
+	for key := range c.Tags {
+		if key == "" {
+			fail("tags", "tag names must not be empty")
+		}
+	}
+	if c.MaxSeries < 0 {
+		fail("max_series", "must not be negative")
+	}
+	if c.BatchSize < 0 {
+		fail("batch_size", "must not be negative")
+	}
+	if c.Retries < 0 {
+		fail("retries", "must not be negative")
+	}
+	if c.SpoolMax < 0 {
+		fail("spool_max", "must not be negative")
+	}
+	if (c.SpoolMax != 0 || c.SpoolKeyFile != "") && c.SpoolDir == "" {
+		fail("spool_dir", "required with spool_max and spool_key_file")
+	}
+	if c.RetryBackoff < 0 {
+		fail("retry_backoff", "must not be negative")
+	}
+
+	for _, name := range c.Collectors {
+		if _, ok := collectors[name]; !ok {
+			fail("collectors", "unknown collector %q, must be one of \"memstats\", \"gc\" or \"goroutines\"", name)
+		}
+	}
+
+	if _, ok := hostnameFormats[c.Hostname]; !ok {
+		fail("hostname", "unknown format %q, must be one of \"as-is\", \"short\" or \"fqdn\"", c.Hostname)
+	}
+	if _, ok := timerUnits[c.TimerUnit]; !ok {
+		fail("timer_unit", "unknown unit %q, must be one of \"ns\", \"us\", \"ms\" or \"s\"", c.TimerUnit)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid metrics config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (c *Config) sink() string {
+	if c.Sink == "" {
+		return SinkBridge
+	}
+	return c.Sink
+}
+
+// Options returns the sqmetrics options for the config. The dry-run sink's
+// file, if any, is opened here; it is never closed.
+func (c *Config) Options() ([]sqmetrics.Option, error) {
+	var options []sqmetrics.Option
+	if c.Jitter > 0 {
+		options = append(options, sqmetrics.WithJitter(c.Jitter))
+	}
+	if c.Aligned {
+		options = append(options, sqmetrics.WithAlignedPublishing())
+	}
+	if len(c.Include) > 0 {
+		options = append(options, sqmetrics.WithInclude(c.Include...))
+	}
+	if len(c.Exclude) > 0 {
+		options = append(options, sqmetrics.WithExclude(c.Exclude...))
+	}
+	if len(c.Tags) > 0 {
+		options = append(options, sqmetrics.WithTags(c.Tags))
+	}
+	if c.MaxSeries > 0 {
+		options = append(options, sqmetrics.WithMaxSeries(c.MaxSeries))
+	}
+	if c.BatchSize > 0 {
+		options = append(options, sqmetrics.WithBatchSize(c.BatchSize))
+	}
+	if c.Retries > 0 {
+		options = append(options, sqmetrics.WithRetries(c.Retries, time.Duration(c.RetryBackoff)))
+	}
+	if c.TokenFile != "" && c.APIKeyHeader != "" {
+		options = append(options, sqmetrics.WithAPIKeyFile(c.APIKeyHeader, c.TokenFile))
+	} else if c.TokenFile != "" {
+		options = append(options, sqmetrics.WithTokenFile(c.TokenFile))
+	}
+	if c.SpoolDir != "" {
+		max := c.SpoolMax
+		if max == 0 {
+			max = 1000
+		}
+		if c.SpoolKeyFile != "" {
+			options = append(options, sqmetrics.WithEncryptedSpool(c.SpoolDir, max, c.SpoolKeyFile))
+		} else {
+			options = append(options, sqmetrics.WithSpool(c.SpoolDir, max))
+		}
+	}
+	if c.Acks {
+		options = append(options, sqmetrics.WithAcks())
+	}
+	if c.SigningKeyFile != "" {
+		options = append(options, sqmetrics.WithSigningKeyFile(c.SigningKeyFile))
+	}
+	if c.HealthProbe != "" {
+		options = append(options, sqmetrics.WithHealthProbe(c.HealthProbe))
+	}
+	if c.Negotiation != "" {
+		options = append(options, sqmetrics.WithNegotiation(c.Negotiation))
+	}
+	if c.SelfMetrics {
+		options = append(options, sqmetrics.WithSelfMetrics())
+	}
+	if c.StartTimes {
+		options = append(options, sqmetrics.WithStartTimes())
+	}
+	if c.SystemdWatchdog {
+		options = append(options, sqmetrics.WithSystemdWatchdog())
+	}
+	if format := hostnameFormats[c.Hostname]; format != sqmetrics.HostnameAsIs {
+		options = append(options, sqmetrics.WithHostnameFormat(format))
+	}
+	if unit := timerUnits[c.TimerUnit]; unit != time.Nanosecond {
+		options = append(options, sqmetrics.WithTimerUnit(unit))
+	}
+	if len(c.PrefixVars) > 0 {
+		options = append(options, sqmetrics.WithPrefixVars(c.PrefixVars))
+	}
+	if c.Collectors != nil {
+		var set sqmetrics.Collector
+		for _, name := range c.Collectors {
+			set |= collectors[name]
+		}
+		options = append(options, sqmetrics.WithCollectors(set))
+	}
+	if c.sink() == SinkDryRun {
+		var out io.Writer = os.Stderr
+		if c.DryRunPath != "" {
+			file, err := os.OpenFile(c.DryRunPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			out = file
+		}
+		options = append(options, sqmetrics.WithDryRun(out))
+	}
+	return options, nil
+}
+
+// NewMetrics creates a SquareMetrics publishing as configured. Extra options
+// are applied after those of the config.
+func (c *Config) NewMetrics(client *http.Client, registry metrics.Registry, logger *log.Logger, extra ...sqmetrics.Option) (*sqmetrics.SquareMetrics, error) {
+	options, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	metricsURL := c.URL
+	if c.sink() != SinkBridge {
+		metricsURL = ""
+	}
+	return sqmetrics.NewMetrics(metricsURL, c.Prefix, client, time.Duration(c.Interval), registry, logger, append(options, extra...)...), nil
+}
+
+// Settings returns the parts of the config that can be changed at runtime,
+// for SquareMetrics.Reload.
+func (c *Config) Settings() sqmetrics.Settings {
+	settings := sqmetrics.Settings{
+		Interval: time.Duration(c.Interval),
+		Include:  c.Include,
+		Exclude:  c.Exclude,
+		Tags:     c.Tags,
+	}
+	if c.sink() == SinkBridge {
+		settings.URL = c.URL
+	}
+	return settings
+}
+
+// Reloader returns a function that loads the config file at path and returns
+// its runtime settings, for SquareMetrics.ReloadOnSignal:
+//
+//	metrics.ReloadOnSignal(sqconfig.Reloader(path))
+//
+// Settings that can only be set at startup, such as the prefix or sink, are
+// not reloaded.
+func Reloader(path string) func() (sqmetrics.Settings, error) {
+	return func() (sqmetrics.Settings, error) {
+		config, err := Load(path)
+		if err != nil {
+			return sqmetrics.Settings{}, err
+		}
+		return config.Settings(), nil
+	}
+}
@@ -0,0 +1,278 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqhdr provides go-metrics histograms and timers backed by HDR
+// histograms, which keep percentiles accurate to a configured precision over
+// the whole range of values, where the default exponentially decaying sample
+// gives poor tail accuracy for multi-modal distributions. They are serialized
+// by sqmetrics with the same fields as any other histogram or timer.
+//
+//	timer := sqhdr.GetOrRegisterTimer("db.query", registry, sqhdr.DefaultTimerConfig)
+package sqhdr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Config is the range and precision of an HDR histogram.
+type Config struct {
+	// Lowest is the lowest value that can be told apart from zero, at least 1.
+	Lowest int64
+	// Highest is the highest value tracked; larger values are recorded as
+	// Highest.
+	Highest int64
+	// SignificantFigures is the number of significant decimal digits values
+	// are kept to, from 1 to 5.
+	SignificantFigures int
+}
+
+// DefaultTimerConfig tracks durations from a microsecond to an hour, in
+// nanoseconds as timers record them, to three significant figures.
+var DefaultTimerConfig = Config{
+	Lowest:             int64(time.Microsecond),
+	Highest:            int64(time.Hour),
+	SignificantFigures: 3,
+}
+
+// Sample is a metrics.Sample backed by an HDR histogram. Unlike the default
+// samples, it covers every value recorded since it was created or cleared,
+// and doesn't keep the values themselves: Values returns nil and Size is the
+// number of values recorded.
+type Sample struct {
+	mutex     sync.Mutex
+	histogram *hdrhistogram.Histogram
+	sum       int64
+}
+
+// NewSample returns an empty Sample with the given range and precision.
+func NewSample(config Config) *Sample {
+	return &Sample{
+		histogram: hdrhistogram.New(config.Lowest, config.Highest, config.SignificantFigures),
+	}
+}
+
+// Clear removes all values.
+func (s *Sample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.histogram.Reset()
+	s.sum = 0
+}
+
+// Count returns the number of values recorded.
+func (s *Sample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.histogram.TotalCount()
+}
+
+// Max returns the highest value recorded, to the histogram's precision.
+func (s *Sample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.histogram.TotalCount() == 0 {
+		return 0
+	}
+	return s.histogram.Max()
+}
+
+// Mean returns the mean of the values recorded, to the histogram's precision.
+func (s *Sample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.histogram.Mean()
+}
+
+// Min returns the lowest value recorded, to the histogram's precision.
+func (s *Sample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.histogram.TotalCount() == 0 {
+		return 0
+	}
+	return s.histogram.Min()
+}
+
+// Percentile returns the value at the given quantile, between 0 and 1.
+func (s *Sample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns the values at the given quantiles, between 0 and 1.
+func (s *Sample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values := make([]float64, len(ps))
+	if s.histogram.TotalCount() == 0 {
+		return values
+	}
+	for i, p := range ps {
+		values[i] = float64(s.histogram.ValueAtQuantile(p * 100))
+	}
+	return values
+}
+
+// Size returns the number of values recorded.
+func (s *Sample) Size() int {
+	return int(s.Count())
+}
+
+// Snapshot returns a copy of the sample.
+func (s *Sample) Snapshot() metrics.Sample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &Sample{
+		histogram: hdrhistogram.Import(s.histogram.Export()),
+		sum:       s.sum,
+	}
+}
+
+// StdDev returns the standard deviation of the values recorded.
+func (s *Sample) StdDev() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.histogram.StdDev()
+}
+
+// Sum returns the exact sum of the values recorded.
+func (s *Sample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sum
+}
+
+// Update records a value, clamped to the histogram's range.
+func (s *Sample) Update(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if highest := s.histogram.HighestTrackableValue(); v > highest {
+		v = highest
+	} else if v < 0 {
+		v = 0
+	}
+	s.histogram.RecordValue(v)
+	s.sum += v
+}
+
+// Values returns nil, as an HDR histogram doesn't keep the values recorded.
+func (s *Sample) Values() []int64 {
+	return nil
+}
+
+// Variance returns the variance of the values recorded.
+func (s *Sample) Variance() float64 {
+	stdDev := s.StdDev()
+	return stdDev * stdDev
+}
+
+// Histogram is a metrics.Histogram backed by an HDR histogram. go-metrics'
+// own histograms and timers only work with its own samples, so a Sample
+// can't simply be passed to metrics.NewHistogram.
+type Histogram struct {
+	sample *Sample
+}
+
+// NewHistogram returns an empty Histogram with the given range and precision.
+func NewHistogram(config Config) *Histogram {
+	return &Histogram{NewSample(config)}
+}
+
+// GetOrRegisterHistogram returns the histogram with the given name, registering
+// a Histogram if needed.
+func GetOrRegisterHistogram(name string, registry metrics.Registry, config Config) metrics.Histogram {
+	return registry.GetOrRegister(name, func() metrics.Histogram {
+		return NewHistogram(config)
+	}).(metrics.Histogram)
+}
+
+func (h *Histogram) Clear()                             { h.sample.Clear() }
+func (h *Histogram) Count() int64                       { return h.sample.Count() }
+func (h *Histogram) Max() int64                         { return h.sample.Max() }
+func (h *Histogram) Mean() float64                      { return h.sample.Mean() }
+func (h *Histogram) Min() int64                         { return h.sample.Min() }
+func (h *Histogram) Percentile(p float64) float64       { return h.sample.Percentile(p) }
+func (h *Histogram) Percentiles(ps []float64) []float64 { return h.sample.Percentiles(ps) }
+func (h *Histogram) Sample() metrics.Sample             { return h.sample }
+func (h *Histogram) StdDev() float64                    { return h.sample.StdDev() }
+func (h *Histogram) Sum() int64                         { return h.sample.Sum() }
+func (h *Histogram) Update(v int64)                     { h.sample.Update(v) }
+func (h *Histogram) Variance() float64                  { return h.sample.Variance() }
+
+// Snapshot returns a copy of the histogram.
+func (h *Histogram) Snapshot() metrics.Histogram {
+	return &Histogram{h.sample.Snapshot().(*Sample)}
+}
+
+// Timer is a metrics.Timer whose durations are recorded in a Histogram.
+type Timer struct {
+	histogram *Histogram
+	meter     metrics.Meter
+}
+
+// NewTimer returns a Timer with the given range and precision, in nanoseconds.
+func NewTimer(config Config) *Timer {
+	return &Timer{NewHistogram(config), metrics.NewMeter()}
+}
+
+// GetOrRegisterTimer returns the timer with the given name, registering a
+// Timer if needed.
+func GetOrRegisterTimer(name string, registry metrics.Registry, config Config) metrics.Timer {
+	return registry.GetOrRegister(name, func() metrics.Timer {
+		return NewTimer(config)
+	}).(metrics.Timer)
+}
+
+func (t *Timer) Count() int64                       { return t.histogram.Count() }
+func (t *Timer) Max() int64                         { return t.histogram.Max() }
+func (t *Timer) Mean() float64                      { return t.histogram.Mean() }
+func (t *Timer) Min() int64                         { return t.histogram.Min() }
+func (t *Timer) Percentile(p float64) float64       { return t.histogram.Percentile(p) }
+func (t *Timer) Percentiles(ps []float64) []float64 { return t.histogram.Percentiles(ps) }
+func (t *Timer) Rate1() float64                     { return t.meter.Rate1() }
+func (t *Timer) Rate5() float64                     { return t.meter.Rate5() }
+func (t *Timer) Rate15() float64                    { return t.meter.Rate15() }
+func (t *Timer) RateMean() float64                  { return t.meter.RateMean() }
+func (t *Timer) StdDev() float64                    { return t.histogram.StdDev() }
+func (t *Timer) Stop()                              { t.meter.Stop() }
+func (t *Timer) Sum() int64                         { return t.histogram.Sum() }
+func (t *Timer) Variance() float64                  { return t.histogram.Variance() }
+
+// Snapshot returns a copy of the timer.
+func (t *Timer) Snapshot() metrics.Timer {
+	return &Timer{t.histogram.Snapshot().(*Histogram), t.meter.Snapshot()}
+}
+
+// Time records the duration of f.
+func (t *Timer) Time(f func()) {
+	start := time.Now()
+	f()
+	t.UpdateSince(start)
+}
+
+// Update records a duration.
+func (t *Timer) Update(d time.Duration) {
+	t.histogram.Update(int64(d))
+	t.meter.Mark(1)
+}
+
+// UpdateSince records the duration since start.
+func (t *Timer) UpdateSince(start time.Time) {
+	t.Update(time.Since(start))
+}
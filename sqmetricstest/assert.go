@@ -0,0 +1,148 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetricstest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Matcher is a condition on a metric value, for the Assert functions.
+type Matcher struct {
+	description string
+	matches     func(float64) bool
+}
+
+func (m Matcher) String() string {
+	return m.description
+}
+
+// Eq matches values equal to v.
+func Eq(v float64) Matcher {
+	return Matcher{fmt.Sprintf("== %v", v), func(x float64) bool { return x == v }}
+}
+
+// Gt matches values greater than v.
+func Gt(v float64) Matcher {
+	return Matcher{fmt.Sprintf("> %v", v), func(x float64) bool { return x > v }}
+}
+
+// Ge matches values greater than or equal to v.
+func Ge(v float64) Matcher {
+	return Matcher{fmt.Sprintf(">= %v", v), func(x float64) bool { return x >= v }}
+}
+
+// Lt matches values less than v.
+func Lt(v float64) Matcher {
+	return Matcher{fmt.Sprintf("< %v", v), func(x float64) bool { return x < v }}
+}
+
+// Le matches values less than or equal to v.
+func Le(v float64) Matcher {
+	return Matcher{fmt.Sprintf("<= %v", v), func(x float64) bool { return x <= v }}
+}
+
+// Between matches values in the closed interval [lo, hi].
+func Between(lo, hi float64) Matcher {
+	return Matcher{fmt.Sprintf("in [%v, %v]", lo, hi), func(x float64) bool { return x >= lo && x <= hi }}
+}
+
+func check(t testing.TB, kind, name string, value float64, m Matcher) {
+	t.Helper()
+	if !m.matches(value) {
+		t.Errorf("sqmetricstest: %s %q is %v, want %s", kind, name, value, m)
+	}
+}
+
+func lookup(t testing.TB, registry metrics.Registry, name string) interface{} {
+	t.Helper()
+	metric := registry.Get(name)
+	if metric == nil {
+		t.Errorf("sqmetricstest: no metric %q registered", name)
+	}
+	return metric
+}
+
+// AssertGauge fails the test unless the gauge (int64 or float64) registered
+// under name has a value matching m.
+func AssertGauge(t testing.TB, registry metrics.Registry, name string, m Matcher) {
+	t.Helper()
+	switch metric := lookup(t, registry, name).(type) {
+	case nil:
+	case metrics.Gauge:
+		check(t, "gauge", name, float64(metric.Value()), m)
+	case metrics.GaugeFloat64:
+		check(t, "gauge", name, metric.Value(), m)
+	default:
+		t.Errorf("sqmetricstest: metric %q is a %T, not a gauge", name, metric)
+	}
+}
+
+// AssertCounter fails the test unless the counter registered under name has a
+// count matching m.
+func AssertCounter(t testing.TB, registry metrics.Registry, name string, m Matcher) {
+	t.Helper()
+	switch metric := lookup(t, registry, name).(type) {
+	case nil:
+	case metrics.Counter:
+		check(t, "counter", name, float64(metric.Count()), m)
+	default:
+		t.Errorf("sqmetricstest: metric %q is a %T, not a counter", name, metric)
+	}
+}
+
+// AssertTimerCount fails the test unless the number of events recorded by the
+// timer registered under name matches m.
+func AssertTimerCount(t testing.TB, registry metrics.Registry, name string, m Matcher) {
+	t.Helper()
+	switch metric := lookup(t, registry, name).(type) {
+	case nil:
+	case metrics.Timer:
+		check(t, "timer count of", name, float64(metric.Count()), m)
+	default:
+		t.Errorf("sqmetricstest: metric %q is a %T, not a timer", name, metric)
+	}
+}
+
+// AssertHistogramCount fails the test unless the number of samples recorded
+// by the histogram registered under name matches m.
+func AssertHistogramCount(t testing.TB, registry metrics.Registry, name string, m Matcher) {
+	t.Helper()
+	switch metric := lookup(t, registry, name).(type) {
+	case nil:
+	case metrics.Histogram:
+		check(t, "histogram count of", name, float64(metric.Count()), m)
+	default:
+		t.Errorf("sqmetricstest: metric %q is a %T, not a histogram", name, metric)
+	}
+}
+
+// AssertRegistered fails the test unless a metric is registered under name.
+func AssertRegistered(t testing.TB, registry metrics.Registry, name string) {
+	t.Helper()
+	lookup(t, registry, name)
+}
+
+// AssertNotRegistered fails the test if a metric is registered under name.
+func AssertNotRegistered(t testing.TB, registry metrics.Registry, name string) {
+	t.Helper()
+	if metric := registry.Get(name); metric != nil {
+		t.Errorf("sqmetricstest: metric %q is registered (%T), want none", name, metric)
+	}
+}
@@ -0,0 +1,200 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqmetricstest provides utilities for testing code that publishes
+// metrics with sqmetrics.
+package sqmetricstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// Bridge is a fake metrics bridge. It records every batch posted to it and can
+// be told to fail, rate limit or delay requests, so that publishing can be
+// tested end-to-end. Point NewMetrics at Bridge.URL, with Bridge.Client().
+type Bridge struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	batches    [][]sqmetrics.MetricPoint
+	requests   int
+	failures   []int
+	retryAfter time.Duration
+	latency    time.Duration
+	received   chan struct{}
+}
+
+// NewBridge starts a fake bridge. Close it when done.
+func NewBridge() *Bridge {
+	bridge := &Bridge{received: make(chan struct{}, 1)}
+	bridge.Server = httptest.NewServer(http.HandlerFunc(bridge.handle))
+	return bridge
+}
+
+func (b *Bridge) handle(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	b.requests++
+	latency := b.latency
+	status := 0
+	if len(b.failures) > 0 {
+		status, b.failures = b.failures[0], b.failures[1:]
+	}
+	retryAfter := b.retryAfter
+	b.mutex.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if status != 0 {
+		if status == http.StatusTooManyRequests && retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var batch []sqmetrics.MetricPoint
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.mutex.Lock()
+	b.batches = append(b.batches, batch)
+	b.mutex.Unlock()
+	select {
+	case b.received <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// FailNext makes the next n requests fail with the given status code, without
+// recording their batches.
+func (b *Bridge) FailNext(n, status int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		b.failures = append(b.failures, status)
+	}
+}
+
+// RateLimitNext makes the next n requests fail with 429 Too Many Requests and
+// the given Retry-After delay.
+func (b *Bridge) RateLimitNext(n int, retryAfter time.Duration) {
+	b.mutex.Lock()
+	b.retryAfter = retryAfter
+	b.mutex.Unlock()
+	b.FailNext(n, http.StatusTooManyRequests)
+}
+
+// SetLatency delays every subsequent response by d.
+func (b *Bridge) SetLatency(d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.latency = d
+}
+
+// Requests returns the number of requests received, including failed ones.
+func (b *Bridge) Requests() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.requests
+}
+
+// Batches returns the batches received successfully, in order. Points are
+// decoded from the wire format, so their values are float64s and their Type is
+// not set.
+func (b *Bridge) Batches() [][]sqmetrics.MetricPoint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([][]sqmetrics.MetricPoint(nil), b.batches...)
+}
+
+// Points returns the points of all batches received successfully, in order.
+func (b *Bridge) Points() []sqmetrics.MetricPoint {
+	points := []sqmetrics.MetricPoint{}
+	for _, batch := range b.Batches() {
+		points = append(points, batch...)
+	}
+	return points
+}
+
+// Latest returns the most recently received point with the given name.
+func (b *Bridge) Latest(name string) (sqmetrics.MetricPoint, bool) {
+	points := b.Points()
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Name == name {
+			return points[i], true
+		}
+	}
+	return sqmetrics.MetricPoint{}, false
+}
+
+// Reset forgets all received batches and pending failures.
+func (b *Bridge) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.batches = nil
+	b.requests = 0
+	b.failures = nil
+}
+
+// WaitForBatches waits until at least n batches have been received, failing
+// the test if that takes longer than timeout.
+func (b *Bridge) WaitForBatches(t testing.TB, n int, timeout time.Duration) [][]sqmetrics.MetricPoint {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		if batches := b.Batches(); len(batches) >= n {
+			return batches
+		}
+		select {
+		case <-b.received:
+		case <-deadline:
+			t.Fatalf("sqmetricstest: received %d batches, want %d within %s", len(b.Batches()), n, timeout)
+			return nil
+		}
+	}
+}
+
+// AssertReceived fails the test unless a point with the given name was
+// received, and returns the latest one.
+func (b *Bridge) AssertReceived(t testing.TB, name string) sqmetrics.MetricPoint {
+	t.Helper()
+	point, ok := b.Latest(name)
+	if !ok {
+		t.Errorf("sqmetricstest: no metric %q received", name)
+	}
+	return point
+}
+
+// AssertNotReceived fails the test if a point with the given name was
+// received.
+func (b *Bridge) AssertNotReceived(t testing.TB, name string) {
+	t.Helper()
+	if _, ok := b.Latest(name); ok {
+		t.Errorf("sqmetricstest: metric %q received, want none", name)
+	}
+}
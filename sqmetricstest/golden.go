@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetricstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// UpdateGoldenEnv is the environment variable that makes AssertGolden
+// (re)write golden files instead of comparing against them.
+const UpdateGoldenEnv = "SQMETRICS_UPDATE_GOLDEN"
+
+// Placeholders substituted by NormalizePayload for values that change from
+// run to run.
+const (
+	NormalizedTimestamp = 0
+	NormalizedHostname  = "HOSTNAME"
+)
+
+// NormalizePayload rewrites a serialized batch (as posted to the bridge or
+// returned by ServeHTTP) into a canonical form suitable for comparing against
+// golden files: timestamps and hostnames are replaced with placeholders, points
+// are sorted by name, and the JSON is indented. All other fields, including
+// ones unknown to this package, are kept as they are.
+func NormalizePayload(payload []byte) ([]byte, error) {
+	var points []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&points); err != nil {
+		return nil, err
+	}
+
+	for _, point := range points {
+		if _, ok := point["timestamp"]; ok {
+			point["timestamp"] = NormalizedTimestamp
+		}
+		if _, ok := point["hostname"]; ok {
+			point["hostname"] = NormalizedHostname
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		name := func(point map[string]interface{}) string {
+			s, _ := point["metric"].(string)
+			return s
+		}
+		return name(points[i]) < name(points[j])
+	})
+
+	normalized, err := json.MarshalIndent(points, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(normalized, '\n'), nil
+}
+
+// AssertGolden normalizes payload with NormalizePayload and compares it with
+// the contents of the golden file at path, failing the test if they differ.
+// If the UpdateGoldenEnv environment variable is set, the golden file is
+// written instead, so that intended payload changes can be accepted with e.g.
+//
+//	SQMETRICS_UPDATE_GOLDEN=1 go test ./...
+//
+// and reviewed in the diff.
+func AssertGolden(t testing.TB, path string, payload []byte) {
+	t.Helper()
+	normalized, err := NormalizePayload(payload)
+	if err != nil {
+		t.Fatalf("sqmetricstest: invalid payload: %s", err)
+	}
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("sqmetricstest: %s", err)
+		}
+		if err := os.WriteFile(path, normalized, 0644); err != nil {
+			t.Fatalf("sqmetricstest: %s", err)
+		}
+		return
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("sqmetricstest: %s (set %s=1 to create it)", err, UpdateGoldenEnv)
+	}
+	if !bytes.Equal(golden, normalized) {
+		t.Errorf("sqmetricstest: payload differs from %s (set %s=1 to update it)\ngot:\n%s\nwant:\n%s",
+			path, UpdateGoldenEnv, normalized, golden)
+	}
+}
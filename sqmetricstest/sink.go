@@ -0,0 +1,92 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetricstest
+
+import (
+	"context"
+	"sync"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// RecordingSink is a sqmetrics.Sink that keeps every batch published to it in
+// memory, so that tests can inspect published metrics without an HTTP server:
+//
+//	sink := &sqmetricstest.RecordingSink{}
+//	metrics := sqmetrics.NewMetrics("", "test", nil, time.Second, registry, logger, sqmetrics.WithSink(sink))
+//	...
+//	metrics.Flush(ctx)
+//	point, ok := sink.Latest("test.requests")
+type RecordingSink struct {
+	mutex   sync.Mutex
+	batches [][]sqmetrics.MetricPoint
+}
+
+// Send records a copy of the batch.
+func (s *RecordingSink) Send(ctx context.Context, batch []sqmetrics.MetricPoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.batches = append(s.batches, append([]sqmetrics.MetricPoint(nil), batch...))
+	return nil
+}
+
+// Batches returns the recorded batches, in order.
+func (s *RecordingSink) Batches() [][]sqmetrics.MetricPoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]sqmetrics.MetricPoint(nil), s.batches...)
+}
+
+// Points returns the points of all recorded batches, in order.
+func (s *RecordingSink) Points() []sqmetrics.MetricPoint {
+	points := []sqmetrics.MetricPoint{}
+	for _, batch := range s.Batches() {
+		points = append(points, batch...)
+	}
+	return points
+}
+
+// Latest returns the most recently recorded point with the given (full)
+// name, and false if there is none.
+func (s *RecordingSink) Latest(name string) (sqmetrics.MetricPoint, bool) {
+	points := s.Points()
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Name == name {
+			return points[i], true
+		}
+	}
+	return sqmetrics.MetricPoint{}, false
+}
+
+// CountFor returns the number of recorded points with the given name, i.e.
+// how many publishes included the metric.
+func (s *RecordingSink) CountFor(name string) int {
+	count := 0
+	for _, point := range s.Points() {
+		if point.Name == name {
+			count++
+		}
+	}
+	return count
+}
+
+// Reset discards the recorded batches.
+func (s *RecordingSink) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.batches = nil
+}
@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqopencensus exports OpenCensus view data into a go-metrics
+// registry, so that legacy OpenCensus instrumentation is published by
+// sqmetrics along with everything else.
+//
+//	view.RegisterExporter(sqopencensus.NewExporter(registry, "oc."))
+package sqopencensus
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics/internal/importer"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Exporter is a view.Exporter that copies the rows of each view into a
+// go-metrics registry, with their tags encoded by sqmetrics.TaggedName. View
+// names are kept as they are; use rewrite rules to adapt them.
+//
+// Count aggregations become Gauges, and sum and last value aggregations
+// GaugeFloat64s. Distributions become a <name>.count, a <name>.min, a
+// <name>.max and a <name>.mean, as for go-metrics histograms, and a
+// <name>.bucket for each bucket with its cumulative count and its upper bound
+// in the "le" tag. NaN and infinite values are not exported.
+type Exporter struct {
+	registry metrics.Registry
+	prefix   string
+
+	mutex    sync.Mutex
+	exported map[string]map[string]bool // view name -> registry names
+}
+
+// NewExporter returns an Exporter into registry, which prepends prefix to the
+// names of the views it exports.
+func NewExporter(registry metrics.Registry, prefix string) *Exporter {
+	return &Exporter{
+		registry: registry,
+		prefix:   prefix,
+		exported: map[string]map[string]bool{},
+	}
+}
+
+// ExportView implements view.Exporter. Rows that are no longer reported for
+// the view are unregistered.
+func (e *Exporter) ExportView(data *view.Data) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	series := importer.NewSeries(e.registry)
+	setInt, setFloat := series.SetInt, series.SetFloat
+
+	name := e.prefix + data.View.Name
+	for _, row := range data.Rows {
+		tags := rowTags(row.Tags)
+		switch aggregation := row.Data.(type) {
+		case *view.CountData:
+			setInt(name, tags, aggregation.Value)
+		case *view.SumData:
+			setFloat(name, tags, aggregation.Value)
+		case *view.LastValueData:
+			setFloat(name, tags, aggregation.Value)
+		case *view.DistributionData:
+			setInt(name+".count", tags, aggregation.Count)
+			if aggregation.Count > 0 {
+				setFloat(name+".min", tags, aggregation.Min)
+				setFloat(name+".max", tags, aggregation.Max)
+			}
+			setFloat(name+".mean", tags, aggregation.Mean)
+
+			var bounds []float64
+			if data.View.Aggregation != nil {
+				bounds = data.View.Aggregation.Buckets
+			}
+			var cumulative int64
+			for i, count := range aggregation.CountPerBucket {
+				cumulative += count
+				le := "+Inf"
+				if i < len(bounds) {
+					le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+				}
+				setInt(name+".bucket", importer.WithTag(tags, "le", le), cumulative)
+			}
+		}
+	}
+
+	e.exported[data.View.Name] = series.Sweep(e.exported[data.View.Name])
+}
+
+func rowTags(tags []tag.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(tags))
+	for _, t := range tags {
+		out[t.Key.Name()] = t.Value
+	}
+	return out
+}
@@ -0,0 +1,187 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqotel
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics/internal/importer"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// MetricImporter is an OpenTelemetry metric reader that snapshots the
+// instruments of a MeterProvider into a go-metrics registry, so that metrics
+// instrumented with the OpenTelemetry API reach the bridge too. Attributes
+// are encoded as tags by sqmetrics.TaggedName.
+//
+// Sums and gauges become Gauges or GaugeFloat64s, depending on the
+// instrument. Histograms become a <name>.count and a <name>.sum, a <name>.min
+// and a <name>.max if recorded, and a <name>.bucket for each bucket with its
+// cumulative count and its upper bound in the "le" tag. Exponential histograms
+// only become a <name>.count and a <name>.sum. NaN and infinite values are not
+// imported.
+//
+//	importer := sqotel.NewMetricImporter(registry, "otel.")
+//	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(importer.Reader()))
+//	defer importer.Start(interval, nil)()
+type MetricImporter struct {
+	reader   *sdkmetric.ManualReader
+	registry metrics.Registry
+	prefix   string
+
+	mutex    sync.Mutex
+	imported map[string]bool
+}
+
+// NewMetricImporter returns a MetricImporter into registry, which prepends
+// prefix to the names of the instruments it imports.
+func NewMetricImporter(registry metrics.Registry, prefix string, options ...sdkmetric.ManualReaderOption) *MetricImporter {
+	return &MetricImporter{
+		reader:   sdkmetric.NewManualReader(options...),
+		registry: registry,
+		prefix:   prefix,
+		imported: map[string]bool{},
+	}
+}
+
+// Reader returns the reader to register with the MeterProvider.
+func (i *MetricImporter) Reader() sdkmetric.Reader {
+	return i.reader
+}
+
+// Import collects the current values and updates the registry. Series that
+// are no longer collected are unregistered.
+func (i *MetricImporter) Import(ctx context.Context) error {
+	var data metricdata.ResourceMetrics
+	if err := i.reader.Collect(ctx, &data); err != nil {
+		return err
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	series := importer.NewSeries(i.registry)
+	for _, scope := range data.ScopeMetrics {
+		for _, metric := range scope.Metrics {
+			importMetric(series, i.prefix+metric.Name, metric.Data)
+		}
+	}
+	i.imported = series.Sweep(i.imported)
+	return nil
+}
+
+func importMetric(series *importer.Series, name string, data metricdata.Aggregation) {
+	setInt, setFloat := series.SetInt, series.SetFloat
+
+	switch data := data.(type) {
+	case metricdata.Sum[int64]:
+		for _, point := range data.DataPoints {
+			setInt(name, attributeTags(point.Attributes), point.Value)
+		}
+	case metricdata.Sum[float64]:
+		for _, point := range data.DataPoints {
+			setFloat(name, attributeTags(point.Attributes), point.Value)
+		}
+	case metricdata.Gauge[int64]:
+		for _, point := range data.DataPoints {
+			setInt(name, attributeTags(point.Attributes), point.Value)
+		}
+	case metricdata.Gauge[float64]:
+		for _, point := range data.DataPoints {
+			setFloat(name, attributeTags(point.Attributes), point.Value)
+		}
+	case metricdata.Histogram[int64]:
+		for _, point := range data.DataPoints {
+			tags := attributeTags(point.Attributes)
+			setInt(name+".sum", tags, point.Sum)
+			importExtrema(setInt, name, tags, point.Min, point.Max)
+			importBuckets(setInt, name, tags, point.Count, point.Bounds, point.BucketCounts)
+		}
+	case metricdata.Histogram[float64]:
+		for _, point := range data.DataPoints {
+			tags := attributeTags(point.Attributes)
+			setFloat(name+".sum", tags, point.Sum)
+			importExtrema(setFloat, name, tags, point.Min, point.Max)
+			importBuckets(setInt, name, tags, point.Count, point.Bounds, point.BucketCounts)
+		}
+	case metricdata.ExponentialHistogram[int64]:
+		for _, point := range data.DataPoints {
+			tags := attributeTags(point.Attributes)
+			setInt(name+".count", tags, int64(point.Count))
+			setInt(name+".sum", tags, point.Sum)
+		}
+	case metricdata.ExponentialHistogram[float64]:
+		for _, point := range data.DataPoints {
+			tags := attributeTags(point.Attributes)
+			setInt(name+".count", tags, int64(point.Count))
+			setFloat(name+".sum", tags, point.Sum)
+		}
+	}
+}
+
+func importExtrema[N int64 | float64](set func(string, map[string]string, N), name string, tags map[string]string, min, max metricdata.Extrema[N]) {
+	if value, ok := min.Value(); ok {
+		set(name+".min", tags, value)
+	}
+	if value, ok := max.Value(); ok {
+		set(name+".max", tags, value)
+	}
+}
+
+// importBuckets imports the count of a histogram and its buckets, made
+// cumulative, with the last one bounded by +Inf.
+func importBuckets(set func(string, map[string]string, int64), name string, tags map[string]string, count uint64, bounds []float64, counts []uint64) {
+	set(name+".count", tags, int64(count))
+	var cumulative uint64
+	for j, bucketCount := range counts {
+		cumulative += bucketCount
+		le := "+Inf"
+		if j < len(bounds) {
+			le = strconv.FormatFloat(bounds[j], 'g', -1, 64)
+		}
+		set(name+".bucket", importer.WithTag(tags, "le", le), int64(cumulative))
+	}
+}
+
+// Start imports every interval until the returned function is called, passing
+// errors to onError if it is not nil.
+func (i *MetricImporter) Start(interval time.Duration, onError func(error)) (stop func()) {
+	return importer.Start(interval, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		if err := i.Import(ctx); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+func attributeTags(set attribute.Set) map[string]string {
+	if set.Len() == 0 {
+		return nil
+	}
+	tags := make(map[string]string, set.Len())
+	for iter := set.Iter(); iter.Next(); {
+		attr := iter.Attribute()
+		tags[string(attr.Key)] = attr.Value.Emit()
+	}
+	return tags
+}
@@ -0,0 +1,90 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqotel integrates sqmetrics with OpenTelemetry: it traces publishes,
+// and imports metrics instrumented with the OpenTelemetry API.
+//
+// To trace publishes, install the transport on the client passed to
+// sqmetrics.NewMetrics:
+//
+//	client := &http.Client{Transport: sqotel.NewTransport(http.DefaultTransport, otel.GetTracerProvider())}
+//	metrics := sqmetrics.NewMetrics(url, prefix, client, interval, registry, logger)
+package sqotel
+
+import (
+	"fmt"
+	"net/http"
+
+	sqmetrics "github.com/square/go-sq-metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/square/go-sq-metrics/sqotel"
+
+// Transport is an http.RoundTripper that wraps each request in a client span
+// and propagates the trace context to the bridge in the request headers.
+type Transport struct {
+	base   http.RoundTripper
+	tracer trace.Tracer
+}
+
+// NewTransport returns a Transport that sends requests through base and
+// records spans with a tracer from provider.
+func NewTransport(base http.RoundTripper, provider trace.TracerProvider) *Transport {
+	return &Transport{
+		base:   base,
+		tracer: provider.Tracer(instrumentationName),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.full", req.URL.String()),
+		attribute.String("server.address", req.URL.Hostname()),
+	}
+	if size, ok := sqmetrics.BatchSizeFromContext(req.Context()); ok {
+		attrs = append(attrs, attribute.Int("sqmetrics.batch_size", size))
+	}
+	if req.ContentLength > 0 {
+		attrs = append(attrs, attribute.Int64("http.request.body.size", req.ContentLength))
+	}
+
+	ctx, span := t.tracer.Start(req.Context(), fmt.Sprintf("sqmetrics %s", req.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
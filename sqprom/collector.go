@@ -0,0 +1,162 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqprom
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// collectorQuantiles are the quantiles exported for histograms and timers, as
+// serialized by sqmetrics.
+var collectorQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// Collector is a prometheus.Collector over a go-metrics registry, so that
+// services scraped by Prometheus can expose their registry alongside other
+// collectors without instrumenting twice. Names are sanitized into valid
+// Prometheus names, and tags encoded by sqmetrics.TaggedName become labels;
+// all series of a metric must have the same tag keys.
+//
+// Counters and gauges keep their types. Meters become counters of their
+// events, named <name>_total. Histograms become summaries, and timers become
+// summaries in seconds, named <name>_seconds; those with explicit buckets
+// (see sqmetrics.Bucketed) become histograms instead. A registry exposed this way
+// should not also be the target of an Importer from the same gatherer.
+type Collector struct {
+	registry  metrics.Registry
+	namespace string
+}
+
+// NewCollector returns a Collector over registry. Unless namespace is empty,
+// it is prepended to the names of the metrics, separated by an underscore.
+func NewCollector(registry metrics.Registry, namespace string) *Collector {
+	return &Collector{registry: registry, namespace: namespace}
+}
+
+// Describe implements prometheus.Collector. It describes nothing, which makes
+// the Collector unchecked, as the metrics of a registry come and go.
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.registry.Each(func(name string, metric interface{}) {
+		name, tags := sqmetrics.SplitTaggedName(name)
+		name = sanitize(name)
+		if c.namespace != "" {
+			name = sanitize(c.namespace) + "_" + name
+		}
+		labels, values := labelPairs(tags)
+
+		switch metric := metric.(type) {
+		case metrics.Counter:
+			send(ch, name, labels, values, prometheus.CounterValue, float64(metric.Count()))
+		case metrics.Gauge:
+			send(ch, name, labels, values, prometheus.GaugeValue, float64(metric.Value()))
+		case metrics.GaugeFloat64:
+			send(ch, name, labels, values, prometheus.GaugeValue, metric.Value())
+		case metrics.Meter:
+			send(ch, name+"_total", labels, values, prometheus.CounterValue, float64(metric.Count()))
+		case metrics.Histogram:
+			snapshot := metric.Snapshot()
+			if bucketed, ok := metric.(sqmetrics.Bucketed); ok {
+				sendHistogram(ch, name, labels, values, snapshot.Count(), snapshot.Sum(), bucketed, 1)
+			} else {
+				sendSummary(ch, name, labels, values, snapshot.Count(), snapshot.Sum(), snapshot.Percentiles(collectorQuantiles), 1)
+			}
+		case metrics.Timer:
+			snapshot := metric.Snapshot()
+			if bucketed, ok := metric.(sqmetrics.Bucketed); ok {
+				sendHistogram(ch, name+"_seconds", labels, values, snapshot.Count(), snapshot.Sum(), bucketed, 1/float64(time.Second))
+			} else {
+				sendSummary(ch, name+"_seconds", labels, values, snapshot.Count(), snapshot.Sum(), snapshot.Percentiles(collectorQuantiles), 1/float64(time.Second))
+			}
+		}
+	})
+}
+
+func send(ch chan<- prometheus.Metric, name string, labels, values []string, kind prometheus.ValueType, value float64) {
+	desc := prometheus.NewDesc(name, name, labels, nil)
+	metric, err := prometheus.NewConstMetric(desc, kind, value, values...)
+	if err != nil {
+		metric = prometheus.NewInvalidMetric(desc, err)
+	}
+	ch <- metric
+}
+
+// sendSummary sends a summary, with its sum and quantiles multiplied by scale.
+func sendSummary(ch chan<- prometheus.Metric, name string, labels, values []string, count, sum int64, percentiles []float64, scale float64) {
+	desc := prometheus.NewDesc(name, name, labels, nil)
+	quantiles := make(map[float64]float64, len(collectorQuantiles))
+	for i, quantile := range collectorQuantiles {
+		quantiles[quantile] = percentiles[i] * scale
+	}
+	metric, err := prometheus.NewConstSummary(desc, uint64(count), float64(sum)*scale, quantiles, values...)
+	if err != nil {
+		metric = prometheus.NewInvalidMetric(desc, err)
+	}
+	ch <- metric
+}
+
+// sendHistogram sends a histogram, with its sum and bucket bounds multiplied
+// by scale.
+func sendHistogram(ch chan<- prometheus.Metric, name string, labels, values []string, count, sum int64, bucketed sqmetrics.Bucketed, scale float64) {
+	desc := prometheus.NewDesc(name, name, labels, nil)
+	bounds, counts := bucketed.Buckets()
+	buckets := make(map[float64]uint64, len(bounds))
+	for i, bound := range bounds {
+		buckets[float64(bound)*scale] = uint64(counts[i])
+	}
+	metric, err := prometheus.NewConstHistogram(desc, uint64(count), float64(sum)*scale, buckets, values...)
+	if err != nil {
+		metric = prometheus.NewInvalidMetric(desc, err)
+	}
+	ch <- metric
+}
+
+// labelPairs returns the sanitized label names of tags, sorted, and their
+// values in the same order.
+func labelPairs(tags map[string]string) (labels, values []string) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels = append(labels, sanitize(key))
+		values = append(values, tags[key])
+	}
+	return labels, values
+}
+
+// sanitize turns a name into a valid Prometheus name, replacing any invalid
+// characters with underscores.
+func sanitize(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqprom bridges sqmetrics and the Prometheus client library: it
+// imports metrics instrumented with prometheus/client_golang, so that they
+// reach the bridge too, and exposes go-metrics registries to Prometheus.
+package sqprom
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics/internal/importer"
+)
+
+// Importer copies the metrics gathered from a prometheus.Gatherer into a
+// go-metrics registry, with labels encoded as tags by sqmetrics.TaggedName.
+// Counters, gauges and untyped metrics become GaugeFloat64s. Summaries become
+// a <name>.count and a <name>.sum, and a <name>.<q>-percentile for each
+// quantile, as for go-metrics histograms. Histograms become a <name>.count
+// and a <name>.sum, and a <name>.bucket for each bucket with its cumulative
+// count and its upper bound in the "le" tag. NaN and infinite samples, such as
+// the quantiles of a summary without observations, are not imported.
+type Importer struct {
+	gatherer prometheus.Gatherer
+	registry metrics.Registry
+	prefix   string
+
+	mutex    sync.Mutex
+	imported map[string]bool
+}
+
+// NewImporter returns an Importer from gatherer into registry, which prepends
+// prefix to the names of the metrics it imports.
+func NewImporter(gatherer prometheus.Gatherer, registry metrics.Registry, prefix string) *Importer {
+	return &Importer{
+		gatherer: gatherer,
+		registry: registry,
+		prefix:   prefix,
+		imported: map[string]bool{},
+	}
+}
+
+// Import gathers the current values and updates the registry. Series that
+// are no longer gathered are unregistered. If gathering fails partially, what
+// was gathered is still imported and the error returned.
+func (i *Importer) Import() error {
+	families, err := i.gatherer.Gather()
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	series := importer.NewSeries(i.registry)
+	// NaN samples, e.g. the quantiles of a summary without observations,
+	// are skipped
+	set := series.SetFloat
+
+	for _, family := range families {
+		name := i.prefix + family.GetName()
+		for _, metric := range family.GetMetric() {
+			labels := labelTags(metric.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				set(name, labels, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				set(name, labels, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				set(name, labels, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				set(name+".count", labels, float64(summary.GetSampleCount()))
+				set(name+".sum", labels, summary.GetSampleSum())
+				for _, quantile := range summary.GetQuantile() {
+					set(name+"."+formatFloat(quantile.GetQuantile()*100)+"-percentile", labels, quantile.GetValue())
+				}
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				set(name+".count", labels, float64(histogram.GetSampleCount()))
+				set(name+".sum", labels, histogram.GetSampleSum())
+				for _, bucket := range histogram.GetBucket() {
+					set(name+".bucket", importer.WithTag(labels, "le", formatFloat(bucket.GetUpperBound())), float64(bucket.GetCumulativeCount()))
+				}
+			}
+		}
+	}
+
+	i.imported = series.Sweep(i.imported)
+	return err
+}
+
+// Start imports every interval until the returned function is called, passing
+// errors to onError if it is not nil.
+func (i *Importer) Start(interval time.Duration, onError func(error)) (stop func()) {
+	return importer.Start(interval, func() {
+		if err := i.Import(); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+func labelTags(labels []*dto.LabelPair) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(labels))
+	for _, label := range labels {
+		tags[label.GetName()] = label.GetValue()
+	}
+	return tags
+}
+
+// formatFloat formats bucket bounds and quantiles the way Prometheus does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
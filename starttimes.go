@@ -0,0 +1,99 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sync"
+)
+
+// WithStartTimes includes a start timestamp with every counter point: the time
+// the counter started counting from, so that consumers such as OTLP and other
+// delta-aware backends can tell a reset from a decrease. Counters seen at the
+// first publish started with the process (the time NewMetrics was called);
+// later ones started at the previous publish, before which they hadn't been
+// seen. A counter whose value goes down is taken to have been reset since it
+// was last published, and restarts from then.
+func WithStartTimes() Option {
+	return func(mb *SquareMetrics) {
+		mb.starts = &startTimes{entries: map[string]startEntry{}}
+	}
+}
+
+// startTimes tracks the start times of cumulative counters.
+type startTimes struct {
+	mutex    sync.Mutex
+	entries  map[string]startEntry
+	latest   int64 // the time of the most recent publish
+	previous int64 // the time of the publish before it
+}
+
+type startEntry struct {
+	start int64
+	value int64
+	seen  int64
+}
+
+// get returns the start time of the counter called name, whose value is value
+// at now, in seconds since the epoch.
+func (s *startTimes) get(name string, value, now, started int64) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.latest == 0 {
+		s.latest = started
+	}
+	if now > s.latest {
+		s.previous, s.latest = s.latest, now
+	}
+
+	entry, ok := s.entries[name]
+	switch {
+	case !ok && s.previous == 0:
+		entry.start = started
+	case !ok:
+		entry.start = s.previous
+	case value < entry.value:
+		entry.start = entry.seen
+	}
+	entry.value, entry.seen = value, now
+	s.entries[name] = entry
+	return entry.start
+}
+
+// peek returns the start time get would return at the next publish for the
+// counter called name, whose value is value, without recording anything, for
+// serializations other than publishes.
+func (s *startTimes) peek(name string, value, started int64) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[name]
+	switch {
+	case !ok && s.latest == 0:
+		return started
+	case !ok:
+		return s.latest
+	case value < entry.value:
+		return entry.seen
+	}
+	return entry.start
+}
+
+// forget drops the start time of a counter that was unregistered.
+func (s *startTimes) forget(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, name)
+}
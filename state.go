@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"sync"
+)
+
+// StateStyle is how a State is serialized.
+type StateStyle int
+
+const (
+	// StatePerGauge serializes a point per state, tagged with the state in
+	// the "state" tag, valued 1 for the current state and 0 for the others,
+	// for graphing and alerting on each state.
+	StatePerGauge StateStyle = iota
+	// StateValue serializes a single point valued with the index of the
+	// current state, with its name in the "state" tag.
+	StateValue
+)
+
+// State is a metric for state machines, such as leader/follower or up/down,
+// whose value is one of an enumerated set of states.
+type State struct {
+	states []string
+	style  StateStyle
+	names  map[string]int
+
+	mutex   sync.Mutex
+	current int
+}
+
+// NewState returns a State with the given states, serialized in the given
+// style. It starts in the first state.
+func NewState(style StateStyle, states ...string) *State {
+	if len(states) == 0 {
+		panic("sqmetrics: a State needs at least one state")
+	}
+	names := make(map[string]int, len(states))
+	for i, state := range states {
+		names[state] = i
+	}
+	return &State{states: states, style: style, names: names}
+}
+
+// State returns the State with the given name, registering a new one with the
+// given states and style if needed. Its name must not be used by a metric of
+// the main registry.
+func (mb *SquareMetrics) State(name string, style StateStyle, states ...string) *State {
+	return mb.custom.getOrRegister(name, func() customMetric {
+		return NewState(style, states...)
+	}).(*State)
+}
+
+// Set changes the current state. It panics if state is not one of the states
+// of the State.
+func (s *State) Set(state string) {
+	i, ok := s.names[state]
+	if !ok {
+		panic(fmt.Sprintf("sqmetrics: unknown state %q", state))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current = i
+}
+
+// Current returns the current state.
+func (s *State) Current() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.states[s.current]
+}
+
+func (s *State) flatten(names *nameCache, nvs []tuple, name string) []tuple {
+	s.mutex.Lock()
+	current := s.current
+	s.mutex.Unlock()
+
+	flattened := names.states(name, s.states)
+	if s.style == StateValue {
+		return append(nvs, tuple{flattened[current], int64(current), StateType})
+	}
+	for i := range s.states {
+		var value int64
+		if i == current {
+			value = 1
+		}
+		nvs = append(nvs, tuple{flattened[i], value, StateType})
+	}
+	return nvs
+}
+
+// stateNames returns the names of a State's points, one per state, with the
+// state merged into any tags encoded in name.
+func stateNames(name string, states []string) []string {
+	base, tags := SplitTaggedName(name)
+	names := make([]string, len(states))
+	for i, state := range states {
+		names[i] = TaggedName(base, mergeMaps(tags, map[string]string{"state": state}))
+	}
+	return names
+}
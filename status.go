@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// publishStatus remembers the outcome of recent publishes.
+type publishStatus struct {
+	mutex       sync.Mutex
+	lastSuccess time.Time
+	lastError   error
+	lastStatus  int
+	lastPayload []byte
+	queued      int
+}
+
+func (s *publishStatus) record(event PublishEvent, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if event.Err == nil {
+		s.lastSuccess = at
+	} else {
+		s.lastError = event.Err
+	}
+	s.lastStatus = event.StatusCode
+}
+
+// setPayload keeps a copy of the payload about to be sent, reusing the memory
+// of the previous one.
+func (s *publishStatus) setPayload(payload []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastPayload = append(s.lastPayload[:0], payload...)
+}
+
+// setQueued records the number of batches waiting to be delivered.
+func (s *publishStatus) setQueued(batches int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queued = batches
+}
+
+// LastPublishTime returns the time of the last successful publish, or the zero
+// time if there hasn't been one yet.
+func (mb *SquareMetrics) LastPublishTime() time.Time {
+	mb.status.mutex.Lock()
+	defer mb.status.mutex.Unlock()
+	return mb.status.lastSuccess
+}
+
+// LastError returns the error the most recent failed publish failed with, or
+// nil if no publish has failed yet. A later successful publish doesn't clear
+// it; compare LastPublishTime to see whether the metrics path has recovered.
+func (mb *SquareMetrics) LastError() error {
+	mb.status.mutex.Lock()
+	defer mb.status.mutex.Unlock()
+	return mb.status.lastError
+}
+
+// defaultHealthIntervals is the number of intervals HealthHandler is given
+// when it is given an invalid one.
+const defaultHealthIntervals = 3
+
+// HealthHandler returns an http.Handler for readiness checks that responds
+// 200 OK if a publish succeeded within the last n intervals, and 503 Service
+// Unavailable otherwise. For the first n intervals after NewMetrics the
+// handler reports healthy even if nothing has been published yet. If n is not
+// positive, 3 intervals are used, with a warning.
+func (mb *SquareMetrics) HealthHandler(n int) http.Handler {
+	if n <= 0 {
+		mb.logger.Printf("invalid metrics health check window of %d intervals, using %d", n, defaultHealthIntervals)
+		n = defaultHealthIntervals
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window := time.Duration(n) * mb.currentInterval()
+		last := mb.LastPublishTime()
+		if last.IsZero() {
+			last = mb.started
+		}
+
+		if since := mb.clock.Now().Sub(last); since > window {
+			message := fmt.Sprintf("no successful metrics publish in %s", since.Round(time.Second))
+			if err := mb.LastError(); err != nil {
+				message = fmt.Sprintf("%s, last error: %s", message, err)
+			}
+			http.Error(w, message, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
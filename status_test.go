@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+func TestHealthHandler(t *testing.T) {
+	clock := &manualClock{Clock: sqmetrics.SystemClock(), now: time.Unix(1500000000, 0)}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Minute, metrics.NewRegistry(), log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithClock(clock))
+	defer mb.Close()
+
+	status := func(n int) int {
+		recorder := httptest.NewRecorder()
+		mb.HealthHandler(n).ServeHTTP(recorder, httptest.NewRequest("GET", "/_health", nil))
+		return recorder.Code
+	}
+	// nothing was published, but it is too early to tell
+	for _, n := range []int{2, 0, -1} {
+		if got := status(n); got != http.StatusOK {
+			t.Errorf("HealthHandler(%d) responded %d at startup, want 200", n, got)
+		}
+	}
+
+	clock.advance(150 * time.Second)
+	if got := status(2); got != http.StatusServiceUnavailable {
+		t.Errorf("HealthHandler(2) responded %d after 2.5 intervals, want 503", got)
+	}
+	// invalid windows default to 3 intervals rather than always failing
+	if got := status(0); got != http.StatusOK {
+		t.Errorf("HealthHandler(0) responded %d after 2.5 intervals, want 200", got)
+	}
+}
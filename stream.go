@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamKeepalive is how often a comment is sent to idle stream clients, so
+// that proxies don't time the connection out.
+const streamKeepalive = 30 * time.Second
+
+// streamHub fans serialized batches out to the clients of StreamHandler.
+type streamHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: map[chan []byte]struct{}{}}
+}
+
+func (h *streamHub) subscribe() chan []byte {
+	c := make(chan []byte, 1)
+	h.mutex.Lock()
+	h.subscribers[c] = struct{}{}
+	h.mutex.Unlock()
+	return c
+}
+
+func (h *streamHub) unsubscribe(c chan []byte) {
+	h.mutex.Lock()
+	delete(h.subscribers, c)
+	h.mutex.Unlock()
+}
+
+// active reports whether any client is connected.
+func (h *streamHub) active() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// broadcast sends a payload to every client. A client that hasn't consumed the
+// previous payload yet gets the new one instead, so slow clients can't hold up
+// publishing.
+func (h *streamHub) broadcast(payload []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for c := range h.subscribers {
+		select {
+		case <-c:
+		default:
+		}
+		c <- payload
+	}
+}
+
+// stream serializes points once and sends them to the stream clients, if
+// there are any.
+func (mb *SquareMetrics) stream(points []MetricPoint) {
+	if !mb.streams.active() {
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := mb.encodePoints(buf, points); err != nil {
+		mb.reportError(err)
+		return
+	}
+	mb.streams.broadcast(append([]byte(nil), buf.Bytes()...))
+}
+
+// streamSnapshot sends every metric to the stream clients when there's no
+// publish, leaving slow lanes and dedupe state alone.
+func (mb *SquareMetrics) streamSnapshot() {
+	if mb.streams.active() {
+		mb.stream(mb.snapshot(nil))
+	}
+}
+
+// StreamHandler returns an http.Handler that streams metrics to clients as
+// server-sent events, for live dashboards that don't want to poll. At every
+// publish, each client receives a "metrics" event whose data is the published
+// batch as a JSON array. If nothing is published, because there is no bridge
+// URL, dry run writer or sink or because the bridge is unhealthy, clients
+// receive a snapshot of every metric at each interval instead. Clients that
+// fall behind skip batches. The handler is protected by WithAuthorizer.
+func (mb *SquareMetrics) StreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mb.authorized(w, r) {
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		payloads := mb.streams.subscribe()
+		defer mb.streams.unsubscribe(payloads)
+
+		preventCaching(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Accel-Buffering", "no")
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		keepalive := mb.clock.NewTicker(streamKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-mb.done:
+				return
+			case <-keepalive.C():
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case payload := <-payloads:
+				if _, err := fmt.Fprintf(w, "event: metrics\ndata: %s\n\n", payload); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
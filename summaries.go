@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// summary holds the values a histogram or timer is flattened into.
+type summary struct {
+	count, min, max int64
+	mean            float64
+	percentiles     []float64
+}
+
+// summaryCache remembers the last summary computed for each histogram and
+// timer. Snapshotting and computing percentiles is by far the most expensive
+// part of serialization, and pointless for metrics that haven't been updated:
+// when the count of a metric is unchanged since it was last summarized, the
+// previous summary is reused. (A metric that is cleared and then updated as
+// many times as before in between two publishes goes unnoticed until its next
+// update.) Histograms with a SlidingWindowSample, and sliding window timers,
+// are always summarized, as their values expire without updates.
+type summaryCache struct {
+	mutex   sync.Mutex
+	entries map[string]summary
+}
+
+func newSummaryCache() *summaryCache {
+	return &summaryCache{entries: map[string]summary{}}
+}
+
+func (c *summaryCache) histogram(name string, histogram metrics.Histogram) summary {
+	_, windowed := histogram.Sample().(windowed)
+	return c.get(name, histogram.Count(), windowed, func() summary {
+		snapshot := histogram.Snapshot()
+		return summary{
+			snapshot.Count(), snapshot.Min(), snapshot.Max(), snapshot.Mean(),
+			snapshot.Percentiles(summaryPercentiles),
+		}
+	})
+}
+
+func (c *summaryCache) timer(name string, timer metrics.Timer) summary {
+	_, windowed := timer.(windowed)
+	return c.get(name, timer.Count(), windowed, func() summary {
+		snapshot := timer.Snapshot()
+		return summary{
+			snapshot.Count(), snapshot.Min(), snapshot.Max(), snapshot.Mean(),
+			snapshot.Percentiles(summaryPercentiles),
+		}
+	})
+}
+
+func (c *summaryCache) get(name string, count int64, windowed bool, compute func() summary) summary {
+	if windowed {
+		return compute()
+	}
+	c.mutex.Lock()
+	cached, ok := c.entries[name]
+	c.mutex.Unlock()
+	if ok && cached.count == count {
+		return cached
+	}
+
+	computed := compute()
+	c.mutex.Lock()
+	c.entries[name] = computed
+	c.mutex.Unlock()
+	return computed
+}
+
+// forget drops the cached summary of an unregistered metric.
+func (c *summaryCache) forget(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, name)
+}
@@ -0,0 +1,169 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// TaggedName encodes tags into a registry name, in the form
+// name{key="value",...} with keys sorted, so that a metric registered under
+// it is published as name with the tags added to (and overriding) the common
+// ones. Each distinct set of tags is a separate series. Filters, slow lanes
+// and other registry name patterns see the encoded name; rewrite rules see
+// the name without its tags.
+func TaggedName(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(tags[key]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// SplitTaggedName decodes a name encoded by TaggedName into the plain name
+// and its tags. Anything after the tags, such as the suffixes of flattened
+// histogram values, is kept in the name. Names without valid tags are
+// returned as they are, with nil tags.
+func SplitTaggedName(name string) (string, map[string]string) {
+	start := strings.IndexByte(name, '{')
+	if start < 0 {
+		return name, nil
+	}
+
+	tags := map[string]string{}
+	rest := name[start+1:]
+	for {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.ContainsAny(key, `{},"`) {
+			return name, nil
+		}
+		quoted, err := strconv.QuotedPrefix(after)
+		if err != nil {
+			return name, nil
+		}
+		tags[key], _ = strconv.Unquote(quoted)
+		rest = after[len(quoted):]
+
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if strings.HasPrefix(rest, "}") {
+			return name[:start] + rest[1:], tags
+		} else {
+			return name, nil
+		}
+	}
+}
+
+// Tags are the tags of a series in a TaggedRegistry.
+type Tags map[string]string
+
+// TaggedRegistry is a go-metrics registry that registers metrics by name and
+// tags, encoding the tags into registry names with TaggedName. It remains a
+// plain metrics.Registry, so it can be passed to NewMetrics or anything else
+// that takes one:
+//
+//	registry := sqmetrics.NewTaggedRegistry(metrics.NewRegistry())
+//	registry.Counter("requests", sqmetrics.Tags{"code": "500"}).Inc(1)
+type TaggedRegistry struct {
+	metrics.Registry
+}
+
+// NewTaggedRegistry returns a TaggedRegistry that registers metrics in
+// registry.
+func NewTaggedRegistry(registry metrics.Registry) *TaggedRegistry {
+	return &TaggedRegistry{registry}
+}
+
+// Counter returns the counter with the given name and tags, registering it
+// if needed.
+func (r *TaggedRegistry) Counter(name string, tags Tags) metrics.Counter {
+	return metrics.GetOrRegisterCounter(TaggedName(name, tags), r.Registry)
+}
+
+// Gauge returns the gauge with the given name and tags, registering it if
+// needed.
+func (r *TaggedRegistry) Gauge(name string, tags Tags) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(TaggedName(name, tags), r.Registry)
+}
+
+// GaugeFloat64 returns the float gauge with the given name and tags,
+// registering it if needed.
+func (r *TaggedRegistry) GaugeFloat64(name string, tags Tags) metrics.GaugeFloat64 {
+	return metrics.GetOrRegisterGaugeFloat64(TaggedName(name, tags), r.Registry)
+}
+
+// Meter returns the meter with the given name and tags, registering it if
+// needed.
+func (r *TaggedRegistry) Meter(name string, tags Tags) metrics.Meter {
+	return metrics.GetOrRegisterMeter(TaggedName(name, tags), r.Registry)
+}
+
+// Histogram returns the histogram with the given name and tags, registering
+// it with an exponentially decaying sample, as go-metrics timers use, if
+// needed.
+func (r *TaggedRegistry) Histogram(name string, tags Tags) metrics.Histogram {
+	return r.Registry.GetOrRegister(TaggedName(name, tags), func() metrics.Histogram {
+		return metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	}).(metrics.Histogram)
+}
+
+// Timer returns the timer with the given name and tags, registering it if
+// needed.
+func (r *TaggedRegistry) Timer(name string, tags Tags) metrics.Timer {
+	return metrics.GetOrRegisterTimer(TaggedName(name, tags), r.Registry)
+}
+
+// GetTagged returns the metric with the given name and tags, or nil if there
+// is none.
+func (r *TaggedRegistry) GetTagged(name string, tags Tags) interface{} {
+	return r.Registry.Get(TaggedName(name, tags))
+}
+
+// UnregisterTagged removes the metric with the given name and tags.
+func (r *TaggedRegistry) UnregisterTagged(name string, tags Tags) {
+	UnregisterFrom(r.Registry, TaggedName(name, tags))
+}
+
+// EachTagged calls fn for each registered metric with its name and tags
+// decoded.
+func (r *TaggedRegistry) EachTagged(fn func(name string, tags Tags, metric interface{})) {
+	r.Registry.Each(func(name string, metric interface{}) {
+		name, tags := SplitTaggedName(name)
+		fn(name, tags, metric)
+	})
+}
@@ -0,0 +1,32 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import "github.com/square/go-sq-metrics/internal/tagmap"
+
+// mergeMaps returns a new map with the entries of all the given maps, later maps
+// winning, or nil if there are none. It is shared with the subpackages.
+var mergeMaps = tagmap.Merge
+
+// updateTags recomputes the tags attached to published metrics. The map is
+// replaced rather than modified, as points share it.
+func (mb *SquareMetrics) updateTags() {
+	mb.tags = mergeMaps(mb.envTags, mb.userTags)
+	for _, source := range mb.sources {
+		source.merged = mergeMaps(mb.tags, source.tags)
+	}
+}
@@ -0,0 +1,148 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// ThresholdRule watches published values for a threshold being crossed, for
+// cheap in-process alerting before the values even reach the backend.
+type ThresholdRule struct {
+	// Pattern selects the values the rule applies to, as for WithInclude. It
+	// is matched against flattened names within their registry, without
+	// tags: "db.latency.99-percentile" for the 99th percentile of a timer.
+	Pattern string
+	// Breached reports whether a value is past the threshold.
+	Breached func(value float64) bool
+	// OnBreach, if set, is called when a value becomes breached.
+	OnBreach func(Breach)
+	// OnRecover, if set, is called when a breached value stops being so.
+	OnRecover func(Breach)
+	// Counter, if set, is the name of a counter in the main registry that is
+	// incremented every time a value becomes breached.
+	Counter string
+}
+
+// Breach describes a value crossing the threshold of a ThresholdRule.
+type Breach struct {
+	// Name is the flattened name of the value, as matched by the rule.
+	Name string
+	// Value is the value at the time of the publish it was crossed at.
+	Value float64
+	// Rule is the rule whose threshold was crossed.
+	Rule *ThresholdRule
+}
+
+// WithThresholds evaluates the given rules against every value at publish
+// time. A value becomes breached the first time the Breached function of a
+// rule matching it returns true, and recovers when it returns false again;
+// a value matched by several rules has a state for each. Callbacks run in the
+// publish loop, and must be quick.
+func WithThresholds(rules ...ThresholdRule) Option {
+	return func(mb *SquareMetrics) {
+		if mb.thresholds == nil {
+			mb.thresholds = &thresholds{breached: map[thresholdKey]bool{}}
+		}
+		for i := range rules {
+			rule := rules[i]
+			mb.thresholds.rules = append(mb.thresholds.rules, &rule)
+		}
+	}
+}
+
+// thresholds tracks which values are breached.
+type thresholds struct {
+	rules []*ThresholdRule
+
+	mutex    sync.Mutex
+	breached map[thresholdKey]bool // only ever true
+}
+
+type thresholdKey struct {
+	name string // the internal flattened name
+	rule *ThresholdRule
+}
+
+// evaluateThresholds applies the rules to the flattened values of a publish.
+func (mb *SquareMetrics) evaluateThresholds(nvs []tuple) {
+	t := mb.thresholds
+	var fired []func()
+	t.mutex.Lock()
+	for _, nv := range nvs {
+		var value float64
+		switch v := nv.value.(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		case sketchValue:
+			value = float64(v.count)
+		default:
+			continue
+		}
+		name, _ := SplitTaggedName(unqualified(nv.name))
+		for _, rule := range t.rules {
+			if !matchesAny(name, []string{rule.Pattern}) {
+				continue
+			}
+			key := thresholdKey{nv.name, rule}
+			breached := rule.Breached(value)
+			if breached == t.breached[key] {
+				continue
+			}
+			breach := Breach{Name: name, Value: value, Rule: rule}
+			if breached {
+				t.breached[key] = true
+				if rule.Counter != "" {
+					metrics.GetOrRegisterCounter(rule.Counter, mb.Registry).Inc(1)
+				}
+				if rule.OnBreach != nil {
+					fired = append(fired, func() { rule.OnBreach(breach) })
+				}
+			} else {
+				delete(t.breached, key)
+				if rule.OnRecover != nil {
+					fired = append(fired, func() { rule.OnRecover(breach) })
+				}
+			}
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, fire := range fired {
+		fire()
+	}
+}
+
+// forget drops the state of the values of a metric that was unregistered. The
+// values of other metrics named after it, as in "db" and "db.latency", are
+// forgotten too, at worst firing again.
+func (t *thresholds) forget(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	base, _ := SplitTaggedName(name)
+	for key := range t.breached {
+		flattened, _ := SplitTaggedName(key.name)
+		if key.name == name || strings.HasPrefix(flattened, base+".") {
+			delete(t.breached, key)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenFile is a credential read from a file, such as one maintained by
+// vault-agent or mounted from a Kubernetes secret, that may be rotated while
+// the process runs.
+type tokenFile struct {
+	path   string
+	header string
+	scheme string
+
+	mutex   sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// WithTokenFile authenticates requests to the bridge with a bearer token read
+// from the file at path. The file is checked before every publish and re-read
+// when it changes, and also when the bridge responds 401 Unauthorized, in
+// which case the batch is resent once if the token changed. If the file can't
+// be read, the last token read is used; publishes fail until one has been.
+func WithTokenFile(path string) Option {
+	return func(mb *SquareMetrics) {
+		mb.token = &tokenFile{path: path, header: "Authorization", scheme: "Bearer "}
+	}
+}
+
+// WithAPIKeyFile is like WithTokenFile, but sends the contents of the file as
+// is in the given header, e.g. X-API-Key.
+func WithAPIKeyFile(header, path string) Option {
+	return func(mb *SquareMetrics) {
+		mb.token = &tokenFile{path: path, header: header}
+	}
+}
+
+// authorize adds the credential to req, re-reading the file if it changed.
+func (t *tokenFile) authorize(req *http.Request) error {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.refresh(false)
+	if t.token == "" {
+		return fmt.Errorf("no metrics bridge credential in %s", t.path)
+	}
+	req.Header.Set(t.header, t.scheme+t.token)
+	return nil
+}
+
+// reload re-reads the file regardless of whether it seems to have changed, and
+// reports whether the credential changed.
+func (t *tokenFile) reload() bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.refresh(true)
+}
+
+// refresh re-reads the file if force is set or its size or modification time
+// changed, keeping the current credential if that fails. It reports whether
+// the credential changed.
+func (t *tokenFile) refresh(force bool) bool {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false
+	}
+	if !force && t.token != "" && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return false
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return false
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return false
+	}
+	changed := token != t.token
+	t.token, t.modTime, t.size = token, info.ModTime(), info.Size()
+	return changed
+}
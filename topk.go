@@ -0,0 +1,190 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// TopK tracks the most frequent items among those observed, such as the
+// heaviest callers or the largest keys, in bounded space. It uses the
+// Space-Saving algorithm: it counts at most capacity distinct items, and an
+// item that isn't counted replaces the one with the lowest count, taking over
+// its count. Counts are therefore upper bounds, overestimating by at most the
+// Error of each item, and the top items are exact for skewed distributions.
+//
+// Each of the k top items is serialized as a point with the name of the TopK,
+// its count as the value and the item in the "item" tag. Counts cover every
+// observation since the TopK was created or reset.
+type TopK struct {
+	k        int
+	capacity int
+
+	mutex   sync.Mutex
+	entries map[string]*topKEntry
+	counts  topKHeap        // the entries, lowest count first
+	emitted map[string]bool // flattened names serialized last time
+}
+
+// TopKItem is an item tracked by a TopK.
+type TopKItem struct {
+	Item  string
+	Count int64
+	// Error is the count the item took over when it replaced another one,
+	// the most its Count overestimates by.
+	Error int64
+}
+
+// topKEntry is a TopKItem with its position in the heap.
+type topKEntry struct {
+	TopKItem
+	index int
+}
+
+// topKHeap is a min-heap of entries by count, implementing heap.Interface.
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	entry := x.(*topKEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewTopK returns a TopK of the k most frequent items (at least 1), counting
+// at most capacity items (10 times k if zero). A larger capacity is more
+// accurate.
+func NewTopK(k, capacity int) *TopK {
+	if k < 1 {
+		k = 1
+	}
+	if capacity < k {
+		capacity = 10 * k
+	}
+	return &TopK{
+		k:        k,
+		capacity: capacity,
+		entries:  map[string]*topKEntry{},
+		emitted:  map[string]bool{},
+	}
+}
+
+// TopK returns the TopK with the given name, registering a new one of the k
+// most frequent items (at least 1) if needed. Its name must not be used by a
+// metric of the main registry.
+func (mb *SquareMetrics) TopK(name string, k int) *TopK {
+	return mb.custom.getOrRegister(name, func() customMetric {
+		return NewTopK(k, 0)
+	}).(*TopK)
+}
+
+// Observe counts one occurrence of item.
+func (t *TopK) Observe(item string) {
+	t.Add(item, 1)
+}
+
+// Add counts n occurrences of item.
+func (t *TopK) Add(item string, n int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if entry, ok := t.entries[item]; ok {
+		entry.Count += n
+		heap.Fix(&t.counts, entry.index)
+		return
+	}
+	if len(t.entries) < t.capacity {
+		entry := &topKEntry{TopKItem: TopKItem{Item: item, Count: n}}
+		t.entries[item] = entry
+		heap.Push(&t.counts, entry)
+		return
+	}
+
+	// the item takes over the entry with the lowest count
+	min := t.counts[0]
+	delete(t.entries, min.Item)
+	min.TopKItem = TopKItem{Item: item, Count: min.Count + n, Error: min.Count}
+	t.entries[item] = min
+	heap.Fix(&t.counts, 0)
+}
+
+// Top returns the k top items, most frequent first.
+func (t *TopK) Top() []TopKItem {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.top()
+}
+
+func (t *TopK) top() []TopKItem {
+	items := make([]TopKItem, 0, len(t.entries))
+	for _, entry := range t.entries {
+		items = append(items, entry.TopKItem)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Item < items[j].Item
+	})
+	if len(items) > t.k {
+		items = items[:t.k]
+	}
+	return items
+}
+
+// Reset forgets all items.
+func (t *TopK) Reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries = map[string]*topKEntry{}
+	t.counts = nil
+}
+
+func (t *TopK) flatten(names *nameCache, nvs []tuple, name string) []tuple {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	base, tags := SplitTaggedName(name)
+	emitted := make(map[string]bool, t.k)
+	for _, item := range t.top() {
+		flattened := TaggedName(base, mergeMaps(tags, map[string]string{"item": item.Item}))
+		nvs = append(nvs, tuple{flattened, item.Count, TopKType})
+		emitted[flattened] = true
+	}
+	// items come and go, so don't keep caching names for those that left
+	for flattened := range t.emitted {
+		if !emitted[flattened] {
+			names.forget(flattened)
+		}
+	}
+	t.emitted = emitted
+	return nvs
+}
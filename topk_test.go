@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+func TestTopKFindsTheHeavyHitters(t *testing.T) {
+	topK := sqmetrics.NewTopK(3, 30)
+	want := map[string]int64{"a": 1000, "b": 500, "c": 200}
+	for i := 0; i < 1000; i++ {
+		// the heavy hitters drown in a long tail of items seen once
+		for item, count := range want {
+			if int64(i) < count {
+				topK.Observe(item)
+			}
+		}
+		for j := 0; j < 5; j++ {
+			topK.Observe(fmt.Sprint("tail-", i, "-", j))
+		}
+	}
+
+	top := topK.Top()
+	if len(top) != 3 {
+		t.Fatalf("got %d items, want 3", len(top))
+	}
+	for i, item := range []string{"a", "b", "c"} {
+		got := top[i]
+		if got.Item != item {
+			t.Errorf("item %d is %q, want %q", i, got.Item, item)
+			continue
+		}
+		// counts are upper bounds, overestimating by at most Error
+		if got.Count < want[item] || got.Count-got.Error > want[item] {
+			t.Errorf("%s counted %d with error %d, want %d", item, got.Count, got.Error, want[item])
+		}
+	}
+}
+
+func TestTopKIsPublishedWithItemTags(t *testing.T) {
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, metrics.NewRegistry(), log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink))
+	defer mb.Close()
+	callers := mb.TopK("callers", 2)
+	callers.Add("web", 5)
+	callers.Add("batch", 3)
+	callers.Add("cron", 1)
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]interface{}{}
+	for _, point := range sink.Points() {
+		if point.Name == "app.callers" {
+			got[point.Tags["item"]] = point.Value
+		}
+	}
+	if len(got) != 2 || got["web"] != int64(5) || got["batch"] != int64(3) {
+		t.Errorf("published %v, want web 5 and batch 3", got)
+	}
+}
@@ -0,0 +1,95 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// ttl tracks when each metric last changed, so that metrics which haven't been
+// updated within the window can be left out of the payload. go-metrics doesn't
+// record update times, so a metric counts as updated when its value (or, for
+// histograms and timers, its count) differs from the one seen previously.
+type ttl struct {
+	window     time.Duration
+	unregister bool
+	prefixes   []string
+
+	mutex sync.Mutex
+	seen  map[string]ttlEntry
+}
+
+type ttlEntry struct {
+	value   interface{}
+	updated time.Time
+}
+
+// stale reports whether the metric has not changed within the window.
+func (t *ttl) stale(now time.Time, name string, metric interface{}) bool {
+	if !t.applies(unqualified(name)) {
+		return false
+	}
+
+	var value interface{}
+	switch metric := metric.(type) {
+	case metrics.Counter:
+		value = metric.Count()
+	case metrics.Gauge:
+		value = metric.Value()
+	case metrics.GaugeFloat64:
+		value = metric.Value()
+	case metrics.Histogram:
+		value = metric.Count()
+	case metrics.Timer:
+		value = metric.Count()
+	default:
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, ok := t.seen[name]
+	if !ok || entry.value != value {
+		t.seen[name] = ttlEntry{value, now}
+		return false
+	}
+	return now.Sub(entry.updated) > t.window
+}
+
+func (t *ttl) applies(name string) bool {
+	if len(t.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range t.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops the tracking state for a metric that was unregistered.
+func (t *ttl) forget(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.seen, name)
+}
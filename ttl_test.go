@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+// manualClock is the system clock, except for Now, which only moves when the
+// test advances it.
+type manualClock struct {
+	sqmetrics.Clock
+
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTTLExpiresUnchangedMetrics(t *testing.T) {
+	clock := &manualClock{Clock: sqmetrics.SystemClock(), now: time.Unix(1500000000, 0)}
+	registry := metrics.NewRegistry()
+	idle := metrics.GetOrRegisterCounter("clients.idle", registry)
+	busy := metrics.GetOrRegisterCounter("clients.busy", registry)
+	metrics.GetOrRegisterGauge("limit", registry).Update(10)
+	idle.Inc(1)
+	busy.Inc(1)
+
+	sink := &sqmetricstest.RecordingSink{}
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, log.New(io.Discard, "", 0),
+		sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink), sqmetrics.WithClock(clock),
+		sqmetrics.WithTTL(time.Minute, true, "clients."))
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(2 * time.Minute)
+	busy.Inc(1)
+	sink.Reset()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := sink.Latest("app.clients.idle"); ok {
+		t.Error("published the expired clients.idle")
+	}
+	sqmetricstest.AssertNotRegistered(t, registry, "clients.idle")
+	if _, ok := sink.Latest("app.clients.busy"); !ok {
+		t.Error("didn't publish the updated clients.busy")
+	}
+	if _, ok := sink.Latest("app.limit"); !ok {
+		t.Error("didn't publish limit, which is out of the TTL's scope")
+	}
+}
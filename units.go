@@ -0,0 +1,90 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// timerUnits are the units timers can be serialized in, other than
+// nanoseconds, with the names recorded in the unit tag.
+var timerUnits = map[time.Duration]string{
+	time.Microsecond: "us",
+	time.Millisecond: "ms",
+	time.Second:      "s",
+}
+
+// WithTimerUnit serializes the durations of timers (min, max, mean,
+// percentiles and bucket bounds) in unit rather than in nanoseconds, as
+// float64 values, so that dashboards don't have to convert them. The unit can
+// be time.Microsecond, time.Millisecond or time.Second, and is recorded in a
+// unit tag ("us", "ms" or "s") on every point of a timer but those of
+// exponential timers' buckets, which stay indexed in nanoseconds. The unit
+// applies to everything published, as well as to Snapshot and
+// SerializeMetrics; time.Nanosecond keeps the default, as do other units, with
+// a warning.
+func WithTimerUnit(unit time.Duration) Option {
+	return func(mb *SquareMetrics) {
+		if _, ok := timerUnits[unit]; !ok {
+			if unit != time.Nanosecond {
+				mb.logger.Printf("unsupported metrics timer unit %s, using nanoseconds", unit)
+			}
+			mb.timerUnit = 0
+			return
+		}
+		mb.timerUnit = unit
+	}
+}
+
+// appendTimerSummary appends the flattened values of a timer, converted to the
+// configured unit if any.
+func (mb *SquareMetrics) appendTimerSummary(nvs []tuple, name string, s summary) []tuple {
+	names := mb.names.summary(name, timerUnits[mb.timerUnit])
+	if mb.timerUnit == 0 {
+		return appendSummary(nvs, names, TimerType, s)
+	}
+	unit := float64(mb.timerUnit)
+	nvs = append(nvs,
+		tuple{names[0], s.count, TimerType},
+		tuple{names[1], float64(s.min) / unit, TimerType},
+		tuple{names[2], float64(s.max) / unit, TimerType},
+		tuple{names[3], s.mean / unit, TimerType},
+	)
+	for i, percentile := range s.percentiles {
+		nvs = append(nvs, tuple{names[4+i], percentile / unit, TimerType})
+	}
+	return nvs
+}
+
+// formatBound formats a bucket bound for the le tag, in unit if it is not 0.
+func formatBound(bound int64, unit time.Duration) string {
+	if unit == 0 {
+		return strconv.FormatInt(bound, 10)
+	}
+	return strconv.FormatFloat(float64(bound)/float64(unit), 'g', -1, 64)
+}
+
+// withUnit returns name with the unit tag merged into the tags it encodes, or
+// name itself if unit is empty.
+func withUnit(name, unit string) string {
+	if unit == "" {
+		return name
+	}
+	base, tags := SplitTaggedName(name)
+	return TaggedName(base, mergeMaps(tags, map[string]string{"unit": unit}))
+}
@@ -0,0 +1,68 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/go-sq-metrics/sqmetricstest"
+)
+
+// publishTimer publishes a timer of 1.5ms with the given logger and options,
+// and returns its published max.
+func publishTimer(t *testing.T, logger *log.Logger, options ...sqmetrics.Option) sqmetrics.MetricPoint {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterTimer("latency", registry).Update(1500 * time.Microsecond)
+	sink := &sqmetricstest.RecordingSink{}
+	options = append(options, sqmetrics.WithCollectors(0), sqmetrics.WithSink(sink))
+	mb := sqmetrics.NewMetrics("", "app", nil, time.Hour, registry, logger, options...)
+	defer mb.Close()
+	if err := mb.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	point, ok := sink.Latest("app.latency.max")
+	if !ok {
+		t.Fatal("latency.max not published")
+	}
+	return point
+}
+
+func TestWithTimerUnitConvertsDurations(t *testing.T) {
+	point := publishTimer(t, log.New(io.Discard, "", 0), sqmetrics.WithTimerUnit(time.Millisecond))
+	if point.Value != 1.5 || point.Tags["unit"] != "ms" {
+		t.Errorf("published %v with unit %q, want 1.5 ms", point.Value, point.Tags["unit"])
+	}
+}
+
+func TestWithTimerUnitKeepsNanosecondsForOtherUnits(t *testing.T) {
+	var logs bytes.Buffer
+	point := publishTimer(t, log.New(&logs, "", 0), sqmetrics.WithTimerUnit(time.Minute))
+	if point.Value != int64(1500000) || point.Tags["unit"] != "" {
+		t.Errorf("published %v with unit %q, want 1500000 nanoseconds", point.Value, point.Tags["unit"])
+	}
+	if !strings.Contains(logs.String(), "unsupported metrics timer unit 1m0s") {
+		t.Errorf("logged %q, want a warning", logs.String())
+	}
+}
@@ -0,0 +1,187 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"regexp"
+	"runtime"
+	"sync"
+	"weak"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Unregister removes the metric with the given name from the main registry,
+// along with everything remembered about it, so that dynamically created
+// series can be cleaned up. The removal is atomic with respect to
+// serialization: the collection of a publish or ServeHTTP in progress
+// completes first, and later ones don't include the metric. Callbacks
+// installed with AddGauge for it stop being called. Runtime metrics are
+// registered again at the next collection, unless their collectors are
+// disabled.
+//
+// Unregister doesn't wait for batches being posted to the bridge, so it can be
+// called from publish hooks and error handlers.
+func (mb *SquareMetrics) Unregister(name string) {
+	mb.settings.Lock()
+	defer mb.settings.Unlock()
+	metric := mb.Registry.Get(name)
+	if metric == nil {
+		metric = mb.custom.get(name)
+	}
+	mb.unregisterMetric(name, metric)
+}
+
+// UnregisterMatching removes, as Unregister does, every metric of every
+// registry whose name within its registry matches pattern, and returns the
+// number of metrics removed.
+func (mb *SquareMetrics) UnregisterMatching(pattern *regexp.Regexp) int {
+	mb.settings.Lock()
+	defer mb.settings.Unlock()
+
+	var matched []registryEntry
+	mb.eachMetric(func(name, registryName string, metric interface{}) {
+		if pattern.MatchString(registryName) {
+			matched = append(matched, registryEntry{name, registryName, metric})
+		}
+	})
+	for _, entry := range matched {
+		mb.unregisterMetric(entry.name, entry.metric)
+	}
+	return len(matched)
+}
+
+// unregisterMetric unregisters the metric with the given internal name, and
+// drops any gauge callback for it.
+func (mb *SquareMetrics) unregisterMetric(name string, metric interface{}) {
+	if metric == nil {
+		return
+	}
+	mb.unregister(name)
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	gauges := mb.gauges[:0]
+	for _, gauge := range mb.gauges {
+		if gauge.gauge != metric {
+			gauges = append(gauges, gauge)
+		}
+	}
+	mb.gauges = gauges
+}
+
+// UnregisterFrom removes the metric with the given name from registry, and
+// makes every SquareMetrics that publishes registry, as its main registry or
+// one added with WithRegistry, forget everything it remembers about it, as
+// Unregister does. Code that unregisters metrics from a registry without
+// access to the SquareMetrics publishing it, such as importers, should use it
+// rather than registry.Unregister. Metrics unregistered directly are only
+// forgotten at the next publish, and until then still count towards
+// WithMaxSeries.
+func UnregisterFrom(registry metrics.Registry, name string) {
+	registry.Unregister(name)
+	for _, mb := range instances.all() {
+		mb.forgetFrom(registry, name)
+	}
+}
+
+// forgetFrom forgets the metric with the given name in registry, if mb
+// publishes it.
+func (mb *SquareMetrics) forgetFrom(registry metrics.Registry, name string) {
+	mb.settings.Lock()
+	defer mb.settings.Unlock()
+	if registry == mb.Registry {
+		mb.forget(name)
+	}
+	for _, source := range mb.sources {
+		if source.registry == registry {
+			mb.forget(source.internalName(name))
+		}
+	}
+}
+
+// instances are the SquareMetrics that haven't been closed, for
+// UnregisterFrom. They are held weakly, so that the set doesn't keep alive
+// instances that are dropped without being closed.
+var instances = &instanceSet{set: map[weak.Pointer[SquareMetrics]]struct{}{}}
+
+type instanceSet struct {
+	mutex sync.Mutex
+	set   map[weak.Pointer[SquareMetrics]]struct{}
+}
+
+func (s *instanceSet) add(mb *SquareMetrics) {
+	pointer := weak.Make(mb)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set[pointer] = struct{}{}
+	runtime.AddCleanup(mb, s.drop, pointer)
+}
+
+func (s *instanceSet) remove(mb *SquareMetrics) {
+	s.drop(weak.Make(mb))
+}
+
+func (s *instanceSet) drop(pointer weak.Pointer[SquareMetrics]) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.set, pointer)
+}
+
+func (s *instanceSet) all() []*SquareMetrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	all := make([]*SquareMetrics, 0, len(s.set))
+	for pointer := range s.set {
+		if mb := pointer.Value(); mb != nil {
+			all = append(all, mb)
+		}
+	}
+	return all
+}
+
+// liveNames finds the metrics that were unregistered from their registry
+// directly, without going through SquareMetrics, so that what is remembered
+// about them (names, summaries, series cap slots...) can be forgotten. Every
+// publish marks the metrics it sees, and then sweeps those it didn't. It is
+// only used by publishes, under the settings lock.
+type liveNames struct {
+	generation uint64
+	seen       map[string]uint64
+}
+
+func newLiveNames() *liveNames {
+	return &liveNames{seen: map[string]uint64{}}
+}
+
+// mark records that a metric is still registered.
+func (l *liveNames) mark(name string) {
+	l.seen[name] = l.generation
+}
+
+// sweep returns the metrics that were not marked since the previous sweep.
+func (l *liveNames) sweep() []string {
+	var gone []string
+	for name, generation := range l.seen {
+		if generation != l.generation {
+			gone = append(gone, name)
+			delete(l.seen, name)
+		}
+	}
+	l.generation++
+	return gone
+}
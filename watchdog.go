@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// WithSystemdWatchdog notifies the systemd watchdog (sd_notify WATCHDOG=1)
+// whenever a batch is delivered, and only then, so that a wedged publish loop,
+// often the symptom of a wedged process, gets the service restarted. The
+// service's WatchdogSec must be comfortably longer than the publish interval;
+// a warning is logged if it is less than twice the interval. There must also
+// be somewhere to publish to, as dry runs don't count as deliveries. It does
+// nothing unless the process runs under systemd with the watchdog enabled for
+// it.
+func WithSystemdWatchdog() Option {
+	return func(mb *SquareMetrics) {
+		socket := os.Getenv("NOTIFY_SOCKET")
+		timeout, ok := watchdogTimeout()
+		if socket == "" || !ok {
+			return
+		}
+		if timeout < 2*mb.interval {
+			mb.logger.Printf("systemd watchdog timeout %s is too short for a metrics interval of %s", timeout, mb.interval)
+		}
+		mb.hooks = append(mb.hooks, func(event PublishEvent) {
+			// dry runs have neither a response nor a sink
+			if event.Err != nil || (event.StatusCode == 0 && mb.sink == nil) {
+				return
+			}
+			if err := notifySystemd(socket, "WATCHDOG=1"); err != nil {
+				mb.logger.Printf("error notifying the systemd watchdog: %s", err)
+			}
+		})
+	}
+}
+
+// watchdogTimeout returns the watchdog timeout systemd configured for this
+// process, and false if it doesn't expect watchdog notifications from it.
+func watchdogTimeout() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// notifySystemd sends a state update to systemd over its notification socket.
+// Sockets in the abstract namespace start with "@", which net handles.
+func notifySystemd(socket, state string) error {
+	conn, err := net.DialTimeout("unixgram", socket, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
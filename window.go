@@ -0,0 +1,220 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqmetrics
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// windowReservoirSize is the number of values kept for each sub-window of a
+// SlidingWindowSample.
+const windowReservoirSize = 1028
+
+// SlidingWindowSample is a metrics.Sample of the values recorded within the
+// last window, kept in a ring of sub-windows that expire one at a time, so
+// that percentiles reflect recent behavior rather than blending hours of
+// history as the exponentially decaying sample does. If a sub-window receives
+// more values than it can keep, a uniform sample of them is kept.
+//
+// Count is the number of values recorded since the sample was created or
+// cleared, as for other samples; Size is the number of values kept within
+// the window.
+type SlidingWindowSample struct {
+	mutex   sync.Mutex
+	width   time.Duration
+	windows []subWindow
+	count   int64
+}
+
+type subWindow struct {
+	index  int64 // time since the epoch, in widths
+	seen   int64 // values recorded in the sub-window, kept or not
+	values []int64
+}
+
+// NewSlidingWindowSample returns a sample of the values recorded within the
+// last window, divided in the given number of sub-windows. The window must be
+// positive, and at least as many nanoseconds as there are sub-windows.
+func NewSlidingWindowSample(window time.Duration, subWindows int) *SlidingWindowSample {
+	if subWindows < 1 {
+		subWindows = 1
+	}
+	if window <= 0 || window < time.Duration(subWindows) {
+		panic(fmt.Sprintf("sqmetrics: invalid sliding window of %s in %d sub-windows", window, subWindows))
+	}
+	return &SlidingWindowSample{
+		width:   window / time.Duration(subWindows),
+		windows: make([]subWindow, subWindows),
+	}
+}
+
+// NewSlidingWindowHistogram returns a histogram of the values recorded within
+// the last window, as for NewSlidingWindowSample.
+func NewSlidingWindowHistogram(window time.Duration, subWindows int) metrics.Histogram {
+	return metrics.NewHistogram(NewSlidingWindowSample(window, subWindows))
+}
+
+// NewSlidingWindowTimer returns a timer whose percentiles and other
+// statistics cover the durations recorded within the last window, as for
+// NewSlidingWindowSample. Its count and rates cover all durations.
+func NewSlidingWindowTimer(window time.Duration, subWindows int) metrics.Timer {
+	histogram := metrics.NewHistogram(NewSlidingWindowSample(window, subWindows))
+	return windowedTimer{metrics.NewCustomTimer(histogram, metrics.NewMeter())}
+}
+
+// GetOrRegisterSlidingWindowHistogram returns the histogram with the given
+// name, registering a sliding window histogram if needed.
+func GetOrRegisterSlidingWindowHistogram(name string, registry metrics.Registry, window time.Duration, subWindows int) metrics.Histogram {
+	return registry.GetOrRegister(name, func() metrics.Histogram {
+		return NewSlidingWindowHistogram(window, subWindows)
+	}).(metrics.Histogram)
+}
+
+// GetOrRegisterSlidingWindowTimer returns the timer with the given name,
+// registering a sliding window timer if needed.
+func GetOrRegisterSlidingWindowTimer(name string, registry metrics.Registry, window time.Duration, subWindows int) metrics.Timer {
+	return registry.GetOrRegister(name, func() metrics.Timer {
+		return NewSlidingWindowTimer(window, subWindows)
+	}).(metrics.Timer)
+}
+
+// windowed is implemented by the samples of histograms, and by timers, whose
+// summaries change as values expire, without updates, so that they are
+// summarized on every publish rather than reused by the summaryCache. Timers
+// don't expose their sample, so only those made by NewSlidingWindowTimer are
+// known to be windowed.
+type windowed interface {
+	slidingWindow()
+}
+
+func (*SlidingWindowSample) slidingWindow() {}
+
+type windowedTimer struct {
+	metrics.Timer
+}
+
+func (windowedTimer) slidingWindow() {}
+
+// current returns the index of the sub-window for now.
+func (s *SlidingWindowSample) current() int64 {
+	return time.Now().UnixNano() / int64(s.width)
+}
+
+// Clear removes all values.
+func (s *SlidingWindowSample) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.windows {
+		s.windows[i] = subWindow{}
+	}
+	s.count = 0
+}
+
+// Count returns the number of values recorded.
+func (s *SlidingWindowSample) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// Max returns the highest value within the window.
+func (s *SlidingWindowSample) Max() int64 {
+	return metrics.SampleMax(s.Values())
+}
+
+// Mean returns the mean of the values within the window.
+func (s *SlidingWindowSample) Mean() float64 {
+	return metrics.SampleMean(s.Values())
+}
+
+// Min returns the lowest value within the window.
+func (s *SlidingWindowSample) Min() int64 {
+	return metrics.SampleMin(s.Values())
+}
+
+// Percentile returns the value at the given quantile within the window.
+func (s *SlidingWindowSample) Percentile(p float64) float64 {
+	return metrics.SamplePercentile(s.Values(), p)
+}
+
+// Percentiles returns the values at the given quantiles within the window.
+func (s *SlidingWindowSample) Percentiles(ps []float64) []float64 {
+	return metrics.SamplePercentiles(s.Values(), ps)
+}
+
+// Size returns the number of values kept within the window.
+func (s *SlidingWindowSample) Size() int {
+	return len(s.Values())
+}
+
+// Snapshot returns a copy of the values within the window.
+func (s *SlidingWindowSample) Snapshot() metrics.Sample {
+	return metrics.NewSampleSnapshot(s.Count(), s.Values())
+}
+
+// StdDev returns the standard deviation of the values within the window.
+func (s *SlidingWindowSample) StdDev() float64 {
+	return metrics.SampleStdDev(s.Values())
+}
+
+// Sum returns the sum of the values within the window.
+func (s *SlidingWindowSample) Sum() int64 {
+	return metrics.SampleSum(s.Values())
+}
+
+// Update records a value in the current sub-window.
+func (s *SlidingWindowSample) Update(v int64) {
+	index := s.current()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.count++
+
+	window := &s.windows[index%int64(len(s.windows))]
+	if window.index != index {
+		window.index, window.seen, window.values = index, 0, window.values[:0]
+	}
+	window.seen++
+	if len(window.values) < windowReservoirSize {
+		window.values = append(window.values, v)
+	} else if r := rand.Int63n(window.seen); r < windowReservoirSize {
+		window.values[r] = v
+	}
+}
+
+// Values returns a copy of the values within the window.
+func (s *SlidingWindowSample) Values() []int64 {
+	index := s.current()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var values []int64
+	for _, window := range s.windows {
+		if window.index > index-int64(len(s.windows)) && window.index <= index {
+			values = append(values, window.values...)
+		}
+	}
+	return values
+}
+
+// Variance returns the variance of the values within the window.
+func (s *SlidingWindowSample) Variance() float64 {
+	return metrics.SampleVariance(s.Values())
+}